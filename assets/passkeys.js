@@ -0,0 +1,126 @@
+// Passkey buttons. A button with data-passkey="login" signs in with a
+// passkey, data-passkey="register" adds one to the account. Both post
+// to data-begin for the options, ask the browser for the passkey and
+// post its response to data-finish, then follow the redirect that
+// comes back. Errors are shown in the element named by data-error.
+(function() {
+  if (!window.PublicKeyCredential) {
+    return;
+  }
+
+  function toBuffer(s) {
+    s = s.replace(/-/g, "+").replace(/_/g, "/");
+    while (s.length % 4) {
+      s += "=";
+    }
+    var bin = atob(s);
+    var buf = new Uint8Array(bin.length);
+    for (var i = 0; i < bin.length; i++) {
+      buf[i] = bin.charCodeAt(i);
+    }
+    return buf.buffer;
+  }
+
+  function toBase64URL(buf) {
+    var bin = "";
+    var bytes = new Uint8Array(buf);
+    for (var i = 0; i < bytes.length; i++) {
+      bin += String.fromCharCode(bytes[i]);
+    }
+    return btoa(bin).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+  }
+
+  function post(url, body, csrfToken) {
+    return fetch(url, {
+      method: "POST",
+      credentials: "same-origin",
+      headers: {"Content-Type": "application/json", "X-CSRF-Token": csrfToken},
+      body: body ? JSON.stringify(body) : null,
+    }).then(function(res) {
+      return res.json().then(function(data) {
+        if (!res.ok) {
+          throw new Error(data.error || "Something went wrong.");
+        }
+        return data;
+      });
+    });
+  }
+
+  function descriptors(list) {
+    return (list || []).map(function(c) {
+      return {type: c.type, id: toBuffer(c.id), transports: c.transports};
+    });
+  }
+
+  function register(options) {
+    var pk = options.publicKey;
+    pk.challenge = toBuffer(pk.challenge);
+    pk.user.id = toBuffer(pk.user.id);
+    pk.excludeCredentials = descriptors(pk.excludeCredentials);
+    return navigator.credentials.create({publicKey: pk}).then(function(cred) {
+      return {
+        id: cred.id,
+        rawId: toBase64URL(cred.rawId),
+        type: cred.type,
+        response: {
+          clientDataJSON: toBase64URL(cred.response.clientDataJSON),
+          attestationObject: toBase64URL(cred.response.attestationObject),
+          transports: cred.response.getTransports ? cred.response.getTransports() : [],
+        },
+      };
+    });
+  }
+
+  function login(options) {
+    var pk = options.publicKey;
+    pk.challenge = toBuffer(pk.challenge);
+    pk.allowCredentials = descriptors(pk.allowCredentials);
+    return navigator.credentials.get({publicKey: pk}).then(function(cred) {
+      var res = cred.response;
+      return {
+        id: cred.id,
+        rawId: toBase64URL(cred.rawId),
+        type: cred.type,
+        response: {
+          clientDataJSON: toBase64URL(res.clientDataJSON),
+          authenticatorData: toBase64URL(res.authenticatorData),
+          signature: toBase64URL(res.signature),
+          userHandle: res.userHandle ? toBase64URL(res.userHandle) : null,
+        },
+      };
+    });
+  }
+
+  document.querySelectorAll("[data-passkey]").forEach(function(button) {
+    var form = button.closest("form");
+    var csrfToken = form.querySelector("input[name='gorilla.csrf.Token']").value;
+    var errors = document.getElementById(button.dataset.error);
+    var ceremony = button.dataset.passkey === "register" ? register : login;
+    form.hidden = false;
+    form.addEventListener("submit", function(e) {
+      e.preventDefault();
+      errors.textContent = "";
+      button.disabled = true;
+      var finish = button.dataset.finish;
+      var name = form.querySelector("input[name=name]");
+      if (name) {
+        finish += "?name=" + encodeURIComponent(name.value);
+      }
+      post(button.dataset.begin, null, csrfToken)
+        .then(ceremony)
+        .then(function(response) {
+          return post(finish, response, csrfToken);
+        })
+        .then(function(data) {
+          window.location = data.redirect;
+        })
+        .catch(function(err) {
+          // Cancelling the browser's prompt is not worth an error
+          if (err.name !== "NotAllowedError") {
+            errors.textContent = err.message;
+          }
+          button.disabled = false;
+        });
+    });
+  });
+})();
@@ -2,8 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 )
 
 type PostgresConfig struct {
@@ -43,12 +45,40 @@ type Config struct {
 	Database PostgresConfig `json:"database"`
 	Mailgun  MailgunConfig  `json:"mailgun"`
 	Dropbox  OAuthConfig    `json:"dropbox"`
+	Storage  StorageConfig  `json:"storage"`
+
+	// EncryptionKey encrypts the secrets kept in the database that
+	// have to be read back, such as two-factor authentication keys.
+	// Users with two-factor authentication can't sign in if it changes.
+	EncryptionKey string `json:"encryption_key"`
+
+	WebAuthn WebAuthnConfig `json:"webauthn"`
 }
 
 func (c Config) IsProd() bool {
 	return c.Env == "prod"
 }
 
+// Validate reports the settings a .config file must have that older
+// ones may be missing, rather than starting without them
+func (c Config) Validate() error {
+	var missing []string
+	if c.EncryptionKey == "" {
+		missing = append(missing, "encryption_key")
+	}
+	if c.WebAuthn.RPID == "" {
+		missing = append(missing, "webauthn.rp_id")
+	}
+	if len(c.WebAuthn.Origins) == 0 {
+		missing = append(missing, "webauthn.origins")
+	}
+	if len(missing) > 0 {
+		return errors.New(".config is missing " + strings.Join(missing, ", ") +
+			", see DefaultConfig in config.go for example values")
+	}
+	return nil
+}
+
 func DefaultConfig() Config {
 	return Config{
 		Port:     3000,
@@ -56,6 +86,10 @@ func DefaultConfig() Config {
 		Pepper:   "some-secret",
 		HMACKey:  "secret-hmac-key",
 		Database: DefaultPostgresConfig(),
+		Storage:  DefaultStorageConfig(),
+
+		EncryptionKey: "secret-encryption-key",
+		WebAuthn:      DefaultWebAuthnConfig(),
 	}
 }
 
@@ -65,6 +99,50 @@ type MailgunConfig struct {
 	Domain       string `json:"domain"`
 }
 
+// StorageConfig selects where image files are kept. Backend is
+// either "disk" (the default) or "s3". UploadDir is where resumable
+// uploads are kept on local disk until they are complete, whatever
+// the backend.
+type StorageConfig struct {
+	Backend   string   `json:"backend"`
+	Dir       string   `json:"dir"`
+	UploadDir string   `json:"upload_dir"`
+	S3        S3Config `json:"s3"`
+}
+
+func DefaultStorageConfig() StorageConfig {
+	return StorageConfig{
+		Backend:   "disk",
+		Dir:       "./images/",
+		UploadDir: "./uploads/",
+	}
+}
+
+// S3Config works with AWS S3 or any S3 compatible service like MinIO
+type S3Config struct {
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+}
+
+// WebAuthnConfig is where the site is served from, for passkeys.
+// RPID is the domain passkeys are tied to, eg "example.com", and
+// Origins the URLs the site is reached at, eg "https://example.com".
+// Passkeys stop working if RPID changes.
+type WebAuthnConfig struct {
+	RPID    string   `json:"rp_id"`
+	Origins []string `json:"origins"`
+}
+
+func DefaultWebAuthnConfig() WebAuthnConfig {
+	return WebAuthnConfig{
+		RPID:    "localhost",
+		Origins: []string{"http://localhost:3000"},
+	}
+}
+
 type OAuthConfig struct {
 	ID       string `json:"id"`
 	Secret   string `json:"secret"`
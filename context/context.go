@@ -7,7 +7,8 @@ import (
 )
 
 const (
-	userKey privateKey = "user"
+	userKey    privateKey = "user"
+	sessionKey privateKey = "session"
 )
 
 type privateKey string
@@ -24,3 +25,17 @@ func User(ctx context.Context) *models.User {
 	}
 	return nil
 }
+
+// WithSession stores the session the current user is signed in with
+func WithSession(ctx context.Context, session *models.Session) context.Context {
+	return context.WithValue(ctx, sessionKey, session)
+}
+
+func Session(ctx context.Context) *models.Session {
+	if temp := ctx.Value(sessionKey); temp != nil {
+		if session, ok := temp.(*models.Session); ok {
+			return session
+		}
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/imattf/go-courses/gallery/context"
+	"github.com/imattf/go-courses/gallery/models"
+	"github.com/imattf/go-courses/gallery/views"
+)
+
+// NameForm changes the user's name
+type NameForm struct {
+	Name string `schema:"name"`
+}
+
+// EmailForm changes the user's email address. The password is asked
+// for so someone who finds a signed in device can't take the account
+// over with a password reset.
+type EmailForm struct {
+	Email    string `schema:"email"`
+	Password string `schema:"password"`
+}
+
+// PasswordForm changes the user's password
+type PasswordForm struct {
+	Password    string `schema:"password"`
+	NewPassword string `schema:"new_password"`
+}
+
+// AccountData is what the account page is rendered with
+type AccountData struct {
+	Sessions    []models.Session
+	Passkeys    []models.WebAuthnCredential
+	TOTPEnabled bool
+	Name        string
+	Email       string
+	Verified    bool
+
+	// CurrentSessionID is the session of the device viewing the page
+	CurrentSessionID uint
+}
+
+// Account shows the user's profile, the devices they are signed in
+// on, their passkeys and whether they use two-factor authentication.
+//
+// GET /account
+func (u *Users) Account(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	vd.Yield = u.accountData(r)
+	u.AccountView.Render(w, r, vd)
+}
+
+// NameUpdate changes the name the user is greeted by.
+//
+// POST /account/name
+func (u *Users) NameUpdate(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var form NameForm
+	if err := parseForm(r, &form); err != nil {
+		u.renderAccountError(w, r, err)
+		return
+	}
+	// Changes are made to a copy, so the page shows the saved values
+	// if they fail
+	updated := *user
+	updated.Name = strings.TrimSpace(form.Name)
+	if err := u.us.Update(&updated); err != nil {
+		u.renderAccountError(w, r, err)
+		return
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Your name was updated.",
+	})
+}
+
+// EmailUpdate changes the user's email address, which then has to be
+// verified again. The old address is told about the change.
+//
+// POST /account/email
+func (u *Users) EmailUpdate(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var form EmailForm
+	if err := parseForm(r, &form); err != nil {
+		u.renderAccountError(w, r, err)
+		return
+	}
+	if _, err := u.us.Authenticate(user.Email, form.Password); err != nil {
+		u.renderAccountError(w, r, err)
+		return
+	}
+	updated := *user
+	updated.Email = form.Email
+	if err := u.us.Update(&updated); err != nil {
+		u.renderAccountError(w, r, err)
+		return
+	}
+	if updated.Email == user.Email {
+		http.Redirect(w, r, "/account", http.StatusFound)
+		return
+	}
+	if err := u.emailer.EmailChanged(user.Name, user.Email, updated.Email); err != nil {
+		log.Println(err)
+	}
+	if err := u.sendVerification(&updated); err != nil {
+		log.Println(err)
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Your email address was changed. Please follow the link we sent to " + updated.Email + " to verify it.",
+	})
+}
+
+// PasswordUpdate changes the user's password once they enter their
+// current one, and signs them out on their other devices.
+//
+// POST /account/password
+func (u *Users) PasswordUpdate(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var form PasswordForm
+	if err := parseForm(r, &form); err != nil {
+		u.renderAccountError(w, r, err)
+		return
+	}
+	if form.NewPassword == "" {
+		u.renderAccountError(w, r, models.ErrPasswordRequired)
+		return
+	}
+	if _, err := u.us.Authenticate(user.Email, form.Password); err != nil {
+		u.renderAccountError(w, r, err)
+		return
+	}
+	updated := *user
+	updated.Password = form.NewPassword
+	if err := u.us.Update(&updated); err != nil {
+		u.renderAccountError(w, r, err)
+		return
+	}
+	var current uint
+	if session := context.Session(r.Context()); session != nil {
+		current = session.ID
+	}
+	if err := u.ss.DeleteByUserID(user.ID, current); err != nil {
+		log.Println(err)
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Your password was changed and your other devices were signed out.",
+	})
+}
+
+// SessionDelete signs one of the user's devices out.
+//
+// POST /account/sessions/:id/delete
+func (u *Users) SessionDelete(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	var session *models.Session
+	sessions, err := u.ss.ByUserID(user.ID)
+	for i := range sessions {
+		if sessions[i].ID == uint(id) {
+			session = &sessions[i]
+		}
+	}
+	if err == nil && session == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = u.ss.Delete(session.ID)
+	}
+	if err != nil {
+		u.renderAccountError(w, r, err)
+		return
+	}
+	if current := context.Session(r.Context()); current != nil && current.ID == session.ID {
+		// Signing out this device is the same as logging out
+		clearSessionCookie(w, r)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: session.Device() + " was signed out.",
+	})
+}
+
+// SessionDeleteOthers signs the user out on every device but this one.
+//
+// POST /account/sessions/delete
+func (u *Users) SessionDeleteOthers(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var current uint
+	if session := context.Session(r.Context()); session != nil {
+		current = session.ID
+	}
+	if err := u.ss.DeleteByUserID(user.ID, current); err != nil {
+		u.renderAccountError(w, r, err)
+		return
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "You have been signed out on every other device.",
+	})
+}
+
+func (u *Users) accountData(r *http.Request) *AccountData {
+	user := context.User(r.Context())
+	data := AccountData{
+		TOTPEnabled: user.TOTPEnabled(),
+		Name:        user.Name,
+		Email:       user.Email,
+		Verified:    user.Verified(),
+	}
+	if session := context.Session(r.Context()); session != nil {
+		data.CurrentSessionID = session.ID
+	}
+	var err error
+	data.Sessions, err = u.ss.ByUserID(user.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	data.Passkeys, err = u.ws.ByUserID(user.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	return &data
+}
+
+func (u *Users) renderAccountError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Println(err)
+	var vd views.Data
+	vd.SetAlert(err)
+	vd.Yield = u.accountData(r)
+	u.AccountView.Render(w, r, vd)
+}
@@ -0,0 +1,155 @@
+package controllers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/imattf/go-courses/gallery/models"
+	"github.com/imattf/go-courses/gallery/storage"
+)
+
+// manifestName is the file in every download listing the images
+// along with their titles and captions
+const manifestName = "manifest.json"
+
+// downloadManifest is written to manifestName
+type downloadManifest struct {
+	Gallery   string          `json:"gallery"`
+	Originals bool            `json:"originals"`
+	Created   time.Time       `json:"created"`
+	Images    []manifestImage `json:"images"`
+
+	// Missing lists images whose files could not be read
+	Missing []string `json:"missing,omitempty"`
+}
+
+type manifestImage struct {
+	File    string `json:"file"`
+	Title   string `json:"title,omitempty"`
+	AltText string `json:"alt_text,omitempty"`
+	Caption string `json:"caption,omitempty"`
+}
+
+// Download streams a ZIP archive of every image in the gallery to
+// anyone who can see it. The owner gets the originals, everyone else
+// the copies they would be served, so the metadata policy applies to
+// downloads too. Images are copied straight from the BlobStore into
+// the response one at a time, so the archive is never held in memory.
+//
+// GET /galleries/:id/download
+func (g *Galleries) Download(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.canView(w, r, gallery) {
+		return
+	}
+	images, err := g.is.ByGalleryID(gallery.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Whoops! ...Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	originals := models.RoleAllows(g.role(r, gallery), models.ActionManage)
+	open := g.is.Published
+	if originals {
+		open = g.is.Original
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="%s.zip"`, archiveName(gallery)))
+
+	manifest := downloadManifest{
+		Gallery:   gallery.Title,
+		Originals: originals,
+		Created:   time.Now().UTC(),
+	}
+	zw := zip.NewWriter(w)
+	for i := range images {
+		image := &images[i]
+		// Prefixing the position keeps the files in gallery order
+		name := fmt.Sprintf("%03d-%s", i+1, image.Filename)
+		err := addToArchive(zw, name, image, open)
+		if err == storage.ErrNotFound {
+			manifest.Missing = append(manifest.Missing, image.Filename)
+			continue
+		}
+		if err != nil {
+			// The response has started, so all we can do is stop and
+			// leave the client with a truncated archive
+			log.Println(err)
+			return
+		}
+		manifest.Images = append(manifest.Images, manifestImage{
+			File:    name,
+			Title:   image.Title,
+			AltText: image.AltText,
+			Caption: image.Caption,
+		})
+	}
+	mw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     manifestName,
+		Method:   zip.Deflate,
+		Modified: manifest.Created,
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	enc := json.NewEncoder(mw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		log.Println(err)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		log.Println(err)
+	}
+}
+
+// addToArchive copies the image file returned by open into zw. Images
+// are already compressed, so they are stored rather than deflated.
+func addToArchive(zw *zip.Writer, name string, image *models.Image, open func(*models.Image) (io.ReadCloser, error)) error {
+	rc, err := open(image)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: image.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, rc)
+	return err
+}
+
+// archiveName is the filename offered for a gallery's archive, made
+// of the letters and digits in its title.
+func archiveName(gallery *models.Gallery) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == ' ' || r == '-' || r == '_':
+			return '-'
+		}
+		return -1
+	}, gallery.Title)
+	name = strings.Trim(name, "-")
+	if name == "" {
+		return fmt.Sprintf("gallery-%d", gallery.ID)
+	}
+	return name
+}
@@ -1,17 +1,24 @@
 package controllers
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 
 	"github.com/imattf/go-courses/gallery/context"
+	"github.com/imattf/go-courses/gallery/email"
+	"github.com/imattf/go-courses/gallery/fetch"
 	"github.com/imattf/go-courses/gallery/models"
+	"github.com/imattf/go-courses/gallery/storage"
+	"github.com/imattf/go-courses/gallery/tus"
+	"github.com/imattf/go-courses/gallery/unzip"
 	"github.com/imattf/go-courses/gallery/views"
 )
 
@@ -20,32 +27,174 @@ const (
 	EditGallery = "edit_gallery"
 
 	maxMultipartMem = 1 << 20 // 1 megabyte
+
+	// galleryUnlockTTL is how long a gallery stays unlocked after its
+	// password is entered
+	galleryUnlockTTL = 12 * time.Hour
+
+	// shareVisitTTL is how long the images of a gallery can be loaded
+	// after it is opened with a share link, see sharedWith
+	shareVisitTTL = time.Hour
+
+	// maxLinks is the most image links that can be added at once
+	maxLinks = 100
 )
 
-func NewGalleries(gs models.GalleryService, is models.ImageService, r *mux.Router) *Galleries {
+func NewGalleries(gs models.GalleryService, is models.ImageService, sls models.ShareLinkService, ms models.GalleryMemberService, store storage.BlobStore, uploads *tus.Store, emailer *email.Client, r *mux.Router) *Galleries {
 	return &Galleries{
-		New:       views.NewView("bootstrap", "galleries/new"),
-		ShowView:  views.NewView("bootstrap", "galleries/show"),
-		EditView:  views.NewView("bootstrap", "galleries/edit"),
-		IndexView: views.NewView("bootstrap", "galleries/index"),
-		gs:        gs,
-		is:        is,
-		r:         r,
+		New:         views.NewView("bootstrap", "galleries/new"),
+		ShowView:    views.NewView("bootstrap", "galleries/show"),
+		ImageView:   views.NewView("bootstrap", "galleries/image"),
+		UnlockView:  views.NewView("bootstrap", "galleries/unlock"),
+		EditView:    views.NewView("bootstrap", "galleries/edit"),
+		IndexView:   views.NewView("bootstrap", "galleries/index"),
+		SimilarView: views.NewView("bootstrap", "galleries/similar"),
+		TrashView:   views.NewView("bootstrap", "trash/index"),
+		gs:          gs,
+		is:          is,
+		sls:         sls,
+		ms:          ms,
+		emailer:     emailer,
+		store:       store,
+		uploads:     uploads,
+		r:           r,
+		fetcher:     fetch.New(fetch.WithMaxSize(models.MaxImageSize)),
+		unzipper:    unzip.New(unzip.WithMaxEntrySize(models.MaxImageSize)),
 	}
 }
 
 type Galleries struct {
-	New       *views.View
-	ShowView  *views.View
-	EditView  *views.View
-	IndexView *views.View
-	gs        models.GalleryService
-	is        models.ImageService
-	r         *mux.Router
+	New         *views.View
+	ShowView    *views.View
+	ImageView   *views.View
+	UnlockView  *views.View
+	EditView    *views.View
+	IndexView   *views.View
+	SimilarView *views.View
+	TrashView   *views.View
+	gs          models.GalleryService
+	is          models.ImageService
+	sls         models.ShareLinkService
+	ms          models.GalleryMemberService
+	emailer     *email.Client
+	store       storage.BlobStore
+	uploads     *tus.Store
+	r           *mux.Router
+	fetcher     *fetch.Fetcher
+	unzipper    *unzip.Extractor
 }
 
 type GalleryForm struct {
-	Title string `schema:"title"`
+	Title          string `schema:"title"`
+	Visibility     string `schema:"visibility"`
+	MetadataPolicy string `schema:"metadata_policy"`
+	Password       string `schema:"password"`
+	RemovePassword bool   `schema:"remove_password"`
+}
+
+// UnlockForm is used to enter the password of a gallery
+type UnlockForm struct {
+	Password string `schema:"password"`
+}
+
+// ImageForm is the text the owner can set on an image
+type ImageForm struct {
+	Title   string `schema:"title"`
+	AltText string `schema:"alt_text"`
+	Caption string `schema:"caption"`
+}
+
+// ImageOrderForm lists image IDs in the order they should be shown
+type ImageOrderForm struct {
+	Order []uint `schema:"order"`
+}
+
+// EditGalleryData is what the edit gallery view is rendered with.
+type EditGalleryData struct {
+	*models.Gallery
+
+	// LinkResults reports on each link posted to ImageViaLink
+	LinkResults []LinkResult
+
+	// ArchiveResults reports on each file in an archive posted to
+	// ImageArchive
+	ArchiveResults []ArchiveResult
+
+	// ShareLinks are the gallery's active share links, and NewShareURL
+	// is the address of a link that was just created
+	ShareLinks  []models.ShareLink
+	NewShareURL string
+
+	Members []models.GalleryMember
+
+	// Role is the current user's role on the gallery, which decides
+	// which parts of the page are shown
+	Role string
+}
+
+// editData loads everything the edit view shows besides the gallery.
+// Share links and members are only loaded for people who can manage
+// them.
+func (g *Galleries) editData(r *http.Request, gallery *models.Gallery) *EditGalleryData {
+	data := &EditGalleryData{
+		Gallery: gallery,
+		Role:    g.role(r, gallery),
+	}
+	if !data.CanManage() {
+		return data
+	}
+	var err error
+	data.ShareLinks, err = g.sls.ActiveByGalleryID(gallery.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	data.Members, err = g.ms.ByGalleryID(gallery.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	return data
+}
+
+// CanEdit reports whether the current user can rename the gallery
+// and edit its images
+func (d *EditGalleryData) CanEdit() bool {
+	return models.RoleAllows(d.Role, models.ActionEdit)
+}
+
+// CanManage reports whether the current user can change who can see
+// the gallery
+func (d *EditGalleryData) CanManage() bool {
+	return models.RoleAllows(d.Role, models.ActionManage)
+}
+
+// CanDelete reports whether the current user can delete the gallery
+func (d *EditGalleryData) CanDelete() bool {
+	return models.RoleAllows(d.Role, models.ActionDelete)
+}
+
+// Visibilities lists the options for the gallery visibility setting
+func (d *EditGalleryData) Visibilities() interface{} {
+	return models.Visibilities
+}
+
+// MetadataPolicies lists the options for the gallery metadata setting
+func (d *EditGalleryData) MetadataPolicies() interface{} {
+	return models.MetadataPolicies
+}
+
+// LinkResult is the outcome of adding an image from a single link.
+// Error is empty when the image was added.
+type LinkResult struct {
+	URL      string
+	Filename string
+	Error    string
+}
+
+// ArchiveResult is the outcome of adding one file from a ZIP archive
+type ArchiveResult struct {
+	Entry    string
+	Filename string
+	Error    string
 }
 
 // Create is used to create the Gallery form, used
@@ -88,35 +237,180 @@ func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Something went wrong!", http.StatusInternalServerError)
 		return
 	}
+	var shared []SharedGallery
+	members, err := g.ms.ByUserID(user.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	for _, m := range members {
+		gallery, err := g.gs.ByID(m.GalleryID)
+		if err != nil {
+			continue
+		}
+		shared = append(shared, SharedGallery{Gallery: *gallery, Role: m.Role})
+	}
+
+	// Load every gallery's images in one go so the index can show
+	// their cover images
+	var ids []uint
+	for _, gallery := range galleries {
+		ids = append(ids, gallery.ID)
+	}
+	for _, sg := range shared {
+		ids = append(ids, sg.ID)
+	}
+	images, err := g.is.ByGalleryIDs(ids)
+	if err != nil {
+		log.Println(err)
+	}
+	byGallery := make(map[uint][]models.Image)
+	for _, image := range images {
+		byGallery[image.GalleryID] = append(byGallery[image.GalleryID], image)
+	}
+	for i := range galleries {
+		galleries[i].Images = byGallery[galleries[i].ID]
+	}
+	for i := range shared {
+		shared[i].Images = byGallery[shared[i].ID]
+	}
 	var vd views.Data
-	vd.Yield = galleries
+	vd.Yield = &IndexData{
+		Galleries: galleries,
+		Shared:    shared,
+	}
 	g.IndexView.Render(w, r, vd)
 }
 
+// IndexData is what the gallery index view is rendered with.
+type IndexData struct {
+	Galleries []models.Gallery
+
+	// Shared are the galleries other people invited the user to
+	Shared []SharedGallery
+}
+
+// SharedGallery is a gallery along with the user's role on it
+type SharedGallery struct {
+	models.Gallery
+	Role string
+}
+
+// CanEdit reports whether the role lets the user open the edit page
+func (sg *SharedGallery) CanEdit() bool {
+	return models.RoleAllows(sg.Role, models.ActionUpload)
+}
+
 // GET /galleries/:id
 func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r)
 	if err != nil {
 		return
 	}
+	if gallery.Unlockable() && !g.visible(r, gallery) {
+		var vd views.Data
+		vd.Yield = gallery
+		g.UnlockView.Render(w, r, vd)
+		return
+	}
+	if !g.canView(w, r, gallery) {
+		return
+	}
+	user := context.User(r.Context())
+	isOwner := gallery.IsOwner(user)
+	if !isOwner {
+		gallery.RedactMetadata()
+	}
 	var vd views.Data
-	vd.Yield = gallery
+	vd.Yield = &ShowGalleryData{
+		Gallery: gallery,
+		IsOwner: isOwner,
+		CanEdit: models.RoleAllows(g.role(r, gallery), models.ActionUpload),
+	}
 	g.ShowView.Render(w, r, vd)
 }
 
+// ShowGalleryData is what the show gallery view is rendered with.
+// CanEdit is set for anyone who can get to the edit page.
+type ShowGalleryData struct {
+	*models.Gallery
+	IsOwner bool
+	CanEdit bool
+}
+
+// ImageData is what the image detail view is rendered with.
+type ImageData struct {
+	Gallery *models.Gallery
+	Image   *models.Image
+	IsOwner bool
+}
+
+// GET /galleries/:id/images/:filename
+func (g *Galleries) ImageShow(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.canView(w, r, gallery) {
+		return
+	}
+	image, err := g.imageByFilename(w, r, gallery)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	isOwner := gallery.IsOwner(user)
+	if !isOwner {
+		image.Exif = image.Exif.Redacted(gallery.MetadataPolicy)
+	}
+	var vd views.Data
+	vd.Yield = &ImageData{
+		Gallery: gallery,
+		Image:   image,
+		IsOwner: isOwner,
+	}
+	g.ImageView.Render(w, r, vd)
+}
+
+// ImageOriginal serves the untouched upload, including all of its
+// metadata, to the owner of the gallery.
+//
+// GET /galleries/:id/images/:filename/original
+func (g *Galleries) ImageOriginal(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.authorize(w, r, gallery, models.ActionManage) {
+		return
+	}
+	image, err := g.imageByFilename(w, r, gallery)
+	if err != nil {
+		return
+	}
+	rc, err := g.is.Original(image)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Whoops! ...Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Type", image.ContentType)
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", image.Size))
+	w.Header().Set("Cache-Control", "private")
+	io.Copy(w, rc)
+}
+
 // GET /galleries/:id/edit
 func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r)
 	if err != nil {
 		return
 	}
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if !g.authorize(w, r, gallery, models.ActionUpload) {
 		return
 	}
 	var vd views.Data
-	vd.Yield = gallery
+	vd.Yield = g.editData(r, gallery)
 	g.EditView.Render(w, r, vd)
 }
 
@@ -126,13 +420,11 @@ func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if !g.authorize(w, r, gallery, models.ActionEdit) {
 		return
 	}
 	var vd views.Data
-	vd.Yield = gallery
+	vd.Yield = g.editData(r, gallery)
 	var form GalleryForm
 	if err := parseForm(r, &form); err != nil {
 		vd.SetAlert(err)
@@ -140,12 +432,37 @@ func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	gallery.Title = form.Title
+	// Editors can rename the gallery, but only the owner can change
+	// who sees it and what they see
+	canManage := models.RoleAllows(g.role(r, gallery), models.ActionManage)
+	if canManage && form.Visibility != "" {
+		gallery.Visibility = form.Visibility
+	}
+	if canManage {
+		if form.RemovePassword {
+			gallery.PasswordHash = ""
+		} else {
+			gallery.Password = form.Password
+		}
+	}
+	policyChanged := canManage && form.MetadataPolicy != "" && form.MetadataPolicy != gallery.MetadataPolicy
+	if policyChanged {
+		gallery.MetadataPolicy = form.MetadataPolicy
+	}
 	err = g.gs.Update(gallery)
 	if err != nil {
 		vd.SetAlert(err)
 		g.EditView.Render(w, r, vd)
 		return
 	}
+	if policyChanged {
+		err = g.is.Republish(gallery)
+		if err != nil {
+			vd.SetAlert(err)
+			g.EditView.Render(w, r, vd)
+			return
+		}
+	}
 	vd.Alert = &views.Alert{
 		Level:   views.AlertLevelSuccess,
 		Message: "Gallery successfully updated",
@@ -159,19 +476,189 @@ func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if !g.authorize(w, r, gallery, models.ActionDelete) {
 		return
 	}
 	var vd views.Data
 	err = g.gs.Delete(gallery.ID)
+	if err == nil {
+		// The files stop being served along with the gallery and are
+		// removed once TrashRetention has passed, unless it is restored
+		err = g.is.DeleteGallery(gallery.ID)
+	}
 	if err != nil {
 		vd.SetAlert(err)
-		vd.Yield = gallery
+		vd.Yield = g.editData(r, gallery)
 		g.EditView.Render(w, r, vd)
+		return
+	}
+	views.RedirectAlert(w, r, "/galleries", http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: gallery.Title + " was moved to the trash.",
+	})
+}
+
+// ImageFile serves the files under /images/ after checking the
+// gallery they belong to may be seen by the current user. Originals
+// are never served here, see ImageOriginal.
+//
+// GET /images/*key
+func (g *Galleries) ImageFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := r.URL.Path
+	id, ok := models.PublicKeyGalleryID(key)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	gallery, err := g.gs.ByID(id)
+	if err != nil {
+		if err != models.ErrNotFound {
+			log.Println(err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+	if !g.visible(r, gallery) {
+		http.NotFound(w, r)
+		return
+	}
+	setVisibilityHeaders(w, gallery)
+	storage.ServeBlob(w, r, g.store, key)
+}
+
+// canView writes a not found response and returns false when the
+// current user may not see the gallery. A 404 is used rather than a
+// 403 so private galleries can't be discovered by guessing IDs.
+// Visitors to locked galleries are sent to the password prompt.
+func (g *Galleries) canView(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) bool {
+	if !g.visible(r, gallery) {
+		if gallery.Unlockable() {
+			http.Redirect(w, r, fmt.Sprintf("/galleries/%v", gallery.ID), http.StatusFound)
+			return false
+		}
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return false
+	}
+	setVisibilityHeaders(w, gallery)
+	return true
+}
+
+// visible reports whether the current user may see the gallery,
+// either through its visibility, a share link they opened or
+// because they entered its password.
+func (g *Galleries) visible(r *http.Request, gallery *models.Gallery) bool {
+	if gallery.VisibleTo(context.User(r.Context())) {
+		return true
+	}
+	if models.RoleAllows(g.role(r, gallery), models.ActionView) {
+		return true
+	}
+	return g.sharedWith(r, gallery) || g.unlocked(r, gallery)
+}
+
+// authorize is where permissions on a gallery are checked. It returns
+// false, after writing an error response, unless the current user's
+// role on the gallery allows action. People with no role at all get
+// a 404 so they can't tell the gallery exists.
+func (g *Galleries) authorize(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, action models.GalleryAction) bool {
+	role := g.role(r, gallery)
+	if models.RoleAllows(role, action) {
+		return true
+	}
+	if role != "" {
+		http.Error(w, "You don't have permission to do that", http.StatusForbidden)
+		return false
+	}
+	http.Error(w, "Gallery not found", http.StatusNotFound)
+	return false
+}
+
+// role returns the current user's role on the gallery, or an empty
+// string when they have none.
+func (g *Galleries) role(r *http.Request, gallery *models.Gallery) string {
+	user := context.User(r.Context())
+	if user == nil {
+		return ""
+	}
+	if gallery.IsOwner(user) {
+		return models.RoleOwner
+	}
+	role, err := g.ms.Role(gallery.ID, user.ID)
+	if err != nil {
+		log.Println(err)
+		return ""
+	}
+	return role
+}
+
+// POST /galleries/:id/unlock
+func (g *Galleries) Unlock(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	// Only galleries that ask for a password get the prompt, which
+	// shows the title
+	if !gallery.Unlockable() && !g.visible(r, gallery) {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+	var vd views.Data
+	vd.Yield = gallery
+	var form UnlockForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.UnlockView.Render(w, r, vd)
+		return
+	}
+	if err := g.gs.CheckPassword(gallery, clientIP(r), form.Password); err != nil {
+		vd.SetAlert(err)
+		g.UnlockView.Render(w, r, vd)
+		return
+	}
+	expires := time.Now().Add(galleryUnlockTTL)
+	cookie := http.Cookie{
+		Name:     unlockCookieName(gallery.ID),
+		Value:    g.gs.UnlockToken(gallery, expires),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, &cookie)
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%v", gallery.ID), http.StatusFound)
+}
+
+// unlocked reports whether the visitor entered the gallery's password
+// recently, see Unlock.
+func (g *Galleries) unlocked(r *http.Request, gallery *models.Gallery) bool {
+	if !gallery.Unlockable() {
+		return false
+	}
+	cookie, err := r.Cookie(unlockCookieName(gallery.ID))
+	if err != nil {
+		return false
+	}
+	return g.gs.ValidUnlockToken(gallery, cookie.Value)
+}
+
+func unlockCookieName(galleryID uint) string {
+	return fmt.Sprintf("unlock_%d", galleryID)
+}
+
+// setVisibilityHeaders keeps private pages and images out of shared
+// caches, and anything that isn't public out of search engines.
+func setVisibilityHeaders(w http.ResponseWriter, gallery *models.Gallery) {
+	if gallery.Visibility != models.VisibilityPublic {
+		w.Header().Set("X-Robots-Tag", "noindex")
+	}
+	if gallery.Visibility == models.VisibilityPrivate {
+		w.Header().Set("Cache-Control", "private")
 	}
-	http.Redirect(w, r, "/galleries", http.StatusFound)
 }
 
 // GET /galleries/:id
@@ -200,6 +687,24 @@ func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models
 	return gallery, nil
 }
 
+// imageByFilename looks up the image named in the URL within gallery,
+// writing an error response if it can't be found.
+func (g *Galleries) imageByFilename(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) (*models.Image, error) {
+	filename := mux.Vars(r)["filename"]
+	image, err := g.is.ByFilename(gallery.ID, filename)
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Image not found", http.StatusNotFound)
+		default:
+			log.Println(err)
+			http.Error(w, "Whoops! ...Something went wrong", http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return image, nil
+}
+
 // POST /galleries/:id/images
 func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r)
@@ -207,22 +712,33 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if !g.authorize(w, r, gallery, models.ActionUpload) {
 		return
 	}
 
 	var vd views.Data
-	vd.Yield = gallery
+	vd.Yield = g.editData(r, gallery)
+	r.Body = http.MaxBytesReader(w, r.Body, models.MaxUploadSize)
 	err = r.ParseMultipartForm(maxMultipartMem)
 	if err != nil {
+		var mbErr *http.MaxBytesError
+		if errors.As(err, &mbErr) {
+			err = models.ErrUploadTooLarge
+		}
 		vd.SetAlert(err)
 		g.EditView.Render(w, r, vd)
 		return
 	}
+	defer r.MultipartForm.RemoveAll()
 
 	files := r.MultipartForm.File["images"]
+	var duplicates []string
 	for _, f := range files {
+		if f.Size > models.MaxImageSize {
+			vd.SetAlert(models.ErrImageTooLarge)
+			g.EditView.Render(w, r, vd)
+			return
+		}
 		// Open the uploaded file
 		file, err := f.Open()
 		if err != nil {
@@ -230,14 +746,32 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 			g.EditView.Render(w, r, vd)
 			return
 		}
-		defer file.Close()
-		err = g.is.Create(gallery.ID, file, f.Filename)
+		image := models.Image{
+			GalleryID: gallery.ID,
+			UserID:    user.ID,
+			Filename:  f.Filename,
+		}
+		err = g.is.Create(&image, file)
+		if err == models.ErrImageDuplicate {
+			// Skip images that were already uploaded rather than
+			// failing the rest
+			duplicates = append(duplicates, f.Filename)
+			continue
+		}
 		if err != nil {
 			vd.SetAlert(err)
 			g.EditView.Render(w, r, vd)
 			return
 		}
 	}
+	if len(duplicates) > 0 {
+		g.redirectToEdit(w, r, gallery, views.Alert{
+			Level: views.AlertLevelWarning,
+			Message: fmt.Sprintf("Skipped %d of %d images that were already in the gallery: %s",
+				len(duplicates), len(files), strings.Join(duplicates, ", ")),
+		})
+		return
+	}
 	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
 	if err != nil {
 		log.Println(err)
@@ -254,39 +788,258 @@ func (g *Galleries) ImageViaLink(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if !g.authorize(w, r, gallery, models.ActionUpload) {
 		return
 	}
+	data := g.editData(r, gallery)
 	var vd views.Data
-	vd.Yield = gallery
+	vd.Yield = data
 
-	if err := r.ParseForm(); err != nil {
+	// The Dropbox chooser posts a multipart form. It only holds links,
+	// so it has to fit in memory.
+	r.Body = http.MaxBytesReader(w, r.Body, maxMultipartMem)
+	err = r.ParseMultipartForm(maxMultipartMem)
+	if err != nil && err != http.ErrNotMultipart {
 		vd.SetAlert(err)
 		g.EditView.Render(w, r, vd)
 		return
 	}
+	if r.MultipartForm != nil {
+		defer r.MultipartForm.RemoveAll()
+	}
 	files := r.PostForm["files"]
+	if len(files) > maxLinks {
+		vd.AlertError(fmt.Sprintf("Please add at most %d links at a time.", maxLinks))
+		g.EditView.Render(w, r, vd)
+		return
+	}
+
+	results := g.fetcher.FetchAll(files, func(res *fetch.Result, body io.Reader) error {
+		image := models.Image{
+			GalleryID: gallery.ID,
+			UserID:    user.ID,
+			Filename:  res.Filename,
+		}
+		err := g.is.Create(&image, io.NopCloser(body))
+		res.Filename = image.Filename
+		return err
+	})
+
+	failed := 0
+	for _, res := range results {
+		lr := LinkResult{
+			URL:      res.URL,
+			Filename: res.Filename,
+		}
+		if res.Err != nil {
+			failed++
+			log.Println("Failed to add the image from:", res.URL, res.Err)
+			lr.Error = publicMessage(res.Err)
+		}
+		data.LinkResults = append(data.LinkResults, lr)
+	}
+	gallery.Images, _ = g.is.ByGalleryID(gallery.ID)
+
+	switch {
+	case failed == 0:
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLevelSuccess,
+			Message: fmt.Sprintf("Added %d images.", len(results)),
+		}
+	case failed == len(results):
+		vd.AlertError("None of the images could be added.")
+	default:
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLevelWarning,
+			Message: fmt.Sprintf("Added %d of %d images.", len(results)-failed, len(results)),
+		}
+	}
+	g.EditView.Render(w, r, vd)
+}
+
+// ImageArchive adds every image in an uploaded ZIP archive, which
+// makes adding hundreds of images at once practical. Files that can't
+// be added are reported back rather than failing the whole upload.
+//
+// POST /galleries/:id/images/archive
+func (g *Galleries) ImageArchive(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	if !g.authorize(w, r, gallery, models.ActionUpload) {
+		return
+	}
+	data := g.editData(r, gallery)
+	var vd views.Data
+	vd.Yield = data
+
+	// Archives over maxMultipartMem are spooled to a temporary file,
+	// which is read back in place rather than loaded into memory
+	r.Body = http.MaxBytesReader(w, r.Body, models.MaxArchiveSize)
+	err = r.ParseMultipartForm(maxMultipartMem)
+	if err != nil {
+		var mbErr *http.MaxBytesError
+		if errors.As(err, &mbErr) {
+			err = models.ErrArchiveTooLarge
+		}
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	file, header, err := r.FormFile("archive")
+	if err != nil {
+		vd.AlertError("Please choose a ZIP archive to upload.")
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	defer file.Close()
+
+	results, err := g.unzipper.ExtractAll(file, header.Size, func(res *unzip.Result, body io.Reader) error {
+		image := models.Image{
+			GalleryID: gallery.ID,
+			UserID:    user.ID,
+			Filename:  res.Filename,
+		}
+		err := g.is.Create(&image, io.NopCloser(body))
+		res.Filename = image.Filename
+		return err
+	})
+	if err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+
+	failed := 0
+	for _, res := range results {
+		ar := ArchiveResult{
+			Entry:    res.Name,
+			Filename: res.Filename,
+		}
+		if res.Err != nil {
+			failed++
+			log.Println("Failed to add the image from the archive:", res.Name, res.Err)
+			ar.Error = publicMessage(res.Err)
+		}
+		data.ArchiveResults = append(data.ArchiveResults, ar)
+	}
+	gallery.Images, _ = g.is.ByGalleryID(gallery.ID)
+
+	switch {
+	case len(results) == 0:
+		vd.AlertError("The archive doesn't contain any files.")
+	case failed == 0:
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLevelSuccess,
+			Message: fmt.Sprintf("Added %d images.", len(results)),
+		}
+	case failed == len(results):
+		vd.AlertError("None of the images could be added.")
+	default:
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLevelWarning,
+			Message: fmt.Sprintf("Added %d of %d images.", len(results)-failed, len(results)),
+		}
+	}
+	g.EditView.Render(w, r, vd)
+}
+
+// POST /galleries/:id/images/order
+func (g *Galleries) ImageOrder(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.authorize(w, r, gallery, models.ActionEdit) {
+		return
+	}
+	var vd views.Data
+	vd.Yield = g.editData(r, gallery)
+	var form ImageOrderForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	err = g.is.Reorder(gallery.ID, form.Order)
+	if err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, url.Path, http.StatusFound)
+}
+
+// POST /galleries/:id/images/:filename/update
+func (g *Galleries) ImageUpdate(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.authorize(w, r, gallery, models.ActionEdit) {
+		return
+	}
+	image, err := g.imageByFilename(w, r, gallery)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	vd.Yield = g.editData(r, gallery)
+	var form ImageForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	image.Title = form.Title
+	image.AltText = form.AltText
+	image.Caption = form.Caption
+	err = g.is.Update(image)
+	if err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, url.Path, http.StatusFound)
+}
 
-	var wg sync.WaitGroup
-	wg.Add(len(files))
-	for _, fileURL := range files {
-		go func(url string) {
-			defer wg.Done()
-			resp, err := http.Get(url)
-			if err != nil {
-				log.Println("Failed to download the image from:", url)
-				return
-			}
-			defer resp.Body.Close()
-			pieces := strings.Split(url, "/")
-			filename := pieces[len(pieces)-1]
-			if err := g.is.Create(gallery.ID, resp.Body, filename); err != nil {
-				log.Println("Failed to create the image from:", url)
-			}
-		}(fileURL)
-	}
-	wg.Wait()
+// POST /galleries/:id/images/:filename/cover
+func (g *Galleries) ImageCover(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.authorize(w, r, gallery, models.ActionEdit) {
+		return
+	}
+	image, err := g.imageByFilename(w, r, gallery)
+	if err != nil {
+		return
+	}
+	gallery.CoverImageID = image.ID
+	err = g.gs.Update(gallery)
+	if err != nil {
+		var vd views.Data
+		vd.Yield = g.editData(r, gallery)
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
 	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
 	if err != nil {
 		log.Println(err)
@@ -303,20 +1056,17 @@ func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if !g.authorize(w, r, gallery, models.ActionEdit) {
 		return
 	}
-	filename := mux.Vars(r)["filename"]
-	i := models.Image{
-		Filename:  filename,
-		GalleryID: gallery.ID,
+	image, err := g.imageByFilename(w, r, gallery)
+	if err != nil {
+		return
 	}
-	err = g.is.Delete(&i)
+	err = g.is.Delete(image)
 	if err != nil {
 		var vd views.Data
-		vd.Yield = gallery
+		vd.Yield = g.editData(r, gallery)
 		vd.SetAlert(err)
 		g.EditView.Render(w, r, vd)
 		return
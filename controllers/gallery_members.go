@@ -0,0 +1,191 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/imattf/go-courses/gallery/context"
+	"github.com/imattf/go-courses/gallery/models"
+	"github.com/imattf/go-courses/gallery/views"
+)
+
+// MemberForm is used to invite someone to a gallery and to change
+// the role of a member
+type MemberForm struct {
+	Email string `schema:"email"`
+	Role  string `schema:"role"`
+}
+
+// MemberRoles are the roles the owner can pick from
+func (d *EditGalleryData) MemberRoles() interface{} {
+	return models.MemberRoles
+}
+
+// POST /galleries/:id/members
+func (g *Galleries) MemberInvite(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.authorize(w, r, gallery, models.ActionManage) {
+		return
+	}
+	user := context.User(r.Context())
+	var vd views.Data
+	vd.Yield = g.editData(r, gallery)
+	var form MemberForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	if strings.EqualFold(strings.TrimSpace(form.Email), user.Email) {
+		vd.AlertError("You already own this gallery")
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	member := models.GalleryMember{
+		GalleryID: gallery.ID,
+		Email:     form.Email,
+		Role:      form.Role,
+	}
+	if err := g.ms.Invite(&member); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	err = g.emailer.Invite(member.Email, user.Name, gallery.Title, member.Role, member.InviteToken)
+	if err != nil {
+		// The invitation exists, so the owner can remove it and try
+		// again
+		log.Println(err)
+		vd.Yield = g.editData(r, gallery)
+		vd.AlertError("The invitation was created but the email could not be sent. Please remove it and try again.")
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	g.redirectToEdit(w, r, gallery, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Invitation sent to " + member.Email,
+	})
+}
+
+// POST /galleries/:id/members/:member_id/update
+func (g *Galleries) MemberUpdate(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.authorize(w, r, gallery, models.ActionManage) {
+		return
+	}
+	member, err := g.memberByID(w, r, gallery)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	vd.Yield = g.editData(r, gallery)
+	var form MemberForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	member.Role = form.Role
+	if err := g.ms.Update(member); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	g.redirectToEdit(w, r, gallery, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Role updated for " + member.Email,
+	})
+}
+
+// POST /galleries/:id/members/:member_id/delete
+func (g *Galleries) MemberDelete(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.authorize(w, r, gallery, models.ActionManage) {
+		return
+	}
+	member, err := g.memberByID(w, r, gallery)
+	if err != nil {
+		return
+	}
+	if err := g.ms.Delete(member.ID); err != nil {
+		var vd views.Data
+		vd.Yield = g.editData(r, gallery)
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	g.redirectToEdit(w, r, gallery, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: member.Email + " no longer has access",
+	})
+}
+
+// InviteAccept adds the logged in user to the gallery they were
+// invited to.
+//
+// GET /invites/:token
+func (g *Galleries) InviteAccept(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	member, err := g.ms.Accept(mux.Vars(r)["token"], user)
+	if err != nil {
+		if err != models.ErrInviteInvalid {
+			log.Println(err)
+		}
+		views.RedirectAlert(w, r, "/galleries", http.StatusFound, views.Alert{
+			Level:   views.AlertLevelError,
+			Message: publicMessage(err),
+		})
+		return
+	}
+	url := fmt.Sprintf("/galleries/%d", member.GalleryID)
+	if u, err := g.r.Get(ShowGallery).URL("id", fmt.Sprintf("%v", member.GalleryID)); err == nil {
+		url = u.Path
+	}
+	views.RedirectAlert(w, r, url, http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "You now have access to this gallery",
+	})
+}
+
+// memberByID looks up the member in the URL, which must belong to
+// gallery. It writes a 404 and returns an error otherwise.
+func (g *Galleries) memberByID(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) (*models.GalleryMember, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["member_id"])
+	if err != nil {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return nil, err
+	}
+	member, err := g.ms.ByID(uint(id))
+	if err == nil && member.GalleryID != gallery.ID {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return nil, err
+	}
+	return member, nil
+}
+
+func (g *Galleries) redirectToEdit(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, alert views.Alert) {
+	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	views.RedirectAlert(w, r, url.Path, http.StatusFound, alert)
+}
@@ -1,10 +1,15 @@
 package controllers
 
 import (
+	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
 	"net/url"
 
 	"github.com/gorilla/schema"
+
+	"github.com/imattf/go-courses/gallery/views"
 )
 
 func parseForm(r *http.Request, dst interface{}) error {
@@ -34,3 +39,35 @@ func parseValues(values url.Values, dst interface{}) error {
 	}
 	return nil
 }
+
+// publicMessage returns the message to show users for err, falling
+// back to the generic alert message for errors that aren't public.
+func publicMessage(err error) string {
+	var pErr views.PublicError
+	if errors.As(err, &pErr) {
+		return pErr.Public()
+	}
+	return views.AlertMsgGeneric
+}
+
+// writeJSON responds with v encoded as JSON, for requests made from
+// JavaScript
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+// writeJSONError responds with {"error": "<message>"}, where the
+// message is safe to show users
+func writeJSONError(w http.ResponseWriter, err error) {
+	log.Println(err)
+	status := http.StatusBadRequest
+	var pErr views.PublicError
+	if !errors.As(err, &pErr) {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, map[string]string{"error": publicMessage(err)})
+}
@@ -0,0 +1,200 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/imattf/go-courses/gallery/context"
+	"github.com/imattf/go-courses/gallery/middleware"
+	"github.com/imattf/go-courses/gallery/models"
+	"github.com/imattf/go-courses/gallery/views"
+)
+
+const (
+	// webAuthnStateCookie keeps the state of a passkey ceremony until
+	// the browser responds. It is encrypted by the WebAuthnService.
+	webAuthnStateCookie = "webauthn_state"
+	webAuthnStateTTL    = 5 * time.Minute
+
+	// maxWebAuthnResponse is plenty for any authenticator's response
+	maxWebAuthnResponse = 64 << 10
+)
+
+// PasskeyLoginBegin starts signing in with a passkey instead of an
+// email address and password. The browser gets the options for
+// navigator.credentials.get as JSON.
+//
+// POST /login/passkey
+func (u *Users) PasskeyLoginBegin(w http.ResponseWriter, r *http.Request) {
+	assertion, state, err := u.ws.BeginLogin(nil)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	setWebAuthnState(w, r, state)
+	writeJSON(w, http.StatusOK, assertion)
+}
+
+// PasskeyLoginFinish signs in the owner of the passkey the browser
+// responded with. A passkey login verifies the user, eg with a
+// fingerprint, so it skips two-factor authentication.
+//
+// POST /login/passkey/finish
+func (u *Users) PasskeyLoginFinish(w http.ResponseWriter, r *http.Request) {
+	state, ok := webAuthnState(w, r)
+	if !ok {
+		return
+	}
+	user, err := u.ws.FinishLogin(nil, state, http.MaxBytesReader(w, r.Body, maxWebAuthnResponse))
+	if err == nil {
+		err = u.signIn(w, r, user)
+	}
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"redirect": "/galleries"})
+}
+
+// PasskeyTwoFactorBegin starts using a passkey as the second sign in
+// step, after the user entered their password.
+//
+// POST /login/2fa/passkey
+func (u *Users) PasskeyTwoFactorBegin(w http.ResponseWriter, r *http.Request) {
+	user, err := u.passwordUser(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": loginTimeoutMsg})
+		return
+	}
+	assertion, state, err := u.ws.BeginLogin(user)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	setWebAuthnState(w, r, state)
+	writeJSON(w, http.StatusOK, assertion)
+}
+
+// POST /login/2fa/passkey/finish
+func (u *Users) PasskeyTwoFactorFinish(w http.ResponseWriter, r *http.Request) {
+	user, err := u.passwordUser(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": loginTimeoutMsg})
+		return
+	}
+	state, ok := webAuthnState(w, r)
+	if !ok {
+		return
+	}
+	_, err = u.ws.FinishLogin(user, state, http.MaxBytesReader(w, r.Body, maxWebAuthnResponse))
+	if err == nil {
+		clearTOTPLoginCookie(w, r)
+		err = u.signIn(w, r, user)
+	}
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"redirect": "/galleries"})
+}
+
+// PasskeyRegisterBegin starts adding a passkey to the user's account.
+// The browser gets the options for navigator.credentials.create as
+// JSON.
+//
+// POST /account/passkeys/begin
+func (u *Users) PasskeyRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	creation, state, err := u.ws.BeginRegistration(user)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	setWebAuthnState(w, r, state)
+	writeJSON(w, http.StatusOK, creation)
+}
+
+// PasskeyRegisterFinish stores the passkey the browser created, named
+// after the name query parameter.
+//
+// POST /account/passkeys/finish?name=
+func (u *Users) PasskeyRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	state, ok := webAuthnState(w, r)
+	if !ok {
+		return
+	}
+	name := r.URL.Query().Get("name")
+	_, err := u.ws.FinishRegistration(user, state, name, http.MaxBytesReader(w, r.Body, maxWebAuthnResponse))
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"redirect": "/account"})
+}
+
+// POST /account/passkeys/:id/delete
+func (u *Users) PasskeyDelete(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Passkey not found", http.StatusNotFound)
+		return
+	}
+	var cred *models.WebAuthnCredential
+	creds, err := u.ws.ByUserID(user.ID)
+	for i := range creds {
+		if creds[i].ID == uint(id) {
+			cred = &creds[i]
+		}
+	}
+	if err == nil && cred == nil {
+		http.Error(w, "Passkey not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = u.ws.Delete(cred.ID)
+	}
+	if err != nil {
+		u.renderAccountError(w, r, err)
+		return
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: cred.Name + " was removed.",
+	})
+}
+
+func setWebAuthnState(w http.ResponseWriter, r *http.Request, state string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     webAuthnStateCookie,
+		Value:    state,
+		Path:     "/",
+		Expires:  time.Now().Add(webAuthnStateTTL),
+		HttpOnly: true,
+		Secure:   middleware.SecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// webAuthnState returns the state set by setWebAuthnState and clears
+// it, a ceremony that fails has to be started again
+func webAuthnState(w http.ResponseWriter, r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(webAuthnStateCookie)
+	http.SetCookie(w, &http.Cookie{
+		Name:     webAuthnStateCookie,
+		Path:     "/",
+		Expires:  time.Now(),
+		HttpOnly: true,
+		Secure:   middleware.SecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	if err != nil {
+		writeJSONError(w, models.ErrPasskeyInvalid)
+		return "", false
+	}
+	return cookie.Value, true
+}
@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/imattf/go-courses/gallery/context"
+	"github.com/imattf/go-courses/gallery/middleware"
+	"github.com/imattf/go-courses/gallery/models"
+)
+
+type userMemory struct {
+	models.UserService
+	user *models.User
+}
+
+func (m *userMemory) ByID(id uint) (*models.User, error) {
+	if id != m.user.ID {
+		return nil, models.ErrNotFound
+	}
+	return m.user, nil
+}
+
+func (m *userMemory) ByLoginToken(token string) (*models.User, error) {
+	if token != "login-token" {
+		return nil, models.ErrTokenInvalid
+	}
+	return m.user, nil
+}
+
+type sessionMemory struct {
+	models.SessionService
+	sessions map[string]models.Session
+}
+
+func (m *sessionMemory) Create(session *models.Session) error {
+	session.ID = uint(len(m.sessions) + 1)
+	session.Token = "session-token-" + strconv.Itoa(len(m.sessions))
+	session.ExpiresAt = time.Now().Add(models.SessionDuration)
+	m.sessions[session.Token] = *session
+	return nil
+}
+
+func (m *sessionMemory) ByToken(token string) (*models.Session, error) {
+	session, ok := m.sessions[token]
+	if !ok {
+		return nil, models.ErrNotFound
+	}
+	return &session, nil
+}
+
+func (m *sessionMemory) Touch(session *models.Session) error {
+	return nil
+}
+
+// webAuthnMemory accepts any response, the ceremonies themselves are
+// tested in models
+type webAuthnMemory struct {
+	models.WebAuthnService
+	user *models.User
+}
+
+func (m *webAuthnMemory) FinishLogin(user *models.User, state string, response io.Reader) (*models.User, error) {
+	return m.user, nil
+}
+
+// TestPasskeySignIn follows both passkey sign ins through to a page
+// that needs the session, the way a browser would
+func TestPasskeySignIn(t *testing.T) {
+	user := &models.User{Name: "Jon", Email: "jon@example.com"}
+	user.ID = 42
+	us := &userMemory{user: user}
+	ss := &sessionMemory{sessions: make(map[string]models.Session)}
+	u := &Users{us: us, ss: ss, ws: &webAuthnMemory{user: user}}
+	userMw := middleware.User{UserService: us, SessionService: ss}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/login/passkey/finish", u.PasskeyLoginFinish).Methods("POST")
+	r.HandleFunc("/login/2fa/passkey/finish", u.PasskeyTwoFactorFinish).Methods("POST")
+	r.HandleFunc("/galleries", userMw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+		if user := context.User(r.Context()); user != nil {
+			io.WriteString(w, user.Email)
+			return
+		}
+		http.Error(w, "Not signed in", http.StatusUnauthorized)
+	}))
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	srvURL, _ := url.Parse(srv.URL)
+
+	cases := map[string][]*http.Cookie{
+		"/login/passkey/finish": {
+			{Name: webAuthnStateCookie, Value: "state", Path: "/"},
+		},
+		"/login/2fa/passkey/finish": {
+			{Name: webAuthnStateCookie, Value: "state", Path: "/"},
+			{Name: totpLoginCookie, Value: "login-token", Path: "/login"},
+		},
+	}
+	for path, cookies := range cases {
+		jar, _ := cookiejar.New(nil)
+		jar.SetCookies(srvURL, cookies)
+		client := &http.Client{Jar: jar}
+
+		resp, err := client.Post(srv.URL+path, "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: Expected status 200. Recieved %d", path, resp.StatusCode)
+		}
+
+		resp, err = client.Get(srv.URL + "/galleries")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(b) != user.Email {
+			t.Errorf("%s: Expected to be signed in on /galleries. Recieved %d %q", path, resp.StatusCode, b)
+		}
+	}
+}
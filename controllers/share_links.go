@@ -0,0 +1,202 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/imattf/go-courses/gallery/context"
+	"github.com/imattf/go-courses/gallery/models"
+	"github.com/imattf/go-courses/gallery/views"
+)
+
+// ShareLinkForm is used to create a share link. ExpiresIn is in days,
+// 0 for links that don't expire, and MaxViews is 0 for no limit.
+type ShareLinkForm struct {
+	Label     string `schema:"label"`
+	ExpiresIn int    `schema:"expires_in"`
+	MaxViews  int    `schema:"max_views"`
+}
+
+// ShareExpiries are the options offered for how long a link lasts
+func (d *EditGalleryData) ShareExpiries() interface{} {
+	return []struct {
+		Days  int
+		Label string
+	}{
+		{1, "1 day"},
+		{7, "1 week"},
+		{30, "30 days"},
+		{0, "Never"},
+	}
+}
+
+// POST /galleries/:id/shares
+func (g *Galleries) ShareCreate(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.authorize(w, r, gallery, models.ActionManage) {
+		return
+	}
+	var vd views.Data
+	vd.Yield = g.editData(r, gallery)
+	var form ShareLinkForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	link := models.ShareLink{
+		GalleryID: gallery.ID,
+		Label:     form.Label,
+		MaxViews:  form.MaxViews,
+	}
+	if form.ExpiresIn > 0 {
+		expires := time.Now().AddDate(0, 0, form.ExpiresIn)
+		link.ExpiresAt = &expires
+	}
+	if err := g.sls.Create(&link); err != nil {
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	// The token is only known now, so the link is shown right away
+	// rather than redirecting back to the edit page
+	data := g.editData(r, gallery)
+	data.NewShareURL = absoluteURL(r, link.Path())
+	vd.Yield = data
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Share link created. Copy it now, it won't be shown again.",
+	}
+	g.EditView.Render(w, r, vd)
+}
+
+// POST /galleries/:id/shares/:share_id/revoke
+func (g *Galleries) ShareRevoke(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.authorize(w, r, gallery, models.ActionManage) {
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["share_id"])
+	if err != nil {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	link, err := g.sls.ByID(uint(id))
+	if err != nil || link.GalleryID != gallery.ID {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	if err := g.sls.Revoke(link); err != nil {
+		var vd views.Data
+		vd.Yield = g.editData(r, gallery)
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		log.Println(err)
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, url.Path, http.StatusFound)
+}
+
+// SharedShow shows a gallery to anyone holding a valid share link.
+// It also sets a cookie so the visitor can load the gallery's images
+// and image pages for a while, which are checked by sharedWith.
+//
+// GET /s/:token
+func (g *Galleries) SharedShow(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	link, err := g.sls.Use(token)
+	if err != nil {
+		if err != models.ErrShareLinkInvalid {
+			log.Println(err)
+		}
+		http.Error(w, "This link is not valid or has expired", http.StatusNotFound)
+		return
+	}
+	gallery, err := g.gs.ByID(link.GalleryID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "This link is not valid or has expired", http.StatusNotFound)
+		return
+	}
+	gallery.Images, _ = g.is.ByGalleryID(gallery.ID)
+
+	// The cookie only lasts for the view that was just counted, rather
+	// than holding the token, which would let it be used without limit
+	expires := time.Now().Add(shareVisitTTL)
+	if link.ExpiresAt != nil && link.ExpiresAt.Before(expires) {
+		expires = *link.ExpiresAt
+	}
+	cookie := http.Cookie{
+		Name:     shareCookieName(gallery.ID),
+		Value:    g.sls.VisitToken(link, expires),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, &cookie)
+
+	// Keep the token out of shared caches and out of the Referer
+	// header sent when following links off the page
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Robots-Tag", "noindex")
+
+	user := context.User(r.Context())
+	isOwner := gallery.IsOwner(user)
+	if !isOwner {
+		gallery.RedactMetadata()
+	}
+	var vd views.Data
+	vd.Yield = &ShowGalleryData{
+		Gallery: gallery,
+		IsOwner: isOwner,
+		CanEdit: models.RoleAllows(g.role(r, gallery), models.ActionUpload),
+	}
+	g.ShowView.Render(w, r, vd)
+}
+
+// sharedWith reports whether the visitor opened a share link to the
+// gallery within the last shareVisitTTL, and the link hasn't expired
+// or been revoked since. Views are only counted by SharedShow.
+func (g *Galleries) sharedWith(r *http.Request, gallery *models.Gallery) bool {
+	cookie, err := r.Cookie(shareCookieName(gallery.ID))
+	if err != nil {
+		return false
+	}
+	link, err := g.sls.ByVisitToken(cookie.Value)
+	if err != nil {
+		return false
+	}
+	return link.GalleryID == gallery.ID
+}
+
+func shareCookieName(galleryID uint) string {
+	return fmt.Sprintf("share_%d", galleryID)
+}
+
+// absoluteURL turns path into a full URL on the host the request was
+// made to, for links that are copied out of the app.
+func absoluteURL(r *http.Request, path string) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + path
+}
@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/imattf/go-courses/gallery/models"
+	"github.com/imattf/go-courses/gallery/views"
+)
+
+// SimilarForm keeps one image out of a group of similar images, the
+// others in Group are deleted
+type SimilarForm struct {
+	Keep  uint   `schema:"keep"`
+	Group []uint `schema:"group"`
+}
+
+// SimilarData is what the similar photos view is rendered with
+type SimilarData struct {
+	*models.Gallery
+	Groups [][]models.Image
+}
+
+// Similar shows groups of images that look alike, such as shots from
+// a burst, so the best of each can be kept.
+//
+// GET /galleries/:id/similar
+func (g *Galleries) Similar(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.authorize(w, r, gallery, models.ActionEdit) {
+		return
+	}
+	var vd views.Data
+	data := &SimilarData{Gallery: gallery}
+	vd.Yield = data
+	data.Groups, err = g.is.Similar(gallery.ID)
+	if err != nil {
+		log.Println(err)
+		vd.SetAlert(err)
+	}
+	g.SimilarView.Render(w, r, vd)
+}
+
+// SimilarKeep deletes every image in a group of similar images but
+// the one chosen to keep.
+//
+// POST /galleries/:id/similar
+func (g *Galleries) SimilarKeep(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.authorize(w, r, gallery, models.ActionEdit) {
+		return
+	}
+	var vd views.Data
+	vd.Yield = &SimilarData{Gallery: gallery}
+	var form SimilarForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.SimilarView.Render(w, r, vd)
+		return
+	}
+	keep := false
+	for _, id := range form.Group {
+		keep = keep || id == form.Keep
+	}
+	if !keep {
+		vd.AlertError("Please choose the image to keep.")
+		g.SimilarView.Render(w, r, vd)
+		return
+	}
+
+	deleted := 0
+	for _, id := range form.Group {
+		if id == form.Keep {
+			continue
+		}
+		image, err := g.is.ByID(id)
+		if err == models.ErrNotFound || (err == nil && image.GalleryID != gallery.ID) {
+			// Skip images that were already deleted, eg by submitting
+			// the form twice, and images from other galleries
+			continue
+		}
+		if err == nil {
+			err = g.is.Delete(image)
+		}
+		if err != nil {
+			log.Println(err)
+			vd.SetAlert(err)
+			g.SimilarView.Render(w, r, vd)
+			return
+		}
+		deleted++
+	}
+	views.RedirectAlert(w, r, fmt.Sprintf("/galleries/%d/similar", gallery.ID), http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: fmt.Sprintf("Deleted %d similar images.", deleted),
+	})
+}
@@ -0,0 +1,214 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/imattf/go-courses/gallery/context"
+	"github.com/imattf/go-courses/gallery/models"
+	"github.com/imattf/go-courses/gallery/views"
+)
+
+// TrashData is what the trash view is rendered with
+type TrashData struct {
+	Galleries []models.Gallery
+	Images    []TrashedImage
+}
+
+// TrashedImage is a deleted image along with the gallery it was
+// deleted from
+type TrashedImage struct {
+	models.Image
+	GalleryTitle string
+}
+
+// PurgeDate is when an item deleted at deletedAt is removed for good
+func (d *TrashData) PurgeDate(deletedAt *time.Time) time.Time {
+	if deletedAt == nil {
+		return time.Time{}
+	}
+	return deletedAt.Add(models.TrashRetention)
+}
+
+// Trash lists the current user's deleted galleries, and the images
+// deleted from the galleries they still have.
+//
+// GET /trash
+func (g *Galleries) Trash(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	vd.Yield = g.trashData(r)
+	g.TrashView.Render(w, r, vd)
+}
+
+// POST /trash/galleries/:id/restore
+func (g *Galleries) TrashGalleryRestore(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := g.trashedGallery(w, r)
+	if !ok {
+		return
+	}
+	err := g.gs.Restore(gallery.ID)
+	if err == nil {
+		err = g.is.RestoreGallery(gallery.ID, *gallery.DeletedAt)
+	}
+	if err != nil {
+		g.renderTrashError(w, r, err)
+		return
+	}
+	views.RedirectAlert(w, r, "/galleries", http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: gallery.Title + " was restored.",
+	})
+}
+
+// POST /trash/galleries/:id/delete
+func (g *Galleries) TrashGalleryDelete(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := g.trashedGallery(w, r)
+	if !ok {
+		return
+	}
+	err := g.is.PurgeGallery(gallery.ID)
+	if err == nil {
+		err = g.gs.Purge(gallery.ID)
+	}
+	if err != nil {
+		g.renderTrashError(w, r, err)
+		return
+	}
+	views.RedirectAlert(w, r, "/trash", http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: gallery.Title + " was deleted for good.",
+	})
+}
+
+// POST /trash/images/:id/restore
+func (g *Galleries) TrashImageRestore(w http.ResponseWriter, r *http.Request) {
+	image, ok := g.trashedImage(w, r)
+	if !ok {
+		return
+	}
+	if err := g.is.Restore(image); err != nil {
+		g.renderTrashError(w, r, err)
+		return
+	}
+	views.RedirectAlert(w, r, "/trash", http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: image.Filename + " was restored.",
+	})
+}
+
+// POST /trash/images/:id/delete
+func (g *Galleries) TrashImageDelete(w http.ResponseWriter, r *http.Request) {
+	image, ok := g.trashedImage(w, r)
+	if !ok {
+		return
+	}
+	if err := g.is.Purge(image); err != nil {
+		g.renderTrashError(w, r, err)
+		return
+	}
+	views.RedirectAlert(w, r, "/trash", http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: image.Filename + " was deleted for good.",
+	})
+}
+
+func (g *Galleries) trashData(r *http.Request) *TrashData {
+	user := context.User(r.Context())
+	var data TrashData
+	var err error
+	data.Galleries, err = g.gs.DeletedByUserID(user.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	// Only images deleted from galleries the user still has are
+	// listed, the rest come back along with their gallery
+	galleries, err := g.gs.ByUserID(user.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	titles := make(map[uint]string)
+	var ids []uint
+	for _, gallery := range galleries {
+		titles[gallery.ID] = gallery.Title
+		ids = append(ids, gallery.ID)
+	}
+	images, err := g.is.DeletedByGalleryIDs(ids)
+	if err != nil {
+		log.Println(err)
+	}
+	for _, image := range images {
+		data.Images = append(data.Images, TrashedImage{
+			Image:        image,
+			GalleryTitle: titles[image.GalleryID],
+		})
+	}
+	return &data
+}
+
+func (g *Galleries) renderTrashError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Println(err)
+	var vd views.Data
+	vd.SetAlert(err)
+	vd.Yield = g.trashData(r)
+	g.TrashView.Render(w, r, vd)
+}
+
+// trashedGallery looks up the deleted gallery in the URL, which must
+// belong to the current user. Otherwise it writes a 404 and returns
+// false.
+func (g *Galleries) trashedGallery(w http.ResponseWriter, r *http.Request) (*models.Gallery, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return nil, false
+	}
+	user := context.User(r.Context())
+	gallery, err := g.gs.DeletedByID(uint(id))
+	if err == nil && !gallery.IsOwner(user) {
+		err = models.ErrNotFound
+	}
+	switch err {
+	case nil:
+		return gallery, true
+	case models.ErrNotFound:
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+	default:
+		log.Println(err)
+		http.Error(w, "Whoops! ...Something went wrong", http.StatusInternalServerError)
+	}
+	return nil, false
+}
+
+// trashedImage looks up the deleted image in the URL, which must be
+// from a gallery the current user owns and hasn't deleted. Otherwise
+// it writes a 404 and returns false.
+func (g *Galleries) trashedImage(w http.ResponseWriter, r *http.Request) (*models.Image, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return nil, false
+	}
+	user := context.User(r.Context())
+	image, err := g.is.DeletedByID(uint(id))
+	if err == nil {
+		var gallery *models.Gallery
+		gallery, err = g.gs.ByID(image.GalleryID)
+		if err == nil && !gallery.IsOwner(user) {
+			err = models.ErrNotFound
+		}
+	}
+	switch err {
+	case nil:
+		return image, true
+	case models.ErrNotFound:
+		http.Error(w, "Image not found", http.StatusNotFound)
+	default:
+		log.Println(err)
+		http.Error(w, "Whoops! ...Something went wrong", http.StatusInternalServerError)
+	}
+	return nil, false
+}
@@ -0,0 +1,267 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+
+	"github.com/imattf/go-courses/gallery/context"
+	"github.com/imattf/go-courses/gallery/middleware"
+	"github.com/imattf/go-courses/gallery/models"
+	"github.com/imattf/go-courses/gallery/totp"
+	"github.com/imattf/go-courses/gallery/views"
+)
+
+const (
+	// totpIssuer is the name authenticator apps list the account under
+	totpIssuer = "Gallery"
+
+	// totpLoginTimeout is how long users have to enter a two-factor
+	// code after their password
+	totpLoginTimeout = 10 * time.Minute
+
+	totpLoginCookie = "totp_login"
+
+	loginTimeoutMsg = "Your sign in timed out, please enter your password again."
+)
+
+// TOTPForm is used both to sign in with a two-factor code and to
+// confirm the authenticator app was set up
+type TOTPForm struct {
+	Code string `schema:"code"`
+}
+
+// TOTPDisableForm asks for the password before turning two-factor
+// authentication off
+type TOTPDisableForm struct {
+	Password string `schema:"password"`
+}
+
+// TOTPSetupData is what the two-factor setup view is rendered with
+type TOTPSetupData struct {
+	Secret string
+	QRCode template.URL
+}
+
+// LoginTOTPData is what the second sign in step is rendered with, it
+// offers whichever second factors the user has
+type LoginTOTPData struct {
+	TOTP     bool
+	Passkeys bool
+}
+
+// secondFactorRequired reports whether user has to use a two-factor
+// code or a passkey after their password
+func (u *Users) secondFactorRequired(user *models.User) (bool, error) {
+	if user.TOTPEnabled() {
+		return true, nil
+	}
+	creds, err := u.ws.ByUserID(user.ID)
+	if err != nil {
+		return false, err
+	}
+	return len(creds) > 0, nil
+}
+
+// requireSecondFactor sends a user who entered their password on to
+// the second sign in step, rather than signing them in.
+func (u *Users) requireSecondFactor(w http.ResponseWriter, r *http.Request, user *models.User) {
+	expires := time.Now().Add(totpLoginTimeout)
+	cookie := http.Cookie{
+		Name:     totpLoginCookie,
+		Value:    u.us.LoginToken(user, expires),
+		Path:     "/login",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   middleware.SecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, &cookie)
+	http.Redirect(w, r, "/login/2fa", http.StatusFound)
+}
+
+// GET /login/2fa
+func (u *Users) LoginTOTPForm(w http.ResponseWriter, r *http.Request) {
+	user, ok := u.totpLoginUser(w, r)
+	if !ok {
+		return
+	}
+	var vd views.Data
+	vd.Yield = u.loginTOTPData(user)
+	u.LoginTOTPView.Render(w, r, vd)
+}
+
+// LoginTOTP is the second sign in step for users with two-factor
+// authentication, after Login checked their password.
+//
+// POST /login/2fa
+func (u *Users) LoginTOTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := u.totpLoginUser(w, r)
+	if !ok {
+		return
+	}
+	var vd views.Data
+	vd.Yield = u.loginTOTPData(user)
+	var form TOTPForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.LoginTOTPView.Render(w, r, vd)
+		return
+	}
+	if err := u.us.VerifyTOTP(user, form.Code); err != nil {
+		vd.SetAlert(err)
+		u.LoginTOTPView.Render(w, r, vd)
+		return
+	}
+	clearTOTPLoginCookie(w, r)
+	if err := u.signIn(w, r, user); err != nil {
+		vd.SetAlert(err)
+		u.LoginTOTPView.Render(w, r, vd)
+		return
+	}
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+// totpLoginUser returns the user part way through signing in. If the
+// second step timed out it sends them back to the login page and
+// returns false.
+func (u *Users) totpLoginUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	user, err := u.passwordUser(r)
+	if err == nil {
+		return user, true
+	}
+	views.RedirectAlert(w, r, "/login", http.StatusFound, views.Alert{
+		Level:   views.AlertLevelWarning,
+		Message: loginTimeoutMsg,
+	})
+	return nil, false
+}
+
+// passwordUser returns the user who entered their password but still
+// has to use their second factor
+func (u *Users) passwordUser(r *http.Request) (*models.User, error) {
+	cookie, err := r.Cookie(totpLoginCookie)
+	if err != nil {
+		return nil, models.ErrTokenInvalid
+	}
+	return u.us.ByLoginToken(cookie.Value)
+}
+
+func (u *Users) loginTOTPData(user *models.User) *LoginTOTPData {
+	data := LoginTOTPData{TOTP: user.TOTPEnabled()}
+	creds, err := u.ws.ByUserID(user.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	data.Passkeys = len(creds) > 0
+	return &data
+}
+
+func clearTOTPLoginCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     totpLoginCookie,
+		Path:     "/login",
+		Expires:  time.Now(),
+		HttpOnly: true,
+		Secure:   middleware.SecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// TOTPSetup shows the two-factor secret as a QR code to scan with an
+// authenticator app, generating one the first time.
+//
+// GET /account/2fa
+func (u *Users) TOTPSetup(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	secret, err := u.us.EnrollTOTP(user)
+	if err != nil {
+		u.renderAccountError(w, r, err)
+		return
+	}
+	var vd views.Data
+	vd.Yield, err = totpSetupData(user, secret)
+	if err != nil {
+		u.renderAccountError(w, r, err)
+		return
+	}
+	u.TOTPSetupView.Render(w, r, vd)
+}
+
+// TOTPEnable turns two-factor authentication on once the user enters
+// a code from their authenticator app, and shows their recovery
+// codes.
+//
+// POST /account/2fa
+func (u *Users) TOTPEnable(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var vd views.Data
+	var form TOTPForm
+	err := parseForm(r, &form)
+	var codes []string
+	if err == nil {
+		codes, err = u.us.EnableTOTP(user, form.Code)
+	}
+	if err == models.ErrTOTPEnabled || err == models.ErrTOTPNotEnrolled {
+		u.renderAccountError(w, r, err)
+		return
+	}
+	if err != nil {
+		// Show the same QR code again so the app doesn't have to be
+		// set up twice
+		vd.SetAlert(err)
+		secret, err := u.us.TOTPSecret(user)
+		if err != nil {
+			u.renderAccountError(w, r, err)
+			return
+		}
+		vd.Yield, err = totpSetupData(user, secret)
+		if err != nil {
+			u.renderAccountError(w, r, err)
+			return
+		}
+		u.TOTPSetupView.Render(w, r, vd)
+		return
+	}
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Two-factor authentication is now turned on.",
+	}
+	vd.Yield = codes
+	u.RecoveryCodesView.Render(w, r, vd)
+}
+
+// POST /account/2fa/disable
+func (u *Users) TOTPDisable(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var form TOTPDisableForm
+	err := parseForm(r, &form)
+	if err == nil {
+		err = u.us.DisableTOTP(user, form.Password)
+	}
+	if err != nil {
+		u.renderAccountError(w, r, err)
+		return
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Two-factor authentication is now turned off.",
+	})
+}
+
+func totpSetupData(user *models.User, secret string) (*TOTPSetupData, error) {
+	png, err := qrcode.Encode(totp.URL(totpIssuer, user.Email, secret), qrcode.Medium, 256)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return &TOTPSetupData{
+		Secret: secret,
+		// The image is inlined so the secret never ends up in a URL
+		QRCode: template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)),
+	}, nil
+}
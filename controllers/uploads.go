@@ -0,0 +1,221 @@
+package controllers
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/imattf/go-courses/gallery/context"
+	"github.com/imattf/go-courses/gallery/models"
+	"github.com/imattf/go-courses/gallery/tus"
+)
+
+// The handlers below implement the tus 1.0 protocol so images can be
+// uploaded in chunks and resumed after a dropped connection. Clients
+// create an upload with POST, send its bytes with PATCH requests and
+// ask how much arrived with HEAD. Once every byte is received the
+// file is added to the gallery like any other upload.
+
+// OPTIONS /galleries/:id/uploads
+func (g *Galleries) UploadOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tus.Version)
+	w.Header().Set("Tus-Version", tus.Version)
+	w.Header().Set("Tus-Extension", tus.Extensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(g.uploads.MaxSize(), 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /galleries/:id/uploads
+func (g *Galleries) UploadCreate(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.authorize(w, r, gallery, models.ActionUpload) {
+		return
+	}
+	user := context.User(r.Context())
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil {
+		http.Error(w, "Upload-Length is required", http.StatusBadRequest)
+		return
+	}
+	if size > g.uploads.MaxSize() {
+		http.Error(w, publicMessage(models.ErrImageTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	metadata, err := tus.ParseMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	upload := tus.Upload{
+		Size:      size,
+		Metadata:  metadata,
+		GalleryID: gallery.ID,
+		UserID:    user.ID,
+	}
+	if err := g.uploads.Create(&upload); err != nil {
+		tusError(w, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/galleries/%d/uploads/%s", gallery.ID, upload.ID))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// HEAD /galleries/:id/uploads/:upload_id
+func (g *Galleries) UploadHead(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+	upload, ok := g.uploadByID(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Size, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+// PATCH /galleries/:id/uploads/:upload_id
+func (g *Galleries) UploadPatch(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != tus.ContentType {
+		http.Error(w, "Content-Type must be "+tus.ContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Upload-Offset is required", http.StatusBadRequest)
+		return
+	}
+	upload, ok := g.uploadByID(w, r)
+	if !ok {
+		return
+	}
+	upload, err = g.uploads.Write(upload.ID, offset, r.Body)
+	if err != nil {
+		if upload != nil && err != tus.ErrTooLarge {
+			// The client went away part way through the chunk, keep
+			// what arrived so it can resume from there
+			w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		}
+		tusError(w, err)
+		return
+	}
+	if upload.Complete() {
+		err = g.uploads.Finish(upload.ID, func(u *tus.Upload, data io.Reader) error {
+			image := models.Image{
+				GalleryID: u.GalleryID,
+				UserID:    u.UserID,
+				Filename:  uploadFilename(u),
+			}
+			return g.is.Create(&image, io.NopCloser(data))
+		})
+		if err != nil {
+			log.Println("Failed to add the uploaded image:", err)
+			// The upload is gone either way, so this must not be an
+			// error the client would retry
+			http.Error(w, publicMessage(err), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /galleries/:id/uploads/:upload_id
+func (g *Galleries) UploadDelete(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+	upload, ok := g.uploadByID(w, r)
+	if !ok {
+		return
+	}
+	if err := g.uploads.Remove(upload.ID); err != nil {
+		tusError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadByID looks up the upload in the URL, which must have been
+// created by the current user for the gallery in the URL, and that
+// user must still be allowed to upload to it. Otherwise it writes a
+// 404 and returns false.
+func (g *Galleries) uploadByID(w http.ResponseWriter, r *http.Request) (*tus.Upload, bool) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return nil, false
+	}
+	if !g.authorize(w, r, gallery, models.ActionUpload) {
+		return nil, false
+	}
+	user := context.User(r.Context())
+	upload, err := g.uploads.Get(mux.Vars(r)["upload_id"])
+	if err == nil && (upload.GalleryID != gallery.ID || upload.UserID != user.ID) {
+		err = tus.ErrNotFound
+	}
+	if err != nil {
+		tusError(w, err)
+		return nil, false
+	}
+	return upload, true
+}
+
+// uploadFilename is the name the client sent along with the upload.
+// tus-js-client and Uppy use different keys for it.
+func uploadFilename(u *tus.Upload) string {
+	for _, key := range []string{"filename", "name"} {
+		if name := u.Metadata[key]; name != "" {
+			return name
+		}
+	}
+	return "upload"
+}
+
+// tusResumable sets the Tus-Resumable header every response carries
+// and returns false, after writing a 412, for clients speaking
+// another version of the protocol.
+func tusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tus.Version)
+	if r.Header.Get("Tus-Resumable") != tus.Version {
+		w.Header().Set("Tus-Version", tus.Version)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// tusError writes the response for an error returned by the tus store
+func tusError(w http.ResponseWriter, err error) {
+	switch err {
+	case tus.ErrNotFound:
+		http.Error(w, "Upload not found", http.StatusNotFound)
+	case tus.ErrOffsetMismatch:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case tus.ErrLocked:
+		http.Error(w, err.Error(), http.StatusLocked)
+	case tus.ErrSizeInvalid, tus.ErrMetadataInvalid:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case tus.ErrTooLarge:
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	default:
+		// Most likely the client hung up in the middle of a chunk
+		log.Println(err)
+		http.Error(w, "Whoops! ...Something went wrong", http.StatusInternalServerError)
+	}
+}
@@ -1,24 +1,32 @@
 package controllers
 
 import (
+	"log"
+	"net"
 	"net/http"
 	"time"
 
 	"github.com/imattf/go-courses/gallery/context"
 	"github.com/imattf/go-courses/gallery/email"
+	"github.com/imattf/go-courses/gallery/middleware"
 	"github.com/imattf/go-courses/gallery/models"
-	"github.com/imattf/go-courses/gallery/rand"
 	"github.com/imattf/go-courses/gallery/views"
 	// "github.com/gorilla/schema"
 )
 
 type Users struct {
-	NewView      *views.View
-	LoginView    *views.View
-	ForgotPwView *views.View
-	ResetPwView  *views.View
-	us           models.UserService
-	emailer      *email.Client
+	NewView           *views.View
+	LoginView         *views.View
+	ForgotPwView      *views.View
+	ResetPwView       *views.View
+	AccountView       *views.View
+	LoginTOTPView     *views.View
+	TOTPSetupView     *views.View
+	RecoveryCodesView *views.View
+	us                models.UserService
+	ss                models.SessionService
+	ws                models.WebAuthnService
+	emailer           *email.Client
 }
 
 type SignupForm struct {
@@ -32,14 +40,20 @@ type LoginForm struct {
 	Password string `schema:"password"`
 }
 
-func NewUsers(us models.UserService, emailer *email.Client) *Users {
+func NewUsers(us models.UserService, ss models.SessionService, ws models.WebAuthnService, emailer *email.Client) *Users {
 	return &Users{
-		NewView:      views.NewView("bootstrap", "users/new"),
-		LoginView:    views.NewView("bootstrap", "users/login"),
-		ForgotPwView: views.NewView("bootstrap", "users/forgot_pw"),
-		ResetPwView:  views.NewView("bootstrap", "users/reset_pw"),
-		us:           us,
-		emailer:      emailer,
+		NewView:           views.NewView("bootstrap", "users/new"),
+		LoginView:         views.NewView("bootstrap", "users/login"),
+		ForgotPwView:      views.NewView("bootstrap", "users/forgot_pw"),
+		ResetPwView:       views.NewView("bootstrap", "users/reset_pw"),
+		AccountView:       views.NewView("bootstrap", "users/account"),
+		LoginTOTPView:     views.NewView("bootstrap", "users/login_totp"),
+		TOTPSetupView:     views.NewView("bootstrap", "users/totp_setup"),
+		RecoveryCodesView: views.NewView("bootstrap", "users/recovery_codes"),
+		us:                us,
+		ss:                ss,
+		ws:                ws,
+		emailer:           emailer,
 	}
 }
 
@@ -78,8 +92,12 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 	}
 	// this emailer could be sent on a "go" routine if needed
 	u.emailer.Welcome(user.Name, user.Email)
+	if err := u.sendVerification(&user); err != nil {
+		// They can ask for another link from their account page
+		log.Println(err)
+	}
 
-	err := u.signIn(w, &user)
+	err := u.signIn(w, r, &user)
 	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusFound)
 		return
@@ -115,8 +133,18 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 		u.LoginView.Render(w, r, vd)
 		return
 	}
+	required, err := u.secondFactorRequired(user)
+	if err != nil {
+		vd.SetAlert(err)
+		u.LoginView.Render(w, r, vd)
+		return
+	}
+	if required {
+		u.requireSecondFactor(w, r, user)
+		return
+	}
 
-	err = u.signIn(w, user)
+	err = u.signIn(w, r, user)
 	if err != nil {
 		vd.SetAlert(err)
 		u.LoginView.Render(w, r, vd)
@@ -126,22 +154,17 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 }
 
 // Logout delete the users session cookie (remember_token)
-// and update the user resource with a new remember_token.
+// and ends the session, leaving the user signed in on their
+// other devices.
 //
 // POST /logout
 func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
-	cookie := http.Cookie{
-		Name:     "remember_token",
-		Value:    "",
-		Expires:  time.Now(),
-		HttpOnly: true,
+	clearSessionCookie(w, r)
+	if session := context.Session(r.Context()); session != nil {
+		if err := u.ss.Delete(session.ID); err != nil {
+			log.Println(err)
+		}
 	}
-	http.SetCookie(w, &cookie)
-
-	user := context.User(r.Context())
-	token, _ := rand.RememberToken()
-	user.Remember = token
-	u.us.Update(user)
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
@@ -217,37 +240,61 @@ func (u *Users) CompleteReset(w http.ResponseWriter, r *http.Request) {
 		u.ResetPwView.Render(w, r, vd)
 		return
 	}
-	u.signIn(w, user)
+	// Whoever else knew the old password is signed out
+	if err := u.ss.DeleteByUserID(user.ID, 0); err != nil {
+		vd.SetAlert(err)
+		u.ResetPwView.Render(w, r, vd)
+		return
+	}
+	required, err := u.secondFactorRequired(user)
+	if err != nil {
+		vd.SetAlert(err)
+		u.ResetPwView.Render(w, r, vd)
+		return
+	}
+	if required {
+		// A reset password still needs the second factor
+		u.requireSecondFactor(w, r, user)
+		return
+	}
+	u.signIn(w, r, user)
 	views.RedirectAlert(w, r, "/galleries", http.StatusFound, views.Alert{
 		Level:   views.AlertLevelSuccess,
 		Message: "Your password has been reset and you have been logged in!",
 	})
 }
 
-// Assign session cookie
-func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
-	if user.Remember == "" {
-		token, err := rand.RememberToken()
-		if err != nil {
-			return err
-		}
-		user.Remember = token
-		err = u.us.Update(user)
-		if err != nil {
-			return err
-		}
+// Start a session for this device and assign session cookie
+func (u *Users) signIn(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	session := models.Session{
+		UserID:    user.ID,
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
 	}
-
-	cookie := http.Cookie{
-		Name:     "remember_token",
-		Value:    user.Remember,
-		HttpOnly: true,
+	if err := u.ss.Create(&session); err != nil {
+		return err
 	}
 
-	http.SetCookie(w, &cookie)
+	http.SetCookie(w, middleware.SessionCookie(r, session.Token, session.ExpiresAt))
 	return nil
 }
 
+// Remove session cookie
+func clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	cookie := middleware.SessionCookie(r, "", time.Now())
+	cookie.MaxAge = -1
+	http.SetCookie(w, cookie)
+}
+
+// clientIP is the address the request came from, without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 // // Read email cookie for testing
 // func (u *Users) CookieTest(w http.ResponseWriter, r *http.Request) {
 // 	cookie, err := r.Cookie("remember_token")
@@ -255,7 +302,7 @@ func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
 // 		http.Redirect(w, r, "/login", http.StatusFound)
 // 		return
 // 	}
-// 	user, err := u.us.ByRemember(cookie.Value)
+// 	session, err := u.ss.ByToken(cookie.Value)
 // 	if err != nil {
 // 		http.Redirect(w, r, "/login", http.StatusFound)
 // 		return
@@ -0,0 +1,69 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/imattf/go-courses/gallery/context"
+	"github.com/imattf/go-courses/gallery/models"
+	"github.com/imattf/go-courses/gallery/views"
+)
+
+// VerifyForm is used to process the link in verification emails
+type VerifyForm struct {
+	Token string `schema:"token"`
+}
+
+// Verify marks the user's email address as verified when they
+// follow the link emailed to them.
+//
+// GET /verify
+func (u *Users) Verify(w http.ResponseWriter, r *http.Request) {
+	var form VerifyForm
+	err := parseURLParams(r, &form)
+	var user *models.User
+	if err == nil {
+		user, err = u.us.CompleteVerification(form.Token)
+	}
+	if err != nil {
+		log.Println(err)
+		var vd views.Data
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLevelError,
+			Message: "That link is not valid or has expired. Please sign in and ask for a new one from your account page.",
+		}
+		u.LoginView.Render(w, r, vd)
+		return
+	}
+	url := "/login"
+	if current := context.User(r.Context()); current != nil && current.ID == user.ID {
+		url = "/galleries"
+	}
+	views.RedirectAlert(w, r, url, http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "Thanks, your email address is verified!",
+	})
+}
+
+// VerifyResend emails the user a new verification link.
+//
+// POST /account/verify
+func (u *Users) VerifyResend(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if err := u.sendVerification(user); err != nil {
+		u.renderAccountError(w, r, err)
+		return
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, views.Alert{
+		Level:   views.AlertLevelSuccess,
+		Message: "We sent a new verification link to " + user.Email + ".",
+	})
+}
+
+func (u *Users) sendVerification(user *models.User) error {
+	token, err := u.us.InitiateVerification(user)
+	if err != nil {
+		return err
+	}
+	return u.emailer.Verify(user.Name, user.Email, token)
+}
@@ -2,6 +2,7 @@ package email
 
 import (
 	"fmt"
+	"html"
 	"net/url"
 
 	mailgun "gopkg.in/mailgun/mailgun-go.v1"
@@ -13,6 +14,11 @@ const (
 	welcomeSubject = "Welcome to gallery.faulkners.io!"
 	resetSubject   = "Instructions for resetting your password."
 	resetBaseURL   = "https://galleries.faulkners.io/reset"
+	inviteSubject  = "You've been invited to a gallery on gallery.faulkners.io"
+	inviteBaseURL  = "https://gallery.faulkners.io/invites/"
+	verifySubject  = "Please verify your email address for gallery.faulkners.io"
+	verifyBaseURL  = "https://gallery.faulkners.io/verify"
+	changedSubject = "The email address for your gallery.faulkners.io account was changed"
 )
 
 const welcomeText = `Hi there!
@@ -73,6 +79,93 @@ Support Team</br>
 gallery.faulkners.io
 `
 
+const inviteTextTmpl = `Hi there!
+
+%s has invited you to their gallery "%s" as a %s. To accept, please sign in or sign up with this email address and follow the link below:
+
+%s
+
+If you weren't expecting this invitation you can safely ignore this email.
+
+
+Best,
+
+Support Team 
+gallery.faulkners.io
+
+`
+
+const inviteHTMLTmpl = `Hi there!</br>
+</br>
+%s has invited you to their gallery "%s" as a %s. To accept, please
+sign in or sign up with this email address and follow the link below:<br/>
+</br>
+<a href="%s">%s</a><br/>
+</br>
+If you weren't expecting this invitation you can safely ignore this email.</br>
+</br>
+Best,</br>
+Support Team</br>
+gallery.faulkners.io
+`
+
+const verifyTextTmpl = `Hi there!
+
+Please follow the link below to verify this is your email address:
+
+%s
+
+The link works for 48 hours. If you didn't sign up or change your email address you can safely ignore this email.
+
+
+Best,
+
+Support Team 
+gallery.faulkners.io
+
+`
+
+const verifyHTMLTmpl = `Hi there!</br>
+</br>
+Please follow the link below to verify this is your email address:<br/>
+</br>
+<a href="%s">%s</a><br/>
+</br>
+The link works for 48 hours. If you didn't sign up or change your
+email address you can safely ignore this email.</br>
+</br>
+Best,</br>
+Support Team</br>
+gallery.faulkners.io
+`
+
+const changedTextTmpl = `Hi there!
+
+The email address for your account was just changed to %s, so we will send emails there from now on.
+
+If you didn't change it, please reply to this email right away so we can help you get your account back.
+
+
+Best,
+
+Support Team 
+gallery.faulkners.io
+
+`
+
+const changedHTMLTmpl = `Hi there!</br>
+</br>
+The email address for your account was just changed to %s, so we
+will send emails there from now on.</br>
+</br>
+If you didn't change it, please reply to this email right away so we
+can help you get your account back.</br>
+</br>
+Best,</br>
+Support Team</br>
+gallery.faulkners.io
+`
+
 func WithMailgun(domain, apiKey, publicKey string) ClientConfig {
 	return func(c *Client) {
 		mg := mailgun.NewMailgun(domain, apiKey, publicKey)
@@ -149,6 +242,55 @@ func (c *Client) ResetPw(toEmail, token string) error {
 	return err
 }
 
+// Invite sends an invitation to a gallery. fromName is the name of
+// the gallery owner and role the role the invitee will have.
+func (c *Client) Invite(toEmail, fromName, galleryTitle, role, token string) error {
+	inviteURL := inviteBaseURL + url.PathEscape(token)
+	inviteText := fmt.Sprintf(inviteTextTmpl, fromName, galleryTitle, role, inviteURL)
+	inviteHTML := fmt.Sprintf(inviteHTMLTmpl, html.EscapeString(fromName),
+		html.EscapeString(galleryTitle), role, inviteURL, inviteURL)
+	message := c.mg.NewMessage(c.from, inviteSubject, inviteText, toEmail)
+	message.SetHtml(inviteHTML)
+
+	_, _, err := c.mg.Send(message)
+	if err != nil {
+		fmt.Println("Got a mailgun Email error!!", err)
+	}
+	return err
+}
+
+// Verify sends the link that proves the user owns toEmail
+func (c *Client) Verify(toName, toEmail, token string) error {
+	v := url.Values{}
+	v.Set("token", token)
+	verifyURL := verifyBaseURL + "?" + v.Encode()
+	verifyText := fmt.Sprintf(verifyTextTmpl, verifyURL)
+	verifyHTML := fmt.Sprintf(verifyHTMLTmpl, verifyURL, verifyURL)
+	message := c.mg.NewMessage(c.from, verifySubject, verifyText, buildEmail(toName, toEmail))
+	message.SetHtml(verifyHTML)
+
+	_, _, err := c.mg.Send(message)
+	if err != nil {
+		fmt.Println("Got a mailgun Email error!!", err)
+	}
+	return err
+}
+
+// EmailChanged tells the old address of an account that it was
+// changed to newEmail, in case someone else changed it
+func (c *Client) EmailChanged(toName, oldEmail, newEmail string) error {
+	changedText := fmt.Sprintf(changedTextTmpl, newEmail)
+	changedHTML := fmt.Sprintf(changedHTMLTmpl, html.EscapeString(newEmail))
+	message := c.mg.NewMessage(c.from, changedSubject, changedText, buildEmail(toName, oldEmail))
+	message.SetHtml(changedHTML)
+
+	_, _, err := c.mg.Send(message)
+	if err != nil {
+		fmt.Println("Got a mailgun Email error!!", err)
+	}
+	return err
+}
+
 func buildEmail(name, email string) string {
 	if name == "" {
 		return email
@@ -0,0 +1,68 @@
+// Package encrypt protects small secrets, such as two-factor
+// authentication keys, that have to be stored in the database but
+// must be readable again, unlike passwords.
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// ErrCiphertextInvalid is returned when decrypting something that
+// wasn't encrypted with the same key, or was tampered with
+const ErrCiphertextInvalid encryptError = "encrypt: ciphertext is not valid"
+
+type encryptError string
+
+func (e encryptError) Error() string {
+	return string(e)
+}
+
+// Cipher encrypts with AES-256-GCM, so tampering is detected too
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// NewCipher creates a Cipher. The key can be any string, it is
+// stretched to the 32 bytes AES-256 needs with SHA-256.
+func NewCipher(key string) Cipher {
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		// Only possible for a key of the wrong length
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return Cipher{aead: aead}
+}
+
+// Encrypt returns plaintext encrypted with a random nonce, base64
+// URL encoded so it can be stored as a string
+func (c Cipher) Encrypt(plaintext string) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := c.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.URLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt reverses Encrypt
+func (c Cipher) Decrypt(ciphertext string) (string, error) {
+	sealed, err := base64.URLEncoding.DecodeString(ciphertext)
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return "", ErrCiphertextInvalid
+	}
+	n := c.aead.NonceSize()
+	plaintext, err := c.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return "", ErrCiphertextInvalid
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,25 @@
+package encrypt
+
+import "testing"
+
+func TestCipher(t *testing.T) {
+	c := NewCipher("secret-key")
+	a, err := c.Encrypt("JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := c.Encrypt("JBSWY3DPEHPK3PXP")
+	if a == b {
+		t.Error("Expected a fresh nonce for every encryption")
+	}
+	got, err := c.Decrypt(a)
+	if err != nil || got != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("Expected the secret back. Recieved %q, %v", got, err)
+	}
+	if _, err := NewCipher("other-key").Decrypt(a); err != ErrCiphertextInvalid {
+		t.Errorf("Expected ErrCiphertextInvalid for another key. Recieved %v", err)
+	}
+	if _, err := c.Decrypt(a[:len(a)-4] + "AAAA"); err != ErrCiphertextInvalid {
+		t.Errorf("Expected ErrCiphertextInvalid when tampered with. Recieved %v", err)
+	}
+}
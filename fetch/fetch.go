@@ -0,0 +1,333 @@
+// Package fetch downloads remote files on behalf of users, such as
+// the Dropbox links posted to ImageViaLink, without letting those
+// URLs reach into our own network or tie up the server.
+package fetch
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// ErrSchemeNotAllowed is returned for URLs that aren't http(s)
+	ErrSchemeNotAllowed fetchError = "fetch: only http and https links are supported"
+
+	// ErrAddressBlocked is returned when a URL resolves to a private,
+	// loopback or otherwise internal address
+	ErrAddressBlocked fetchError = "fetch: link points to an address that is not allowed"
+
+	// ErrTooManyRedirects is returned when a URL redirects more than
+	// MaxRedirects times
+	ErrTooManyRedirects fetchError = "fetch: link redirected too many times"
+
+	// ErrTooLarge is returned when a response body is over MaxSize
+	ErrTooLarge fetchError = "fetch: file is too large"
+
+	// ErrTimeout is returned when a download takes longer than Timeout
+	ErrTimeout fetchError = "fetch: download timed out"
+
+	// ErrBadStatus is returned for non 2xx responses
+	ErrBadStatus fetchError = "fetch: remote server returned an error"
+
+	// ErrFailed is returned for any other network error
+	ErrFailed fetchError = "fetch: download failed"
+)
+
+type fetchError string
+
+func (e fetchError) Error() string {
+	return string(e)
+}
+
+// Public lets fetch errors be shown to users, see views.PublicError
+func (e fetchError) Public() string {
+	s := strings.Replace(string(e), "fetch: ", "", 1)
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// Result is the outcome of fetching a single URL
+type Result struct {
+	URL      string
+	Filename string
+	Err      error
+}
+
+// HandlerFunc is called with the body of every successful download,
+// with res.Filename set from the final URL. The handler may change
+// res.Filename to whatever name the file was stored under. The body
+// must be fully consumed before returning, it is closed afterwards.
+type HandlerFunc func(res *Result, body io.Reader) error
+
+type Config func(*Fetcher)
+
+// WithWorkers sets how many URLs are fetched at the same time, by
+// every call on the Fetcher together
+func WithWorkers(n int) Config {
+	return func(f *Fetcher) {
+		f.workers = n
+	}
+}
+
+// WithTimeout sets how long a single download, including redirects
+// and reading the body, may take
+func WithTimeout(d time.Duration) Config {
+	return func(f *Fetcher) {
+		f.timeout = d
+	}
+}
+
+// WithMaxSize sets the largest response body that will be read
+func WithMaxSize(n int64) Config {
+	return func(f *Fetcher) {
+		f.maxSize = n
+	}
+}
+
+// WithMaxRedirects sets how many redirects are followed
+func WithMaxRedirects(n int) Config {
+	return func(f *Fetcher) {
+		f.maxRedirects = n
+	}
+}
+
+// WithSchemes sets the allowed URL schemes
+func WithSchemes(schemes ...string) Config {
+	return func(f *Fetcher) {
+		f.schemes = schemes
+	}
+}
+
+// WithAllowPrivate turns off blocking of internal addresses. This is
+// only meant for tests that fetch from a local httptest server.
+func WithAllowPrivate() Config {
+	return func(f *Fetcher) {
+		f.allowPrivate = true
+	}
+}
+
+// New creates a Fetcher, applying the configs over our defaults of
+// 4 workers, a 30 second timeout, 3 redirects and http(s) only.
+func New(cfgs ...Config) *Fetcher {
+	f := Fetcher{
+		workers:      4,
+		timeout:      30 * time.Second,
+		maxSize:      20 << 20,
+		maxRedirects: 3,
+		schemes:      []string{"https", "http"},
+	}
+	for _, cfg := range cfgs {
+		cfg(&f)
+	}
+	f.slots = make(chan struct{}, f.workers)
+
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: f.checkAddress,
+	}
+	f.client = &http.Client{
+		Timeout: f.timeout,
+		Transport: &http.Transport{
+			// Never use an environment proxy, it would do the dialing
+			// for us and bypass the address checks
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: f.timeout,
+			MaxIdleConns:          f.workers,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > f.maxRedirects {
+				return ErrTooManyRedirects
+			}
+			return f.checkScheme(req.URL)
+		},
+	}
+	return &f
+}
+
+// Fetcher downloads URLs with a bounded pool of workers, shared by
+// every request using it
+type Fetcher struct {
+	workers      int
+	slots        chan struct{}
+	timeout      time.Duration
+	maxSize      int64
+	maxRedirects int
+	schemes      []string
+	allowPrivate bool
+	client       *http.Client
+}
+
+// FetchAll downloads every URL, passing each body to fn, and returns
+// one Result per URL in the same order the URLs were given.
+func (f *Fetcher) FetchAll(urls []string, fn HandlerFunc) []Result {
+	results := make([]Result, len(urls))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	workers := f.workers
+	if workers > len(urls) {
+		workers = len(urls)
+	}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				results[j] = f.Fetch(urls[j], fn)
+			}
+		}()
+	}
+	for i := range urls {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+// Fetch downloads a single URL and passes the body to fn. It waits
+// while the Fetcher's workers are all busy.
+func (f *Fetcher) Fetch(rawURL string, fn HandlerFunc) Result {
+	f.slots <- struct{}{}
+	defer func() { <-f.slots }()
+
+	res := Result{URL: rawURL}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		res.Err = ErrFailed
+		return res
+	}
+	if res.Err = f.checkScheme(u); res.Err != nil {
+		return res
+	}
+
+	resp, err := f.client.Get(u.String())
+	if err != nil {
+		res.Err = f.translate(err)
+		return res
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		res.Err = ErrBadStatus
+		return res
+	}
+	if resp.ContentLength > f.maxSize {
+		res.Err = ErrTooLarge
+		return res
+	}
+
+	res.Filename = path.Base(resp.Request.URL.Path)
+	body := &limitedReader{r: resp.Body, n: f.maxSize}
+	if err := fn(&res, body); err != nil {
+		res.Err = f.translate(err)
+	}
+	return res
+}
+
+func (f *Fetcher) checkScheme(u *url.URL) error {
+	for _, s := range f.schemes {
+		if strings.EqualFold(u.Scheme, s) {
+			return nil
+		}
+	}
+	return ErrSchemeNotAllowed
+}
+
+// checkAddress runs right before every connection is made, after DNS
+// resolution, so hostnames that resolve to internal addresses are
+// caught too.
+func (f *Fetcher) checkAddress(network, address string, _ syscall.RawConn) error {
+	if f.allowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return ErrAddressBlocked
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || IsBlocked(ip) {
+		return ErrAddressBlocked
+	}
+	return nil
+}
+
+// translate turns the errors returned by the http client into the
+// fetch errors above, so users get a useful message.
+func (f *Fetcher) translate(err error) error {
+	var fErr fetchError
+	if errors.As(err, &fErr) {
+		return fErr
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrTimeout
+	}
+	var pErr interface{ Public() string }
+	if errors.As(err, &pErr) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrFailed, err)
+}
+
+var blockedNets = []*net.IPNet{
+	mustCIDR("0.0.0.0/8"),
+	mustCIDR("100.64.0.0/10"), // carrier grade NAT
+	mustCIDR("192.0.0.0/24"),
+	mustCIDR("198.18.0.0/15"),
+	mustCIDR("240.0.0.0/4"),
+	mustCIDR("64:ff9b::/96"), // NAT64 can reach IPv4 internals
+}
+
+// IsBlocked reports whether ip is an address we never fetch from,
+// such as loopback, private, link-local or multicast addresses.
+func IsBlocked(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// limitedReader returns ErrTooLarge once more than n bytes are read
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, ErrTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, ErrTooLarge
+	}
+	return n, err
+}
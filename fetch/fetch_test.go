@@ -0,0 +1,121 @@
+package fetch
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIsBlocked(t *testing.T) {
+	blocked := []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1",
+		"169.254.169.254", "100.64.0.1", "0.0.0.0", "::1", "fe80::1", "fc00::1",
+		"::ffff:127.0.0.1"}
+	for _, s := range blocked {
+		if !IsBlocked(net.ParseIP(s)) {
+			t.Errorf("Expected %s to be blocked", s)
+		}
+	}
+	allowed := []string{"8.8.8.8", "162.125.1.1", "2606:4700::1111"}
+	for _, s := range allowed {
+		if IsBlocked(net.ParseIP(s)) {
+			t.Errorf("Expected %s to be allowed", s)
+		}
+	}
+}
+
+func TestFetchBlocksLoopback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secret")
+	}))
+	defer srv.Close()
+
+	f := New()
+	res := f.Fetch(srv.URL+"/photo.jpg", func(res *Result, body io.Reader) error {
+		t.Error("Handler should not be called for a blocked address")
+		return nil
+	})
+	if res.Err != ErrAddressBlocked {
+		t.Errorf("Expected ErrAddressBlocked. Recieved %v", res.Err)
+	}
+
+	res = f.Fetch("file:///etc/passwd", nil)
+	if res.Err != ErrSchemeNotAllowed {
+		t.Errorf("Expected ErrSchemeNotAllowed. Recieved %v", res.Err)
+	}
+}
+
+func TestFetchAll(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/a.jpg", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "small")
+	})
+	mux.HandleFunc("/big.jpg", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Repeat("x", 100))
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	f := New(WithAllowPrivate(), WithMaxSize(10), WithWorkers(2))
+	urls := []string{srv.URL + "/a.jpg", srv.URL + "/big.jpg", srv.URL + "/loop", srv.URL + "/missing.jpg"}
+	results := f.FetchAll(urls, func(res *Result, body io.Reader) error {
+		_, err := io.ReadAll(body)
+		return err
+	})
+	want := []error{nil, ErrTooLarge, ErrTooManyRedirects, ErrBadStatus}
+	for i, res := range results {
+		if res.URL != urls[i] {
+			t.Errorf("Expected result %d to be for %s. Recieved %s", i, urls[i], res.URL)
+		}
+		if res.Err != want[i] {
+			t.Errorf("%s: expected %v. Recieved %v", urls[i], want[i], res.Err)
+		}
+	}
+	if results[0].Filename != "a.jpg" {
+		t.Errorf("Expected filename a.jpg. Recieved %q", results[0].Filename)
+	}
+}
+
+func TestFetchAllSharesWorkers(t *testing.T) {
+	var mu sync.Mutex
+	var busy, most int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		busy++
+		if busy > most {
+			most = busy
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		busy--
+		mu.Unlock()
+		io.WriteString(w, "small")
+	}))
+	defer srv.Close()
+
+	f := New(WithAllowPrivate(), WithWorkers(2))
+	urls := []string{srv.URL + "/a.jpg", srv.URL + "/b.jpg", srv.URL + "/c.jpg"}
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.FetchAll(urls, func(res *Result, body io.Reader) error {
+				_, err := io.ReadAll(body)
+				return err
+			})
+		}()
+	}
+	wg.Wait()
+	if most > 2 {
+		t.Errorf("Expected at most 2 downloads at once. Recieved %d", most)
+	}
+}
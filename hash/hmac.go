@@ -4,28 +4,28 @@ import (
   "crypto/hmac"
   "crypto/sha256"
   "encoding/base64"
-  "hash"
 )
 
 // HMAC is a wrapper around the crypto/hmac package
 // making it a little easier to use
 type HMAC struct {
-  hmac hash.Hash
+  key []byte
 }
 
 // NewHMAC creates and returns a new HMAC object
 func NewHMAC(key string) HMAC {
-  h := hmac.New(sha256.New, []byte(key))
   return HMAC{
-    hmac: h,
+    key: []byte(key),
   }
 }
 
 // Hash will will provide hased value of input string
-// using HMAC with a secret key provided when HMAC object is created
+// using HMAC with a secret key provided when HMAC object is created.
+// A new hash.Hash is used for every call so Hash is safe to use from
+// multiple goroutines, eg concurrent requests.
 func (h HMAC) Hash(input string) string {
-  h.hmac.Reset()
-  h.hmac.Write([]byte(input))
-  b := h.hmac.Sum(nil)
+  mac := hmac.New(sha256.New, h.key)
+  mac.Write([]byte(input))
+  b := mac.Sum(nil)
   return base64.URLEncoding.EncodeToString(b)
 }
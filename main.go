@@ -4,6 +4,8 @@ import (
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
@@ -14,6 +16,8 @@ import (
 	"github.com/imattf/go-courses/gallery/middleware"
 	"github.com/imattf/go-courses/gallery/models"
 	"github.com/imattf/go-courses/gallery/rand"
+	"github.com/imattf/go-courses/gallery/storage"
+	"github.com/imattf/go-courses/gallery/tus"
 )
 
 func main() {
@@ -22,13 +26,29 @@ func main() {
 	flag.Parse()
 
 	cfg := LoadConfig(*envPtr)
+	if err := cfg.Validate(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 	dbCfg := cfg.Database
+	store, err := newBlobStore(cfg.Storage)
+	if err != nil {
+		panic(err)
+	}
+	uploads, err := newUploadStore(cfg.Storage)
+	if err != nil {
+		panic(err)
+	}
 	services, err := models.NewServices(
 		models.WithGorm(dbCfg.Dialect(), dbCfg.ConnectionInfo()),
 		models.WithLogMode(!cfg.IsProd()),
-		models.WithUser(cfg.Pepper, cfg.HMACKey),
-		models.WithGallery(),
-		models.WithImage(),
+		models.WithUser(cfg.Pepper, cfg.HMACKey, cfg.EncryptionKey),
+		models.WithSession(cfg.HMACKey),
+		models.WithWebAuthn(cfg.WebAuthn.RPID, cfg.WebAuthn.Origins, cfg.EncryptionKey),
+		models.WithGallery(cfg.Pepper, cfg.HMACKey),
+		models.WithImage(store),
+		models.WithShareLink(cfg.HMACKey),
+		models.WithGalleryMember(cfg.HMACKey),
 		models.WithOAuth(),
 	)
 
@@ -41,6 +61,16 @@ func main() {
 	// services.DestructiveReset()
 	// Auto construct from the gorm data model
 	services.AutoMigrate()
+	// Before serving, so no upload can take the filename of a file
+	// that is still being imported
+	n, err := services.Image.ImportStored()
+	if err != nil {
+		fmt.Println("Failed to import stored images:", err)
+	}
+	if n > 0 {
+		fmt.Printf("Imported %d stored images\n", n)
+	}
+	go emptyTrash(services)
 
 	// email mailgun stuff...
 	mgCfg := cfg.Mailgun
@@ -55,8 +85,8 @@ func main() {
 	r := mux.NewRouter()
 
 	staticC := controllers.NewStatic()
-	usersC := controllers.NewUsers(services.User, emailer)
-	galleriesC := controllers.NewGalleries(services.Gallery, services.Image, r)
+	usersC := controllers.NewUsers(services.User, services.Session, services.WebAuthn, emailer)
+	galleriesC := controllers.NewGalleries(services.Gallery, services.Image, services.ShareLink, services.GalleryMember, store, uploads, emailer, r)
 
 	configs := make(map[string]*oauth2.Config)
 	configs[models.OAuthDropbox] = &oauth2.Config{
@@ -74,11 +104,15 @@ func main() {
 	must(err)
 	csrfMw := csrf.Protect(b, csrf.Secure(cfg.IsProd()))
 	userMw := middleware.User{
-		UserService: services.User,
+		UserService:    services.User,
+		SessionService: services.Session,
 	}
 	requireUserMw := middleware.RequireUser{
 		User: userMw,
 	}
+	requireVerifiedMw := middleware.RequireVerified{
+		RequireUser: requireUserMw,
+	}
 
 	// use custom 404 page
 	r.NotFoundHandler = http.HandlerFunc(notFoundPage)
@@ -90,11 +124,31 @@ func main() {
 	r.HandleFunc("/signup", usersC.Create).Methods("POST")
 	r.Handle("/login", usersC.LoginView).Methods("GET")
 	r.HandleFunc("/login", usersC.Login).Methods("POST")
+	r.HandleFunc("/login/2fa", usersC.LoginTOTPForm).Methods("GET")
+	r.HandleFunc("/login/2fa", usersC.LoginTOTP).Methods("POST")
+	r.HandleFunc("/login/passkey", usersC.PasskeyLoginBegin).Methods("POST")
+	r.HandleFunc("/login/passkey/finish", usersC.PasskeyLoginFinish).Methods("POST")
+	r.HandleFunc("/login/2fa/passkey", usersC.PasskeyTwoFactorBegin).Methods("POST")
+	r.HandleFunc("/login/2fa/passkey/finish", usersC.PasskeyTwoFactorFinish).Methods("POST")
 	r.HandleFunc("/logout", requireUserMw.ApplyFn(usersC.Logout)).Methods("POST")
 	r.Handle("/forgot", usersC.ForgotPwView).Methods("GET")
 	r.HandleFunc("/forgot", usersC.InitiateReset).Methods("POST")
 	r.HandleFunc("/reset", usersC.ResetPw).Methods("GET")
 	r.HandleFunc("/reset", usersC.CompleteReset).Methods("POST")
+	r.HandleFunc("/verify", usersC.Verify).Methods("GET")
+	r.HandleFunc("/account", requireUserMw.ApplyFn(usersC.Account)).Methods("GET")
+	r.HandleFunc("/account/verify", requireUserMw.ApplyFn(usersC.VerifyResend)).Methods("POST")
+	r.HandleFunc("/account/name", requireUserMw.ApplyFn(usersC.NameUpdate)).Methods("POST")
+	r.HandleFunc("/account/email", requireUserMw.ApplyFn(usersC.EmailUpdate)).Methods("POST")
+	r.HandleFunc("/account/password", requireUserMw.ApplyFn(usersC.PasswordUpdate)).Methods("POST")
+	r.HandleFunc("/account/sessions/delete", requireUserMw.ApplyFn(usersC.SessionDeleteOthers)).Methods("POST")
+	r.HandleFunc("/account/sessions/{id:[0-9]+}/delete", requireUserMw.ApplyFn(usersC.SessionDelete)).Methods("POST")
+	r.HandleFunc("/account/2fa", requireUserMw.ApplyFn(usersC.TOTPSetup)).Methods("GET")
+	r.HandleFunc("/account/2fa", requireUserMw.ApplyFn(usersC.TOTPEnable)).Methods("POST")
+	r.HandleFunc("/account/2fa/disable", requireUserMw.ApplyFn(usersC.TOTPDisable)).Methods("POST")
+	r.HandleFunc("/account/passkeys/begin", requireUserMw.ApplyFn(usersC.PasskeyRegisterBegin)).Methods("POST")
+	r.HandleFunc("/account/passkeys/finish", requireUserMw.ApplyFn(usersC.PasskeyRegisterFinish)).Methods("POST")
+	r.HandleFunc("/account/passkeys/{id:[0-9]+}/delete", requireUserMw.ApplyFn(usersC.PasskeyDelete)).Methods("POST")
 	// r.HandleFunc("/cookie", usersC.CookieTest).Methods("GET")
 
 	// OAuth routes
@@ -107,8 +161,9 @@ func main() {
 	assetHandler = http.StripPrefix("/assets/", assetHandler)
 	r.PathPrefix("/assets/").Handler(assetHandler)
 
-	// Image routes
-	imageHandler := http.FileServer(http.Dir("./images/"))
+	// Image routes, which check the gallery each file belongs to
+	// may be seen before serving it
+	imageHandler := http.HandlerFunc(galleriesC.ImageFile)
 	r.PathPrefix("/images/").Handler(http.StripPrefix("/images/", imageHandler))
 
 	// Gallery routes
@@ -120,8 +175,38 @@ func main() {
 	r.HandleFunc("/galleries/{id:[0-9]+}/delete", requireUserMw.ApplyFn(galleriesC.Delete)).Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}/images", requireUserMw.ApplyFn(galleriesC.ImageUpload)).Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}/images/link", requireUserMw.ApplyFn(galleriesC.ImageViaLink)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/archive", requireUserMw.ApplyFn(galleriesC.ImageArchive)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads", galleriesC.UploadOptions).Methods("OPTIONS")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads", requireUserMw.ApplyFn(galleriesC.UploadCreate)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads/{upload_id}", galleriesC.UploadOptions).Methods("OPTIONS")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads/{upload_id}", requireUserMw.ApplyFn(galleriesC.UploadHead)).Methods("HEAD")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads/{upload_id}", requireUserMw.ApplyFn(galleriesC.UploadPatch)).Methods("PATCH")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads/{upload_id}", requireUserMw.ApplyFn(galleriesC.UploadDelete)).Methods("DELETE")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/order", requireUserMw.ApplyFn(galleriesC.ImageOrder)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/similar", requireUserMw.ApplyFn(galleriesC.Similar)).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/similar", requireUserMw.ApplyFn(galleriesC.SimilarKeep)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}", galleriesC.ImageShow).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/original", requireUserMw.ApplyFn(galleriesC.ImageOriginal)).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/update", requireUserMw.ApplyFn(galleriesC.ImageUpdate)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/cover", requireUserMw.ApplyFn(galleriesC.ImageCover)).Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete", requireUserMw.ApplyFn(galleriesC.ImageDelete)).Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}", galleriesC.Show).Methods("GET").Name(controllers.ShowGallery)
+	r.HandleFunc("/galleries/{id:[0-9]+}/unlock", galleriesC.Unlock).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/download", galleriesC.Download).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/shares", requireVerifiedMw.ApplyFn(galleriesC.ShareCreate)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/shares/{share_id:[0-9]+}/revoke", requireUserMw.ApplyFn(galleriesC.ShareRevoke)).Methods("POST")
+	r.HandleFunc("/s/{token}", galleriesC.SharedShow).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/members", requireVerifiedMw.ApplyFn(galleriesC.MemberInvite)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/members/{member_id:[0-9]+}/update", requireUserMw.ApplyFn(galleriesC.MemberUpdate)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/members/{member_id:[0-9]+}/delete", requireUserMw.ApplyFn(galleriesC.MemberDelete)).Methods("POST")
+	r.HandleFunc("/invites/{token}", requireUserMw.ApplyFn(galleriesC.InviteAccept)).Methods("GET")
+
+	// Trash routes
+	r.HandleFunc("/trash", requireUserMw.ApplyFn(galleriesC.Trash)).Methods("GET")
+	r.HandleFunc("/trash/galleries/{id:[0-9]+}/restore", requireUserMw.ApplyFn(galleriesC.TrashGalleryRestore)).Methods("POST")
+	r.HandleFunc("/trash/galleries/{id:[0-9]+}/delete", requireUserMw.ApplyFn(galleriesC.TrashGalleryDelete)).Methods("POST")
+	r.HandleFunc("/trash/images/{id:[0-9]+}/restore", requireUserMw.ApplyFn(galleriesC.TrashImageRestore)).Methods("POST")
+	r.HandleFunc("/trash/images/{id:[0-9]+}/delete", requireUserMw.ApplyFn(galleriesC.TrashImageDelete)).Methods("POST")
 
 	// Server startup...
 	fmt.Printf("Starting galleries on port :%d...\n", cfg.Port)
@@ -135,6 +220,59 @@ func must(err error) {
 	}
 }
 
+func newBlobStore(cfg StorageConfig) (storage.BlobStore, error) {
+	switch cfg.Backend {
+	case "s3":
+		s3Cfg := cfg.S3
+		return storage.NewS3(s3Cfg.Endpoint, s3Cfg.Region, s3Cfg.Bucket, s3Cfg.AccessKey, s3Cfg.SecretKey)
+	case "disk", "":
+		dir := cfg.Dir
+		if dir == "" {
+			dir = DefaultStorageConfig().Dir
+		}
+		return storage.NewDisk(dir), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
+}
+
+// newUploadStore creates the store for resumable uploads and starts
+// removing the ones that were abandoned.
+func newUploadStore(cfg StorageConfig) (*tus.Store, error) {
+	dir := cfg.UploadDir
+	if dir == "" {
+		dir = DefaultStorageConfig().UploadDir
+	}
+	uploads, err := tus.NewStore(dir, tus.WithMaxSize(models.MaxImageSize))
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for range time.Tick(time.Hour) {
+			if _, err := uploads.Sweep(); err != nil {
+				fmt.Println("Failed to remove expired uploads:", err)
+			}
+		}
+	}()
+	return uploads, nil
+}
+
+// emptyTrash removes deleted galleries and images, and their files,
+// once they have been kept for models.TrashRetention.
+func emptyTrash(services *models.Services) {
+	tick := time.Tick(time.Hour)
+	for {
+		n, err := services.EmptyTrash(models.TrashRetention)
+		if err != nil {
+			fmt.Println("Failed to empty the trash:", err)
+		}
+		if n > 0 {
+			fmt.Printf("Purged %d deleted galleries and images\n", n)
+		}
+		<-tick
+	}
+}
+
 func notFoundPage(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
 
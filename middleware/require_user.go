@@ -1,15 +1,18 @@
 package middleware
 
 import (
+	"log"
 	"net/http"
 	"strings"
 
 	"github.com/imattf/go-courses/gallery/context"
 	"github.com/imattf/go-courses/gallery/models"
+	"github.com/imattf/go-courses/gallery/views"
 )
 
 type User struct {
 	models.UserService
+	SessionService models.SessionService
 }
 
 func (mw *User) Apply(next http.Handler) http.HandlerFunc {
@@ -19,32 +22,45 @@ func (mw *User) Apply(next http.Handler) http.HandlerFunc {
 func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		// If the user is requesting a static assets or image
-		// we will not need to lookup the current user, so we skip
-		// doing that.
+		// If the user is requesting a static asset we will not
+		// need to lookup the current user, so we skip doing that.
+		// Images do need the user, private galleries only serve
+		// them to their owner.
 		path := r.URL.Path
-		if strings.HasPrefix(path, "/assets") ||
-			strings.HasPrefix(path, "/images") {
+		if strings.HasPrefix(path, "/assets") {
 			next(w, r)
 			return
 		}
 
 		//if the user is logged in...
-		cookie, err := r.Cookie("remember_token")
+		cookie, err := r.Cookie(SessionCookieName)
 		if err != nil {
 			next(w, r)
 			return
 		}
 
-		user, err := mw.UserService.ByRemember(cookie.Value)
+		session, err := mw.SessionService.ByToken(cookie.Value)
 		if err != nil {
 			next(w, r)
 			return
 		}
+		user, err := mw.UserService.ByID(session.UserID)
+		if err != nil {
+			next(w, r)
+			return
+		}
+		// The cookie is extended along with the session
+		expires := session.ExpiresAt
+		if err := mw.SessionService.Touch(session); err != nil {
+			log.Println(err)
+		} else if !session.ExpiresAt.Equal(expires) {
+			http.SetCookie(w, SessionCookie(r, cookie.Value, session.ExpiresAt))
+		}
 
 		//user is found...
 		ctx := r.Context()
 		ctx = context.WithUser(ctx, user)
+		ctx = context.WithSession(ctx, session)
 		r = r.WithContext(ctx)
 		next(w, r)
 	})
@@ -77,3 +93,28 @@ func (mw *RequireUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 		next(w, r)
 	})
 }
+
+// RequireVerified is for features, like sharing, that only users who
+// verified their email address can use. Others are sent to their
+// account page, where they can ask for a new verification email.
+type RequireVerified struct {
+	RequireUser
+}
+
+func (mw *RequireVerified) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *RequireVerified) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return mw.RequireUser.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if !user.Verified() {
+			views.RedirectAlert(w, r, "/account", http.StatusFound, views.Alert{
+				Level:   views.AlertLevelWarning,
+				Message: "Please verify your email address first, we sent you an email with a link to do so.",
+			})
+			return
+		}
+		next(w, r)
+	})
+}
@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+)
+
+// SessionCookieName is the cookie a device keeps its session token in
+const SessionCookieName = "remember_token"
+
+// SessionCookie keeps the session token on the device until the
+// session expires. It is sent to every page, whichever one signed the
+// user in, but only over HTTPS when the request came in over HTTPS
+// and not along with requests from other sites.
+func SessionCookie(r *http.Request, token string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   SecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// SecureRequest reports whether r came in over HTTPS, directly or
+// through a proxy, so cookies set in reply can be kept to HTTPS
+func SecureRequest(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
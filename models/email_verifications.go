@@ -0,0 +1,145 @@
+package models
+
+import (
+	"time"
+
+	"github.com/imattf/go-courses/gallery/hash"
+	"github.com/imattf/go-courses/gallery/rand"
+	"github.com/jinzhu/gorm"
+)
+
+// EmailVerificationExpiry is how long the link to verify an email
+// address works for
+const EmailVerificationExpiry = 48 * time.Hour
+
+// emailVerification proves a user owns Email once they follow the
+// link with Token that was sent there. Like password resets only a
+// hash of the token is stored.
+type emailVerification struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null;index"`
+	Email     string `gorm:"not null"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+}
+
+type emailVerificationDB interface {
+	ByToken(token string) (*emailVerification, error)
+
+	// Create also removes the user's expired verifications
+	Create(ev *emailVerification) error
+	DeleteByUserID(userID uint) error
+}
+
+func newEmailVerificationValidator(db emailVerificationDB, hmac hash.HMAC) *emailVerificationValidator {
+	return &emailVerificationValidator{
+		emailVerificationDB: db,
+		hmac:                hmac,
+	}
+}
+
+type emailVerificationValidator struct {
+	emailVerificationDB
+	hmac hash.HMAC
+}
+
+func (evv *emailVerificationValidator) ByToken(token string) (*emailVerification, error) {
+	ev := emailVerification{Token: token}
+	err := runEmailVerificationValFns(&ev, evv.hmacToken)
+	if err != nil {
+		return nil, err
+	}
+	return evv.emailVerificationDB.ByToken(ev.TokenHash)
+}
+
+func (evv *emailVerificationValidator) Create(ev *emailVerification) error {
+	err := runEmailVerificationValFns(ev,
+		evv.requireUserID,
+		evv.requireEmail,
+		evv.setTokenIfUnset,
+		evv.hmacToken,
+	)
+	if err != nil {
+		return err
+	}
+	return evv.emailVerificationDB.Create(ev)
+}
+
+func (evv *emailVerificationValidator) DeleteByUserID(userID uint) error {
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+	return evv.emailVerificationDB.DeleteByUserID(userID)
+}
+
+func (evv *emailVerificationValidator) requireUserID(ev *emailVerification) error {
+	if ev.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (evv *emailVerificationValidator) requireEmail(ev *emailVerification) error {
+	if ev.Email == "" {
+		return ErrEmailRequired
+	}
+	return nil
+}
+
+func (evv *emailVerificationValidator) setTokenIfUnset(ev *emailVerification) error {
+	if ev.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	ev.Token = token
+	return nil
+}
+
+func (evv *emailVerificationValidator) hmacToken(ev *emailVerification) error {
+	if ev.Token == "" {
+		return nil
+	}
+	ev.TokenHash = evv.hmac.Hash(ev.Token)
+	return nil
+}
+
+type emailVerificationValFn func(*emailVerification) error
+
+func runEmailVerificationValFns(ev *emailVerification, fns ...emailVerificationValFn) error {
+	for _, fn := range fns {
+		if err := fn(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type emailVerificationGorm struct {
+	db *gorm.DB
+}
+
+func (evg *emailVerificationGorm) ByToken(tokenHash string) (*emailVerification, error) {
+	var ev emailVerification
+	err := first(evg.db.Where("token_hash = ?", tokenHash), &ev)
+	if err != nil {
+		return nil, err
+	}
+	return &ev, nil
+}
+
+func (evg *emailVerificationGorm) Create(ev *emailVerification) error {
+	err := evg.db.Unscoped().
+		Where("user_id = ? AND created_at <= ?", ev.UserID, time.Now().Add(-EmailVerificationExpiry)).
+		Delete(&emailVerification{}).Error
+	if err != nil {
+		return err
+	}
+	return evg.db.Create(ev).Error
+}
+
+func (evg *emailVerificationGorm) DeleteByUserID(userID uint) error {
+	return evg.db.Unscoped().Where("user_id = ?", userID).Delete(&emailVerification{}).Error
+}
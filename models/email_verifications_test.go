@@ -0,0 +1,87 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/imattf/go-courses/gallery/hash"
+)
+
+type emailVerificationMemory struct {
+	evs []emailVerification
+}
+
+func (m *emailVerificationMemory) ByToken(tokenHash string) (*emailVerification, error) {
+	for _, ev := range m.evs {
+		if ev.TokenHash == tokenHash {
+			return &ev, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *emailVerificationMemory) Create(ev *emailVerification) error {
+	ev.CreatedAt = time.Now()
+	m.evs = append(m.evs, *ev)
+	return nil
+}
+
+func (m *emailVerificationMemory) DeleteByUserID(userID uint) error {
+	m.evs = nil
+	return nil
+}
+
+func TestCompleteVerification(t *testing.T) {
+	user := &User{Email: "jon@example.com"}
+	user.ID = 42
+	users := &userMemory{user: user}
+	us := &userService{
+		UserDB:         users,
+		verificationDB: newEmailVerificationValidator(&emailVerificationMemory{}, hash.NewHMAC("test-key")),
+	}
+
+	token, err := us.InitiateVerification(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A link sent before the email address changed doesn't verify
+	// the new one
+	user.Email = "jon@example.org"
+	if _, err := us.CompleteVerification(token); err != ErrTokenInvalid {
+		t.Errorf("Expected ErrTokenInvalid. Recieved %v", err)
+	}
+	user.Email = "jon@example.com"
+	verified, err := us.CompleteVerification(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verified.Verified() || !users.user.Verified() {
+		t.Error("Expected the user to be verified")
+	}
+	if _, err := us.CompleteVerification(token); err != ErrTokenInvalid {
+		t.Errorf("Expected used token to be invalid. Recieved %v", err)
+	}
+	if _, err := us.InitiateVerification(user); err != ErrEmailVerified {
+		t.Errorf("Expected ErrEmailVerified. Recieved %v", err)
+	}
+}
+
+func TestUnverifyChangedEmail(t *testing.T) {
+	stored := &User{Email: "jon@example.com"}
+	stored.ID = 42
+	uv := &userValidator{UserDB: &userMemory{user: stored}}
+	for email, want := range map[string]bool{
+		"jon@example.com": true,
+		"jon@example.org": false,
+	} {
+		user := *stored
+		user.Email = email
+		user.VerifiedAt = &user.CreatedAt
+		if err := uv.unverifyChangedEmail(&user); err != nil {
+			t.Fatal(err)
+		}
+		if user.Verified() != want {
+			t.Errorf("Expected verified to be %v for %s. Recieved %v", want, email, user.Verified())
+		}
+	}
+}
@@ -25,6 +25,10 @@ const (
 	// or create of a user
 	ErrEmailTaken modelError = "models: Email address is already taken"
 
+	// ErrEmailVerified is returned when asking to verify an email
+	// address that was already verified
+	ErrEmailVerified modelError = "models: your email address is already verified"
+
 	// ErrPasswordRequired is return when creating a user and no password
 	// is provided
 	ErrPasswordRequired modelError = "models: Password is required"
@@ -35,22 +39,125 @@ const (
 	// ErrTitleRequired is used to insure valid title is supplied for gallery
 	ErrTitleRequired modelError = "models: title is required"
 
+	// ErrFilenameRequired is used to insure an image has a filename
+	ErrFilenameRequired modelError = "models: filename is required"
+
+	// ErrFilenameInvalid is returned when a filename contains path separators,
+	// dot-segments or other characters we don't allow
+	ErrFilenameInvalid modelError = "models: filename is not valid"
+
+	// ErrImageInvalid is returned when an uploaded file is not an image
+	// in one of the formats we support
+	ErrImageInvalid modelError = "models: only JPEG, PNG, GIF and WebP images can be uploaded"
+
+	// ErrImageTooLarge is returned when an image is larger than MaxImageSize
+	ErrImageTooLarge modelError = "models: images must be 20MB or smaller"
+
+	// ErrImageTooManyPixels is returned when an image has more than
+	// MaxImagePixels
+	ErrImageTooManyPixels modelError = "models: images must be 50 megapixels or smaller"
+
+	// ErrImageDuplicate is returned when an image is already in the
+	// gallery, even under another name
+	ErrImageDuplicate modelError = "models: this image is already in the gallery"
+
+	// ErrUploadTooLarge is returned when an upload request is larger
+	// than MaxUploadSize
+	ErrUploadTooLarge modelError = "models: uploads must be 100MB or smaller in total"
+
+	// ErrArchiveTooLarge is returned when a ZIP archive of images is
+	// larger than MaxArchiveSize
+	ErrArchiveTooLarge modelError = "models: zip archives must be 1GB or smaller"
+
+	// ErrMetadataPolicyInvalid is returned for unknown gallery metadata policies
+	ErrMetadataPolicyInvalid modelError = "models: metadata setting is not valid"
+
+	// ErrGalleryLocked is returned after too many wrong gallery passwords
+	ErrGalleryLocked modelError = "models: too many wrong passwords, please wait a few minutes and try again"
+
+	// ErrVisibilityInvalid is returned for unknown gallery visibility levels
+	ErrVisibilityInvalid modelError = "models: visibility setting is not valid"
+
+	// ErrImageTitleTooLong is returned when an image title is longer
+	// than maxImageTitleLength
+	ErrImageTitleTooLong modelError = "models: image titles must be 200 characters or less"
+
+	// ErrAltTextTooLong is returned when image alt text is longer than
+	// maxAltTextLength
+	ErrAltTextTooLong modelError = "models: alt text must be 500 characters or less"
+
+	// ErrCaptionTooLong is returned when an image caption is longer
+	// than maxCaptionLength
+	ErrCaptionTooLong modelError = "models: captions must be 2000 characters or less"
+
+	// ErrImageOrderInvalid is returned when a new image order doesn't
+	// list every image in the gallery exactly once
+	ErrImageOrderInvalid modelError = "models: image order doesn't match the images in the gallery, please reload and try again"
+
+	// ErrShareLinkInvalid is returned for share links that don't exist,
+	// have expired, have no views left or were revoked
+	ErrShareLinkInvalid modelError = "models: this link is not valid or has expired"
+
+	// ErrShareLinkExpiryInvalid is returned when a share link would
+	// already be expired when created
+	ErrShareLinkExpiryInvalid modelError = "models: link expiry must be in the future"
+
+	// ErrShareLinkMaxViewsInvalid is returned for a negative view limit
+	ErrShareLinkMaxViewsInvalid modelError = "models: view limit can't be negative"
+
+	// ErrInviteInvalid is returned for gallery invitations that don't
+	// exist, were already accepted or were sent to another email address
+	ErrInviteInvalid modelError = "models: this invitation is not valid, please make sure you are signed in with the email address it was sent to"
+
+	// ErrMemberExists is returned when inviting an email address that
+	// was already invited to the gallery
+	ErrMemberExists modelError = "models: that email address was already invited to this gallery"
+
+	// ErrRoleInvalid is returned for unknown gallery member roles
+	ErrRoleInvalid modelError = "models: role is not valid"
+
+	// ErrTOTPCodeInvalid is returned for two-factor codes that are
+	// wrong or were already used
+	ErrTOTPCodeInvalid modelError = "models: that code is not valid, please try again"
+
+	// ErrTOTPLocked is returned after too many wrong two-factor codes
+	ErrTOTPLocked modelError = "models: too many wrong codes, please wait a few minutes and try again"
+
+	// ErrTOTPEnabled is returned when setting up two-factor
+	// authentication for a user who already has it turned on
+	ErrTOTPEnabled modelError = "models: two-factor authentication is already turned on"
+
+	// ErrPasskeyInvalid is returned when a passkey couldn't be
+	// registered or used, including when the browser took too long
+	ErrPasskeyInvalid modelError = "models: that passkey could not be verified, please try again"
+
+	// ErrPasskeyNameTooLong is returned when a passkey name is longer
+	// than maxPasskeyNameLength
+	ErrPasskeyNameTooLong modelError = "models: passkey names must be 100 characters or less"
+
 	// ErrTokenInvalid is used to insure valid token is supplied for password reset
 	ErrTokenInvalid modelError = "models: token provided is not valid"
 
 	// ErrIDInvalid is returned when an ID is 0, for example
 	ErrIDInvalid privateError = "models: ID provided was invalid"
 
-	// ErrRememberTooShort is used to insure remember token is at least 32 bytes
+	// ErrRememberTooShort is used to insure session tokens are at least 32 bytes
 	ErrRememberTooShort privateError = "models: Remember token must be 32 bytes"
 
-	// ErrRememberHash is returned when a create or update
-	// is attempted without a valid user remember token hash.
+	// ErrRememberRequired is returned when a create or update
+	// is attempted without a valid session token hash.
 	ErrRememberRequired privateError = "models: Remember hash is required"
 
+	// ErrTOTPNotEnrolled is returned when a user without a TOTP
+	// secret is asked for a two-factor code
+	ErrTOTPNotEnrolled privateError = "models: two-factor authentication is not set up"
+
 	// ErrUserIDRequired is used to insure valid userID is connected to gallery
 	ErrUserIDRequired privateError = "models: userID is required"
 
+	// ErrGalleryIDRequired is used to insure valid galleryID is connected to an image
+	ErrGalleryIDRequired privateError = "models: galleryID is required"
+
 	// ErrServiceRequired is used to insure valid userID is connected to an oAuth
 	ErrServiceRequired privateError = "models: service is required"
 )
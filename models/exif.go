@@ -0,0 +1,146 @@
+package models
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+// ImageExif is the camera metadata read from an image when it is
+// uploaded. Every field is optional, most images from phones and
+// cameras only fill in some of them.
+type ImageExif struct {
+	CameraMake   string
+	CameraModel  string
+	LensModel    string
+	ExposureTime string // eg 1/250
+	FNumber      float64
+	ISO          int
+	FocalLength  float64 // millimeters
+	TakenAt      *time.Time
+	Latitude     *float64
+	Longitude    *float64
+}
+
+// Camera combines the make and model, skipping the make when the
+// model already starts with it (eg "Canon" + "Canon EOS R5").
+func (e ImageExif) Camera() string {
+	mk := strings.TrimSpace(e.CameraMake)
+	model := strings.TrimSpace(e.CameraModel)
+	if mk == "" || strings.HasPrefix(strings.ToLower(model), strings.ToLower(mk)) {
+		return model
+	}
+	return strings.TrimSpace(mk + " " + model)
+}
+
+// Exposure is a short summary like "1/250s f/2.8 ISO 100 35mm"
+func (e ImageExif) Exposure() string {
+	var parts []string
+	if e.ExposureTime != "" {
+		parts = append(parts, e.ExposureTime+"s")
+	}
+	if e.FNumber > 0 {
+		parts = append(parts, fmt.Sprintf("f/%g", e.FNumber))
+	}
+	if e.ISO > 0 {
+		parts = append(parts, fmt.Sprintf("ISO %d", e.ISO))
+	}
+	if e.FocalLength > 0 {
+		parts = append(parts, fmt.Sprintf("%gmm", e.FocalLength))
+	}
+	return strings.Join(parts, " ")
+}
+
+// HasLocation reports whether GPS coordinates were recorded
+func (e ImageExif) HasLocation() bool {
+	return e.Latitude != nil && e.Longitude != nil
+}
+
+// Location formats the GPS coordinates, eg "48.85837, 2.29448"
+func (e ImageExif) Location() string {
+	if !e.HasLocation() {
+		return ""
+	}
+	return fmt.Sprintf("%.5f, %.5f", *e.Latitude, *e.Longitude)
+}
+
+// MapURL links to the GPS coordinates on OpenStreetMap
+func (e ImageExif) MapURL() string {
+	if !e.HasLocation() {
+		return ""
+	}
+	return fmt.Sprintf("https://www.openstreetmap.org/?mlat=%f&mlon=%f#map=15/%f/%f",
+		*e.Latitude, *e.Longitude, *e.Latitude, *e.Longitude)
+}
+
+// IsEmpty reports whether no metadata at all was found
+func (e ImageExif) IsEmpty() bool {
+	return e == ImageExif{}
+}
+
+// readExif parses whatever EXIF metadata r has. Images without any
+// metadata return an empty ImageExif and no error.
+func readExif(r io.Reader) (ImageExif, error) {
+	var ret ImageExif
+	x, err := exif.Decode(r)
+	if err != nil {
+		if exif.IsCriticalError(err) {
+			// No EXIF segment, which is common for PNGs, GIFs and
+			// images that were exported for the web
+			return ret, nil
+		}
+		if x == nil {
+			return ret, err
+		}
+	}
+
+	ret.CameraMake = exifString(x, exif.Make)
+	ret.CameraModel = exifString(x, exif.Model)
+	ret.LensModel = exifString(x, exif.LensModel)
+	if tag, err := x.Get(exif.ExposureTime); err == nil {
+		if num, den, err := tag.Rat2(0); err == nil && num > 0 && den > 0 {
+			ret.ExposureTime = big.NewRat(num, den).RatString()
+		}
+	}
+	ret.FNumber = exifFloat(x, exif.FNumber)
+	ret.FocalLength = exifFloat(x, exif.FocalLength)
+	if tag, err := x.Get(exif.ISOSpeedRatings); err == nil {
+		ret.ISO, _ = tag.Int(0)
+	}
+	if t, err := x.DateTime(); err == nil && !t.IsZero() {
+		ret.TakenAt = &t
+	}
+	if lat, long, err := x.LatLong(); err == nil {
+		ret.Latitude = &lat
+		ret.Longitude = &long
+	}
+	return ret, nil
+}
+
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil || tag.Format() != tiff.StringVal {
+		return ""
+	}
+	s, _ := tag.StringVal()
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+func exifFloat(x *exif.Exif, name exif.FieldName) float64 {
+	tag, err := x.Get(name)
+	if err != nil {
+		return 0
+	}
+	num, den, err := tag.Rat2(0)
+	if err != nil || den == 0 {
+		return 0
+	}
+	f, _ := big.NewRat(num, den).Float64()
+	// Two decimal places is plenty for apertures and focal lengths
+	return float64(int64(f*100+0.5)) / 100
+}
@@ -1,21 +1,155 @@
 package models
 
-import "github.com/jinzhu/gorm"
+import (
+	"crypto/hmac"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/imattf/go-courses/gallery/hash"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Visibility levels for galleries
+const (
+	// VisibilityPrivate galleries and their images can only be seen
+	// by their owner
+	VisibilityPrivate = "private"
+
+	// VisibilityUnlisted galleries can be seen by anyone with the link,
+	// but ask search engines not to index them
+	VisibilityUnlisted = "unlisted"
+
+	// VisibilityPublic galleries can be seen by anyone
+	VisibilityPublic = "public"
+)
+
+const (
+	// More than maxGalleryPasswordFailures passwords tried on a
+	// gallery lock the client out of it for galleryLockout, so its
+	// password can't be guessed
+	maxGalleryPasswordFailures = 10
+	galleryLockout             = 15 * time.Minute
+)
+
+// Visibilities lists every visibility level with a label for forms
+var Visibilities = []struct {
+	Value string
+	Label string
+}{
+	{VisibilityPrivate, "Private - only you can see it"},
+	{VisibilityUnlisted, "Unlisted - anyone with the link can see it"},
+	{VisibilityPublic, "Public - anyone can see it"},
+}
 
 // Gallery is the image container for users
 type Gallery struct {
 	gorm.Model
-	UserID uint    `gorm:"not_null;index"`
-	Title  string  `gorm:"not_null"`
-	Images []Image `gorm:"-"`
+	UserID         uint   `gorm:"not_null;index"`
+	Title          string `gorm:"not_null"`
+	Visibility     string `gorm:"not_null;default:'private'"`
+	MetadataPolicy string `gorm:"not_null;default:'strip_location'"`
+	CoverImageID   uint
+	Images         []Image `gorm:"-"`
+
+	// Password, when set, is hashed into PasswordHash on create or
+	// update. Visitors need it to see the gallery, see VisibleTo.
+	Password     string `gorm:"-"`
+	PasswordHash string
+}
+
+// HasPassword reports whether the gallery is password protected
+func (g *Gallery) HasPassword() bool {
+	return g.PasswordHash != ""
+}
+
+// Unlockable reports whether visitors can see the gallery by entering
+// its password. Private galleries stay private whatever the password.
+func (g *Gallery) Unlockable() bool {
+	return g.HasPassword() && g.Visibility != VisibilityPrivate
+}
+
+// IsOwner reports whether user owns the gallery. user may be nil for
+// visitors who aren't logged in.
+func (g *Gallery) IsOwner(user *User) bool {
+	return user != nil && user.ID == g.UserID
+}
+
+// VisibleTo reports whether user may see the gallery and its images.
+// Password protected galleries are never visible to anyone but the
+// owner until they are unlocked, see GalleryService.UnlockToken.
+func (g *Gallery) VisibleTo(user *User) bool {
+	if g.IsOwner(user) {
+		return true
+	}
+	if g.HasPassword() {
+		return false
+	}
+	switch g.Visibility {
+	case VisibilityPublic, VisibilityUnlisted:
+		return true
+	}
+	return false
+}
+
+// CoverImage is the image chosen to represent the gallery, falling
+// back to the first image when none was chosen or it was deleted.
+// It is nil for galleries without images.
+func (g *Gallery) CoverImage() *Image {
+	i := g.coverIndex()
+	if i < 0 {
+		return nil
+	}
+	return &g.Images[i]
+}
+
+// IsCover reports whether img is the gallery's cover image
+func (g *Gallery) IsCover(img Image) bool {
+	cover := g.CoverImage()
+	return cover != nil && cover.ID == img.ID
+}
+
+func (g *Gallery) coverIndex() int {
+	if len(g.Images) == 0 {
+		return -1
+	}
+	for i := range g.Images {
+		if g.Images[i].ID == g.CoverImageID {
+			return i
+		}
+	}
+	return 0
+}
+
+// RedactMetadata removes the image metadata that the gallery's
+// policy doesn't allow to be shown to visitors.
+func (g *Gallery) RedactMetadata() {
+	for i := range g.Images {
+		g.Images[i].Exif = g.Images[i].Exif.Redacted(g.MetadataPolicy)
+	}
 }
 
+// ImagesSplitN splits the images into n columns for display. The
+// cover image comes first and the rest follow in their position
+// order, so reading across the columns follows that order.
 func (g *Gallery) ImagesSplitN(n int) [][]Image {
 	ret := make([][]Image, n)
 	for i := 0; i < n; i++ {
 		ret[i] = make([]Image, 0)
 	}
+	images := make([]Image, 0, len(g.Images))
+	cover := g.coverIndex()
+	if cover >= 0 {
+		images = append(images, g.Images[cover])
+	}
 	for i, img := range g.Images {
+		if i != cover {
+			images = append(images, img)
+		}
+	}
+	for i, img := range images {
 		// % is the remainder operator in Go
 		//  0%3 = 0
 		//  1%3 = 1
@@ -31,6 +165,21 @@ func (g *Gallery) ImagesSplitN(n int) [][]Image {
 
 type GalleryService interface {
 	GalleryDB
+
+	// CheckPassword returns ErrPasswordIncorrect unless password is
+	// the password of an Unlockable gallery, or ErrGalleryLocked after client, eg
+	// the visitor's IP address, tried too many. Other clients can
+	// still unlock the gallery.
+	CheckPassword(gallery *Gallery, client, password string) error
+
+	// UnlockToken returns a signed token proving the gallery's
+	// password was entered, which is valid until expires or the
+	// password is changed.
+	UnlockToken(gallery *Gallery, expires time.Time) string
+
+	// ValidUnlockToken reports whether token was returned by
+	// UnlockToken for the gallery and hasn't expired.
+	ValidUnlockToken(gallery *Gallery, token string) bool
 }
 
 type GalleryDB interface {
@@ -38,28 +187,125 @@ type GalleryDB interface {
 	ByUserID(userID uint) ([]Gallery, error)
 	Create(gallery *Gallery) error
 	Update(gallery *Gallery) error
+
+	// Delete soft deletes the gallery, it is only removed for good
+	// by Purge
 	Delete(id uint) error
+
+	// DeletedByID looks up a gallery that was soft deleted, and
+	// DeletedByUserID lists the user's deleted galleries, most
+	// recently deleted first
+	DeletedByID(id uint) (*Gallery, error)
+	DeletedByUserID(userID uint) ([]Gallery, error)
+
+	// DeletedBefore lists the galleries deleted before t
+	DeletedBefore(t time.Time) ([]Gallery, error)
+
+	// Restore undeletes a deleted gallery
+	Restore(id uint) error
+
+	// Purge permanently removes a deleted gallery along with its
+	// share links and members. The images are left to
+	// ImageService.PurgeGallery.
+	Purge(id uint) error
 }
 
-func NewGalleryService(db *gorm.DB) GalleryService {
+func NewGalleryService(db *gorm.DB, pepper, hmacKey string) GalleryService {
 	return &galleryService{
-		GalleryDB: &galleryValidator{&galleryGorm{db}},
+		GalleryDB: &galleryValidator{
+			GalleryDB: &galleryGorm{db},
+			pepper:    pepper,
+		},
+		unlockAttemptDB: &unlockAttemptGorm{db},
+		pepper:          pepper,
+		hmac:            hash.NewHMAC(hmacKey),
 	}
 }
 
 type galleryService struct {
 	GalleryDB
+	unlockAttemptDB unlockAttemptDB
+	pepper          string
+	hmac            hash.HMAC
+}
+
+func (gs *galleryService) CheckPassword(gallery *Gallery, client, password string) error {
+	if !gallery.Unlockable() {
+		return ErrPasswordIncorrect
+	}
+	// Every attempt is counted before the password is checked, the
+	// count is forgotten again if it was right. Attempts made while
+	// locked out count too, so a client that keeps guessing stays
+	// locked out.
+	client = gs.hmac.Hash(client)
+	now := time.Now()
+	attempt, err := gs.unlockAttemptDB.Count(gallery.ID, client, now)
+	if err != nil {
+		return err
+	}
+	if attempt.Locked(now) {
+		return ErrGalleryLocked
+	}
+	if attempt.Failures > maxGalleryPasswordFailures {
+		if err := gs.unlockAttemptDB.Lock(attempt, now.Add(galleryLockout)); err != nil {
+			return err
+		}
+		return ErrGalleryLocked
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(gallery.PasswordHash), []byte(password+gs.pepper))
+	switch err {
+	case nil:
+		return gs.unlockAttemptDB.Delete(gallery.ID, client)
+	case bcrypt.ErrMismatchedHashAndPassword:
+		return ErrPasswordIncorrect
+	default:
+		return err
+	}
+}
+
+// Unlock tokens are "<expires unix time>.<signature>". The signature
+// covers the password hash so changing the password locks everyone
+// out again.
+func (gs *galleryService) UnlockToken(gallery *Gallery, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + gs.unlockSignature(gallery, exp)
+}
+
+func (gs *galleryService) ValidUnlockToken(gallery *Gallery, token string) bool {
+	if !gallery.Unlockable() {
+		return false
+	}
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	exp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() >= exp {
+		return false
+	}
+	want := gs.unlockSignature(gallery, parts[0])
+	return hmac.Equal([]byte(parts[1]), []byte(want))
+}
+
+func (gs *galleryService) unlockSignature(gallery *Gallery, exp string) string {
+	return gs.hmac.Hash(fmt.Sprintf("gallery-unlock:%d:%s:%s", gallery.ID, exp, gallery.PasswordHash))
 }
 
 type galleryValidator struct {
 	GalleryDB
+	pepper string
 }
 
 // Create a gallery in the database
 func (gv *galleryValidator) Create(gallery *Gallery) error {
 	err := runGalleryValFuncs(gallery,
 		gv.userIDRequired,
-		gv.titleRequired)
+		gv.titleRequired,
+		gv.visibilityValid,
+		gv.metadataPolicyValid,
+		gv.passwordMinLength,
+		gv.bcryptPassword)
 	if err != nil {
 		return err
 	}
@@ -70,7 +316,11 @@ func (gv *galleryValidator) Create(gallery *Gallery) error {
 func (gv *galleryValidator) Update(gallery *Gallery) error {
 	err := runGalleryValFuncs(gallery,
 		gv.userIDRequired,
-		gv.titleRequired)
+		gv.titleRequired,
+		gv.visibilityValid,
+		gv.metadataPolicyValid,
+		gv.passwordMinLength,
+		gv.bcryptPassword)
 	if err != nil {
 		return err
 	}
@@ -85,6 +335,20 @@ func (gv *galleryValidator) Delete(id uint) error {
 	return gv.GalleryDB.Delete(id)
 }
 
+func (gv *galleryValidator) Restore(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return gv.GalleryDB.Restore(id)
+}
+
+func (gv *galleryValidator) Purge(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return gv.GalleryDB.Purge(id)
+}
+
 func (gv *galleryValidator) userIDRequired(g *Gallery) error {
 	if g.UserID <= 0 {
 		return ErrUserIDRequired
@@ -99,6 +363,58 @@ func (gv *galleryValidator) titleRequired(g *Gallery) error {
 	return nil
 }
 
+// visibilityValid defaults new galleries to private and makes sure
+// the visibility is one we know how to enforce.
+func (gv *galleryValidator) visibilityValid(g *Gallery) error {
+	switch g.Visibility {
+	case "":
+		g.Visibility = VisibilityPrivate
+	case VisibilityPrivate, VisibilityUnlisted, VisibilityPublic:
+	default:
+		return ErrVisibilityInvalid
+	}
+	return nil
+}
+
+func (gv *galleryValidator) passwordMinLength(g *Gallery) error {
+	if g.Password == "" {
+		return nil
+	}
+	if len(g.Password) < 8 {
+		return ErrPasswordTooShort
+	}
+	return nil
+}
+
+// bcryptPassword hashes the gallery password with the same pepper
+// used for user passwords, see userValidator.bcryptPassword.
+func (gv *galleryValidator) bcryptPassword(g *Gallery) error {
+	if g.Password == "" {
+		return nil
+	}
+	pwBytes := []byte(g.Password + gv.pepper)
+	hashedBytes, err := bcrypt.GenerateFromPassword(pwBytes, bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	g.PasswordHash = string(hashedBytes)
+	g.Password = ""
+	return nil
+}
+
+// metadataPolicyValid defaults the policy to stripping locations
+// and makes sure it is one we know how to apply.
+func (gv *galleryValidator) metadataPolicyValid(g *Gallery) error {
+	switch g.MetadataPolicy {
+	case "":
+		g.MetadataPolicy = MetadataStripLocation
+	case MetadataKeepAll, MetadataStripLocation, MetadataStripAll:
+	default:
+		return ErrMetadataPolicyInvalid
+	}
+	return nil
+}
+
 var _ GalleryDB = &galleryGorm{}
 
 type galleryGorm struct {
@@ -134,6 +450,60 @@ func (gg *galleryGorm) Delete(id uint) error {
 	return gg.db.Delete(&gallery).Error
 }
 
+func (gg *galleryGorm) DeletedByID(id uint) (*Gallery, error) {
+	var gallery Gallery
+	db := gg.db.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", id)
+	err := first(db, &gallery)
+	return &gallery, err
+}
+
+func (gg *galleryGorm) DeletedByUserID(userID uint) ([]Gallery, error) {
+	var galleries []Gallery
+	err := gg.db.Unscoped().
+		Where("user_id = ? AND deleted_at IS NOT NULL", userID).
+		Order("deleted_at desc").
+		Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+func (gg *galleryGorm) DeletedBefore(t time.Time) ([]Gallery, error) {
+	var galleries []Gallery
+	err := gg.db.Unscoped().
+		Where("deleted_at IS NOT NULL AND deleted_at < ?", t).
+		Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+func (gg *galleryGorm) Restore(id uint) error {
+	return gg.db.Unscoped().Model(&Gallery{}).
+		Where("id = ?", id).
+		UpdateColumn("deleted_at", gorm.Expr("NULL")).Error
+}
+
+func (gg *galleryGorm) Purge(id uint) error {
+	tx := gg.db.Begin()
+	for _, value := range []interface{}{&ShareLink{}, &GalleryMember{}, &unlockAttempt{}} {
+		err := tx.Unscoped().Where("gallery_id = ?", id).Delete(value).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	gallery := Gallery{Model: gorm.Model{ID: id}}
+	err := tx.Unscoped().Delete(&gallery).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
 type galleryValFunc func(*Gallery) error
 
 func runGalleryValFuncs(gallery *Gallery, fns ...galleryValFunc) error {
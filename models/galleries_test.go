@@ -0,0 +1,101 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/imattf/go-courses/gallery/hash"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type galleryMemory struct {
+	GalleryDB
+	galleries map[uint]*Gallery
+	updates   int
+}
+
+func (m *galleryMemory) ByID(id uint) (*Gallery, error) {
+	gallery, ok := m.galleries[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return gallery, nil
+}
+
+func (m *galleryMemory) Update(gallery *Gallery) error {
+	m.updates++
+	return nil
+}
+
+// unlockAttemptMemory is an unlockAttemptDB that keeps the attempts
+// in memory
+type unlockAttemptMemory map[string]*unlockAttempt
+
+func (m unlockAttemptMemory) Count(galleryID uint, client string, now time.Time) (*unlockAttempt, error) {
+	key := fmt.Sprint(galleryID, client)
+	attempt, ok := m[key]
+	if !ok || attempt.UpdatedAt.Before(now.Add(-galleryLockout)) {
+		attempt = &unlockAttempt{GalleryID: galleryID, Client: client}
+		m[key] = attempt
+	}
+	attempt.Failures++
+	attempt.UpdatedAt = now
+	counted := *attempt
+	return &counted, nil
+}
+
+func (m unlockAttemptMemory) Lock(attempt *unlockAttempt, until time.Time) error {
+	stored := m[fmt.Sprint(attempt.GalleryID, attempt.Client)]
+	stored.Failures = 0
+	stored.LockedUntil = &until
+	return nil
+}
+
+func (m unlockAttemptMemory) Delete(galleryID uint, client string) error {
+	delete(m, fmt.Sprint(galleryID, client))
+	return nil
+}
+
+func TestCheckPasswordLockout(t *testing.T) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte("password1"+"pepper"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &galleryMemory{}
+	attempts := unlockAttemptMemory{}
+	gs := &galleryService{GalleryDB: m, unlockAttemptDB: attempts, pepper: "pepper", hmac: hash.NewHMAC("secret")}
+	gallery := &Gallery{Visibility: VisibilityUnlisted, PasswordHash: string(hashed)}
+	gallery.ID = 1
+
+	for n := 0; n < maxGalleryPasswordFailures; n++ {
+		if err := gs.CheckPassword(gallery, "10.0.0.1", "wrong"); err != ErrPasswordIncorrect {
+			t.Fatalf("Expected ErrPasswordIncorrect. Recieved %v", err)
+		}
+	}
+	if err := gs.CheckPassword(gallery, "10.0.0.1", "password1"); err != ErrGalleryLocked {
+		t.Errorf("Expected ErrGalleryLocked. Recieved %v", err)
+	}
+	if err := gs.CheckPassword(gallery, "10.0.0.2", "password1"); err != nil {
+		t.Errorf("Expected other clients to still get in. Recieved %v", err)
+	}
+	if m.updates != 0 {
+		t.Errorf("Expected the gallery not to be saved. Recieved %d updates", m.updates)
+	}
+
+	past := time.Now().Add(-time.Minute)
+	for _, attempt := range attempts {
+		attempt.LockedUntil = &past
+	}
+	if err := gs.CheckPassword(gallery, "10.0.0.1", "password1"); err != nil {
+		t.Errorf("Expected the password to work once the lock is over. Recieved %v", err)
+	}
+	if len(attempts) != 0 {
+		t.Errorf("Expected the attempts to be forgotten. Recieved %v", attempts)
+	}
+
+	private := &Gallery{Visibility: VisibilityPrivate, PasswordHash: string(hashed)}
+	if err := gs.CheckPassword(private, "10.0.0.1", "password1"); err != ErrPasswordIncorrect {
+		t.Errorf("Expected private galleries not to unlock. Recieved %v", err)
+	}
+}
@@ -0,0 +1,390 @@
+package models
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/imattf/go-courses/gallery/hash"
+	"github.com/imattf/go-courses/gallery/rand"
+	"github.com/jinzhu/gorm"
+)
+
+// Roles people can have on a gallery. RoleOwner is only ever given to
+// the user who created the gallery, members get one of the others.
+const (
+	// RoleViewer can see the gallery whatever its visibility
+	RoleViewer = "viewer"
+
+	// RoleContributor can also add images
+	RoleContributor = "contributor"
+
+	// RoleEditor can also rename the gallery and edit, reorder and
+	// delete its images
+	RoleEditor = "editor"
+
+	// RoleOwner can do anything, including deleting the gallery and
+	// deciding who else can see it
+	RoleOwner = "owner"
+)
+
+// MemberRoles lists the roles members can be given, with a label
+// for forms
+var MemberRoles = []struct {
+	Value string
+	Label string
+}{
+	{RoleViewer, "Viewer - can see the gallery"},
+	{RoleContributor, "Contributor - can also add images"},
+	{RoleEditor, "Editor - can also rename the gallery and edit or delete images"},
+}
+
+// GalleryAction is something done to a gallery that needs permission
+type GalleryAction int
+
+const (
+	// ActionView is seeing the gallery and its images
+	ActionView GalleryAction = iota
+
+	// ActionUpload is adding images
+	ActionUpload
+
+	// ActionEdit is renaming the gallery and editing, reordering and
+	// deleting images
+	ActionEdit
+
+	// ActionManage is changing who can see the gallery, ie its
+	// visibility, password, share links and members, and downloading
+	// originals with all their metadata
+	ActionManage
+
+	// ActionDelete is deleting the gallery
+	ActionDelete
+)
+
+// roleActions is the most a role may do, every action up to and
+// including it is allowed
+var roleActions = map[string]GalleryAction{
+	RoleViewer:      ActionView,
+	RoleContributor: ActionUpload,
+	RoleEditor:      ActionEdit,
+	RoleOwner:       ActionDelete,
+}
+
+// RoleAllows reports whether someone with role may take action.
+// An empty role, ie no role at all, allows nothing.
+func RoleAllows(role string, action GalleryAction) bool {
+	max, ok := roleActions[role]
+	return ok && action <= max
+}
+
+// GalleryMember gives someone a role on a gallery. Members are
+// invited by email and UserID is only set once they accept, see
+// GalleryMemberService.Accept.
+type GalleryMember struct {
+	gorm.Model
+	GalleryID uint   `gorm:"not_null;unique_index:idx_gallery_members_email"`
+	Email     string `gorm:"not_null;unique_index:idx_gallery_members_email"`
+	UserID    uint   `gorm:"index"`
+	Role      string `gorm:"not_null"`
+
+	InviteToken     string `gorm:"-"`
+	InviteTokenHash string `gorm:"index"`
+	AcceptedAt      *time.Time
+}
+
+// Accepted reports whether the invitation was accepted
+func (m *GalleryMember) Accepted() bool {
+	return m.AcceptedAt != nil
+}
+
+// GalleryMemberDB is used for interacting with the gallery members
+// database.
+type GalleryMemberDB interface {
+	ByID(id uint) (*GalleryMember, error)
+	ByGalleryID(galleryID uint) ([]GalleryMember, error)
+	ByEmail(galleryID uint, email string) (*GalleryMember, error)
+	ByInviteToken(token string) (*GalleryMember, error)
+
+	// ByUserID lists the accepted memberships of a user
+	ByUserID(userID uint) ([]GalleryMember, error)
+
+	Create(member *GalleryMember) error
+	Update(member *GalleryMember) error
+	Delete(id uint) error
+}
+
+// GalleryMemberService manages who else has access to galleries.
+type GalleryMemberService interface {
+	GalleryMemberDB
+
+	// Role returns the role an accepted member has on the gallery,
+	// or an empty string for users who aren't members.
+	Role(galleryID, userID uint) (string, error)
+
+	// Invite creates the membership and sets the InviteToken to email
+	// to the invitee. Inviting an email address twice returns
+	// ErrMemberExists.
+	Invite(member *GalleryMember) error
+
+	// Accept binds the invitation with token to user. The invitation
+	// must have been sent to the user's email address, otherwise
+	// ErrInviteInvalid is returned.
+	Accept(token string, user *User) (*GalleryMember, error)
+}
+
+func NewGalleryMemberService(db *gorm.DB, hmacKey string) GalleryMemberService {
+	return &galleryMemberService{
+		GalleryMemberDB: &galleryMemberValidator{
+			GalleryMemberDB: &galleryMemberGorm{db},
+			hmac:            hash.NewHMAC(hmacKey),
+			emailRegex:      regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
+		},
+	}
+}
+
+// Compiler check to make sure galleryMemberService implements GalleryMemberService
+var _ GalleryMemberService = &galleryMemberService{}
+
+type galleryMemberService struct {
+	GalleryMemberDB
+}
+
+func (gms *galleryMemberService) Role(galleryID, userID uint) (string, error) {
+	if userID == 0 {
+		return "", nil
+	}
+	members, err := gms.ByUserID(userID)
+	if err != nil {
+		return "", err
+	}
+	for _, m := range members {
+		if m.GalleryID == galleryID {
+			return m.Role, nil
+		}
+	}
+	return "", nil
+}
+
+func (gms *galleryMemberService) Invite(member *GalleryMember) error {
+	member.AcceptedAt = nil
+	member.UserID = 0
+	member.InviteToken = ""
+	return gms.Create(member)
+}
+
+func (gms *galleryMemberService) Accept(token string, user *User) (*GalleryMember, error) {
+	member, err := gms.ByInviteToken(token)
+	if err == ErrNotFound {
+		return nil, ErrInviteInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(member.Email, user.Email) {
+		return nil, ErrInviteInvalid
+	}
+	now := time.Now()
+	member.UserID = user.ID
+	member.AcceptedAt = &now
+	member.InviteTokenHash = ""
+	if err := gms.Update(member); err != nil {
+		return nil, err
+	}
+	return member, nil
+}
+
+type galleryMemberValidator struct {
+	GalleryMemberDB
+	hmac       hash.HMAC
+	emailRegex *regexp.Regexp
+}
+
+func (gmv *galleryMemberValidator) ByEmail(galleryID uint, email string) (*GalleryMember, error) {
+	member := GalleryMember{Email: email}
+	if err := gmv.normalizeEmail(&member); err != nil {
+		return nil, err
+	}
+	return gmv.GalleryMemberDB.ByEmail(galleryID, member.Email)
+}
+
+func (gmv *galleryMemberValidator) ByInviteToken(token string) (*GalleryMember, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	return gmv.GalleryMemberDB.ByInviteToken(gmv.hmac.Hash(token))
+}
+
+func (gmv *galleryMemberValidator) Create(member *GalleryMember) error {
+	err := runGalleryMemberValFuncs(member,
+		gmv.galleryIDRequired,
+		gmv.normalizeEmail,
+		gmv.requireEmail,
+		gmv.emailFormat,
+		gmv.emailNotMember(member.GalleryID),
+		gmv.roleValid,
+		gmv.setTokenIfUnset,
+		gmv.hmacToken)
+	if err != nil {
+		return err
+	}
+	return gmv.GalleryMemberDB.Create(member)
+}
+
+func (gmv *galleryMemberValidator) Update(member *GalleryMember) error {
+	err := runGalleryMemberValFuncs(member,
+		gmv.galleryIDRequired,
+		gmv.normalizeEmail,
+		gmv.requireEmail,
+		gmv.roleValid)
+	if err != nil {
+		return err
+	}
+	return gmv.GalleryMemberDB.Update(member)
+}
+
+func (gmv *galleryMemberValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return gmv.GalleryMemberDB.Delete(id)
+}
+
+func (gmv *galleryMemberValidator) galleryIDRequired(m *GalleryMember) error {
+	if m.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return nil
+}
+
+func (gmv *galleryMemberValidator) normalizeEmail(m *GalleryMember) error {
+	m.Email = strings.ToLower(strings.TrimSpace(m.Email))
+	return nil
+}
+
+func (gmv *galleryMemberValidator) requireEmail(m *GalleryMember) error {
+	if m.Email == "" {
+		return ErrEmailRequired
+	}
+	return nil
+}
+
+func (gmv *galleryMemberValidator) emailFormat(m *GalleryMember) error {
+	if !gmv.emailRegex.MatchString(m.Email) {
+		return ErrEmailInvalid
+	}
+	return nil
+}
+
+func (gmv *galleryMemberValidator) emailNotMember(galleryID uint) galleryMemberValFunc {
+	return func(m *GalleryMember) error {
+		_, err := gmv.GalleryMemberDB.ByEmail(galleryID, m.Email)
+		if err == ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return ErrMemberExists
+	}
+}
+
+func (gmv *galleryMemberValidator) roleValid(m *GalleryMember) error {
+	switch m.Role {
+	case RoleViewer, RoleContributor, RoleEditor:
+		return nil
+	}
+	return ErrRoleInvalid
+}
+
+func (gmv *galleryMemberValidator) setTokenIfUnset(m *GalleryMember) error {
+	if m.InviteToken != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	m.InviteToken = token
+	return nil
+}
+
+func (gmv *galleryMemberValidator) hmacToken(m *GalleryMember) error {
+	if m.InviteToken == "" {
+		return nil
+	}
+	m.InviteTokenHash = gmv.hmac.Hash(m.InviteToken)
+	return nil
+}
+
+var _ GalleryMemberDB = &galleryMemberGorm{}
+
+type galleryMemberGorm struct {
+	db *gorm.DB
+}
+
+func (gmg *galleryMemberGorm) ByID(id uint) (*GalleryMember, error) {
+	var member GalleryMember
+	err := first(gmg.db.Where("id = ?", id), &member)
+	return &member, err
+}
+
+func (gmg *galleryMemberGorm) ByGalleryID(galleryID uint) ([]GalleryMember, error) {
+	var members []GalleryMember
+	err := gmg.db.Where("gallery_id = ?", galleryID).Order("email asc").Find(&members).Error
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+func (gmg *galleryMemberGorm) ByEmail(galleryID uint, email string) (*GalleryMember, error) {
+	var member GalleryMember
+	db := gmg.db.Where("gallery_id = ? AND email = ?", galleryID, email)
+	err := first(db, &member)
+	return &member, err
+}
+
+func (gmg *galleryMemberGorm) ByInviteToken(tokenHash string) (*GalleryMember, error) {
+	var member GalleryMember
+	err := first(gmg.db.Where("invite_token_hash = ?", tokenHash), &member)
+	if err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+func (gmg *galleryMemberGorm) ByUserID(userID uint) ([]GalleryMember, error) {
+	var members []GalleryMember
+	err := gmg.db.Where("user_id = ? AND accepted_at IS NOT NULL", userID).Find(&members).Error
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+func (gmg *galleryMemberGorm) Create(member *GalleryMember) error {
+	return gmg.db.Create(member).Error
+}
+
+func (gmg *galleryMemberGorm) Update(member *GalleryMember) error {
+	return gmg.db.Save(member).Error
+}
+
+// Delete removes the row for good rather than soft deleting it, so
+// the same email address can be invited to the gallery again.
+func (gmg *galleryMemberGorm) Delete(id uint) error {
+	member := GalleryMember{Model: gorm.Model{ID: id}}
+	return gmg.db.Unscoped().Delete(&member).Error
+}
+
+type galleryMemberValFunc func(*GalleryMember) error
+
+func runGalleryMemberValFuncs(member *GalleryMember, fns ...galleryMemberValFunc) error {
+	for _, fn := range fns {
+		if err := fn(member); err != nil {
+			return err
+		}
+	}
+	return nil
+}
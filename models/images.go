@@ -1,18 +1,120 @@
 package models
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
-	"os"
-	"path/filepath"
+	"path"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/disintegration/imaging"
+	"github.com/imattf/go-courses/gallery/storage"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
 )
 
-// Image is not stored in the database
+const (
+	// MaxImageSize is the largest single image file we accept
+	MaxImageSize = 20 << 20 // 20 megabytes
+
+	// MaxImagePixels is the most pixels an image we accept can have,
+	// since it is decoded in full to make the renditions
+	MaxImagePixels = 50000000 // 50 megapixels
+
+	// MaxUploadSize is the most we accept in a single upload request
+	MaxUploadSize = 100 << 20 // 100 megabytes
+
+	// MaxArchiveSize is the largest ZIP archive of images we accept
+	MaxArchiveSize = 1 << 30 // 1 gigabyte
+
+	maxFilenameLength = 255
+
+	maxImageTitleLength = 200
+	maxAltTextLength    = 500
+	maxCaptionLength    = 2000
+
+	// maxFilenameClaims is how many times Create tries the next free
+	// filename when another upload claimed it first
+	maxFilenameClaims = 5
+
+	// imageFilenameIndex and imageSHA256Index are the unique indexes
+	// that stop two images in a gallery from having the same filename
+	// or the same file, see AutoMigrate
+	imageFilenameIndex = "uix_images_gallery_id_filename"
+	imageSHA256Index   = "uix_images_gallery_id_sha256"
+)
+
+// imageContentTypes are the sniffed content types uploads may have
+var imageContentTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// imageExtensions are the extensions images are stored with for each
+// of the imageContentTypes, whatever they were uploaded as
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// imageUploadExtensions are the extensions uploads may be named with
+var imageUploadExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".webp": true,
+}
+
+// Image is stored in the database, while the file itself lives
+// in a BlobStore under the key returned by Key.
 type Image struct {
-	GalleryID uint
-	Filename  string
+	gorm.Model
+	GalleryID   uint   `gorm:"not_null;index"`
+	UserID      uint   `gorm:"not_null"`
+	Filename    string `gorm:"not_null"`
+	ContentType string
+	Size        int64
+
+	// SHA256 is the hex encoded hash of the original file, used to
+	// spot images uploaded to the same gallery twice. Images uploaded
+	// before it was added have none.
+	SHA256 string `gorm:"index"`
+
+	// PHash is the perceptual hash of the image, used to find images
+	// that look alike. It is filled in along with the renditions.
+	PHash string `gorm:"size:16"`
+
+	// Title, AltText and Caption are written by the owner. AltText
+	// describes the image for screen readers and when it fails to load.
+	Title   string
+	AltText string
+	Caption string `gorm:"type:text"`
+
+	// Position orders images within their gallery, lowest first.
+	// New images are added at the end.
+	Position int `gorm:"not_null;default:0"`
+
+	// Dimensions of the original, filled in when the renditions
+	// are generated
+	Width         int
+	Height        int
+	HasRenditions bool
+
+	Exif ImageExif `gorm:"embedded;embedded_prefix:exif_"`
 }
 
 func (i *Image) Path() string {
@@ -22,75 +124,911 @@ func (i *Image) Path() string {
 	return temp.String()
 }
 
+// Alt is the text for the alt attribute of the image, falling back
+// to the title and then the caption when no alt text was written.
+func (i *Image) Alt() string {
+	switch {
+	case i.AltText != "":
+		return i.AltText
+	case i.Title != "":
+		return i.Title
+	}
+	return i.Caption
+}
+
+// DisplayTitle is the title, or the filename for untitled images
+func (i *Image) DisplayTitle() string {
+	if i.Title != "" {
+		return i.Title
+	}
+	return i.Filename
+}
+
+// DetailPath is the URL of the page showing this image and its metadata
+func (i *Image) DetailPath() string {
+	temp := url.URL{
+		Path: fmt.Sprintf("/galleries/%v/images/%v", i.GalleryID, i.Filename),
+	}
+	return temp.String()
+}
+
 func (i *Image) RelativePath() string {
-	return fmt.Sprintf("images/galleries/%v/%v", i.GalleryID, i.Filename)
+	return "images/" + i.Key()
+}
+
+// Key is where the publicly served copy of the image is kept in the
+// BlobStore. Depending on the gallery's metadata policy this copy may
+// have had EXIF data removed.
+func (i *Image) Key() string {
+	return fmt.Sprintf("galleries/%v/%v", i.GalleryID, i.Filename)
+}
+
+// OriginalKey is where the untouched upload is kept. It is never
+// served publicly, only to the gallery owner.
+func (i *Image) OriginalKey() string {
+	return fmt.Sprintf("originals/%v/%v", i.GalleryID, i.Filename)
+}
+
+// PublicKeyGalleryID returns the ID of the gallery a publicly served
+// key, ie one returned by Key or a rendition key, belongs to. ok is
+// false for any other key, including original keys.
+func PublicKeyGalleryID(key string) (id uint, ok bool) {
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) != 3 || parts[2] == "" {
+		return 0, false
+	}
+	switch parts[0] {
+	case "galleries", "renditions":
+	default:
+		return 0, false
+	}
+	n, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil || n == 0 {
+		return 0, false
+	}
+	return uint(n), true
 }
 
+// OriginalPath is the URL the owner can download the original from
+func (i *Image) OriginalPath() string {
+	return i.DetailPath() + "/original"
+}
+
+// ImageDB is used for interacting with the images database.
+type ImageDB interface {
+	ByID(id uint) (*Image, error)
+	ByGalleryID(galleryID uint) ([]Image, error)
+	ByGalleryIDs(galleryIDs []uint) ([]Image, error)
+	ByFilename(galleryID uint, filename string) (*Image, error)
+
+	// BySHA256 looks up an image in the gallery by the hash of its
+	// original file
+	BySHA256(galleryID uint, hash string) (*Image, error)
+
+	Create(image *Image) error
+	Update(image *Image) error
+	Delete(id uint) error
+
+	// DeleteByGalleryID soft deletes every image in the gallery, and
+	// PurgeByGalleryID removes them for good, deleted or not
+	DeleteByGalleryID(galleryID uint) error
+	PurgeByGalleryID(galleryID uint) error
+
+	// DeletedByID looks up an image that was soft deleted
+	DeletedByID(id uint) (*Image, error)
+
+	// DeletedByGalleryIDs lists the deleted images of the galleries,
+	// most recently deleted first
+	DeletedByGalleryIDs(galleryIDs []uint) ([]Image, error)
+
+	// DeletedBefore lists the images deleted before t
+	DeletedBefore(t time.Time) ([]Image, error)
+
+	// Restore undeletes the image, saving its filename and position
+	Restore(image *Image) error
+
+	// RestoreByGalleryID undeletes the images of the gallery deleted
+	// at or after since
+	RestoreByGalleryID(galleryID uint, since time.Time) error
+
+	// Purge permanently removes a deleted image
+	Purge(id uint) error
+
+	// Reorder sets the position of every image in the gallery to
+	// its index in imageIDs.
+	Reorder(galleryID uint, imageIDs []uint) error
+}
+
+// ImageService is used to store image files along with their
+// database records.
 type ImageService interface {
-	Create(galleryID uint, r io.ReadCloser, filename string) error
+	// Create will write the contents of r to the blob store and then store
+	// the image record. GalleryID, UserID and Filename must be
+	// set on the image, the remaining metadata is backfilled.
+	// If the filename is already used in the gallery the image
+	// is renamed, eg beach.jpg becomes beach-1.jpg.
+	//
+	// Files that are not JPEG, PNG, GIF or WebP images are rejected
+	// with ErrImageInvalid, files over MaxImageSize with
+	// ErrImageTooLarge and images over MaxImagePixels with
+	// ErrImageTooManyPixels. Files identical to an image already in the
+	// gallery are skipped with ErrImageDuplicate.
+	Create(image *Image, r io.ReadCloser) error
+
+	// Delete soft deletes the image record and moves its files to
+	// the trash, from where Restore can bring it back until Purge is
+	// called.
+	Delete(image *Image) error
+
+	// Restore brings a deleted image and its files back from the
+	// trash, at the end of its gallery. If its filename was taken in
+	// the meantime it is renamed, like in Create. If the same file
+	// was uploaded again it fails with ErrImageDuplicate.
+	Restore(image *Image) error
+
+	// Purge removes a deleted image and its files for good
+	Purge(image *Image) error
+
+	// RestoreGallery restores the images deleted along with a gallery,
+	// ie those deleted at or after since. Images deleted on their own
+	// before that stay in the trash.
+	RestoreGallery(galleryID uint, since time.Time) error
+
+	// PurgeDeleted removes every image deleted before t for good and
+	// returns how many there were.
+	PurgeDeleted(t time.Time) (int, error)
+
+	// DeleteGallery deletes the records of every image in a gallery
+	// that is being deleted. The files are kept, but no longer
+	// served, until PurgeGallery is called.
+	DeleteGallery(galleryID uint) error
+
+	// PurgeGallery removes every file stored for the gallery, ie its
+	// originals, published copies and renditions, along with the
+	// image records.
+	PurgeGallery(galleryID uint) error
+
+	// Original opens the untouched file as it was uploaded
+	Original(image *Image) (io.ReadCloser, error)
+
+	// Published opens the publicly served copy, ie the file visitors
+	// see with metadata removed according to the gallery's policy
+	Published(image *Image) (io.ReadCloser, error)
+
+	// Republish rewrites the publicly served copy of every image in
+	// the gallery, eg after its metadata policy changed.
+	Republish(gallery *Gallery) error
+
+	// Similar returns the groups of images in the gallery that look
+	// alike, see SimilarGroups. Images uploaded before perceptual
+	// hashes were added are hashed first.
+	Similar(galleryID uint) ([][]Image, error)
+
+	// ImportStored creates the images for files published to a
+	// gallery before images were kept in the database, and returns
+	// how many there were. Files that already have an image are
+	// skipped, so it is safe to run on every start.
+	ImportStored() (int, error)
+
+	ByID(id uint) (*Image, error)
 	ByGalleryID(galleryID uint) ([]Image, error)
-	Delete(i *Image) error
+	ByGalleryIDs(galleryIDs []uint) ([]Image, error)
+	ByFilename(galleryID uint, filename string) (*Image, error)
+	BySHA256(galleryID uint, hash string) (*Image, error)
+	DeletedByID(id uint) (*Image, error)
+	DeletedByGalleryIDs(galleryIDs []uint) ([]Image, error)
+	Update(image *Image) error
+	Reorder(galleryID uint, imageIDs []uint) error
 }
 
-func NewImageService() ImageService {
-	return &imageService{}
+func NewImageService(db *gorm.DB, store storage.BlobStore) ImageService {
+	return &imageService{
+		ImageDB:   &imageValidator{&imageGorm{db}},
+		galleryDB: &galleryGorm{db},
+		store:     store,
+	}
 }
 
-type imageService struct{}
+// Compiler check to make sure imageService implements ImageService
+var _ ImageService = &imageService{}
 
-func (is *imageService) Create(galleryID uint, r io.ReadCloser, filename string) error {
+type imageService struct {
+	ImageDB
+	galleryDB GalleryDB
+	store     storage.BlobStore
+}
+
+func (is *imageService) Create(image *Image, r io.ReadCloser) error {
 	defer r.Close()
-	path, err := is.mkImagePath(galleryID)
+
+	err := runImageValFuncs(image, filenameSafe)
+	if err != nil {
+		return err
+	}
+	gallery, err := is.galleryDB.ByID(image.GalleryID)
 	if err != nil {
 		return err
 	}
 
-	// Create a destination file
-	dst, err := os.Create(path + filename)
+	// Sniff the content type before copying reader data to the
+	// blob store, since it decides the extension of the filename
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(512)
+	image.ContentType = http.DetectContentType(head)
+	err = runImageValFuncs(image, canonicalExtension)
+	if err != nil {
+		return err
+	}
+	// The dimensions are checked from the header before anything is
+	// stored or decoded, keeping back what was read for the copy
+	var header bytes.Buffer
+	err = checkPixels(io.TeeReader(io.LimitReader(br, MaxImageSize), &header))
 	if err != nil {
 		return err
 	}
-	defer dst.Close()
+	src := io.MultiReader(&header, br)
+	image.Position, err = is.nextPosition(image.GalleryID)
+	if err != nil {
+		return err
+	}
+	// The image is saved before its files are stored to claim the
+	// filename, and updated once they are
+	err = is.claimFilename(image, is.ImageDB.Create)
+	if err != nil {
+		return err
+	}
+
+	// Hash the file as it is copied, rather than reading it twice
+	hash := sha256.New()
+	cr := &countingReader{r: io.TeeReader(src, hash), max: MaxImageSize}
+	err = is.store.Put(image.OriginalKey(), image.ContentType, cr)
+	if err != nil {
+		is.discard(image)
+		return err
+	}
+	image.Size = cr.n
+	image.SHA256 = hex.EncodeToString(hash.Sum(nil))
 
-	// Copy reader data to the destination file
-	_, err = io.Copy(dst, r)
+	_, err = is.ImageDB.BySHA256(image.GalleryID, image.SHA256)
+	if err == nil {
+		is.discard(image)
+		return ErrImageDuplicate
+	}
+	if err != ErrNotFound {
+		is.discard(image)
+		return err
+	}
+
+	err = is.loadExif(image)
+	if err != nil {
+		is.discard(image)
+		return err
+	}
+	err = is.storeRenditions(image)
+	if err != nil {
+		is.discard(image)
+		return err
+	}
+	err = is.publish(image, gallery.MetadataPolicy)
+	if err != nil {
+		is.discard(image)
+		return err
+	}
+
+	// Catches the same file uploaded twice at the same time, which
+	// BySHA256 can't see
+	err = is.ImageDB.Update(image)
+	if isUniqueViolation(err, imageSHA256Index) {
+		is.discard(image)
+		return ErrImageDuplicate
+	}
 	if err != nil {
+		is.discard(image)
 		return err
 	}
 	return nil
 }
 
+// discard removes an image that failed to be created, along with
+// whichever of its files were already stored
+func (is *imageService) discard(i *Image) {
+	is.deleteFiles(i)
+	is.ImageDB.Purge(i.ID)
+}
+
 func (is *imageService) Delete(i *Image) error {
-	return os.Remove(i.RelativePath())
+	err := is.ImageDB.Delete(i.ID)
+	if err != nil {
+		return err
+	}
+	for _, key := range i.fileKeys() {
+		if err := is.moveFile(key, trashKey(i, key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (is *imageService) DeleteGallery(galleryID uint) error {
+	return is.ImageDB.DeleteByGalleryID(galleryID)
+}
+
+func (is *imageService) PurgeGallery(galleryID uint) error {
+	// Listing the keys rather than going through the image records
+	// also catches files left behind by failed uploads
+	for _, prefix := range galleryKeyPrefixes(galleryID) {
+		keys, err := is.store.List(prefix)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := is.store.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+	return is.ImageDB.PurgeByGalleryID(galleryID)
+}
+
+// galleryKeyPrefixes are the BlobStore prefixes every file of the
+// gallery is kept under, see Key, OriginalKey, renditionKey and
+// trashKey
+func galleryKeyPrefixes(galleryID uint) []string {
+	return []string{
+		fmt.Sprintf("galleries/%v/", galleryID),
+		fmt.Sprintf("originals/%v/", galleryID),
+		fmt.Sprintf("renditions/%v/", galleryID),
+		galleryTrashPrefix(galleryID),
+	}
+}
+
+func (is *imageService) Original(i *Image) (io.ReadCloser, error) {
+	rc, err := is.store.Get(i.OriginalKey())
+	if err == storage.ErrNotFound {
+		// Images uploaded before originals were kept separately only
+		// have the served copy, which is the original
+		return is.store.Get(i.Key())
+	}
+	return rc, err
 }
 
-// func (is *imageService) ByGalleryID(galleryID uint) ([]string, error) {
-func (is *imageService) ByGalleryID(galleryID uint) ([]Image, error) {
-	path := is.imagePath(galleryID)
-	imgStrings, err := filepath.Glob(path + "*")
+func (is *imageService) Published(i *Image) (io.ReadCloser, error) {
+	return is.store.Get(i.Key())
+}
+
+func (is *imageService) Similar(galleryID uint) ([][]Image, error) {
+	images, err := is.ImageDB.ByGalleryID(galleryID)
 	if err != nil {
 		return nil, err
 	}
-	ret := make([]Image, len(imgStrings))
-	for i := range imgStrings {
-		imgStrings[i] = strings.Replace(imgStrings[i], path, "", 1)
-		ret[i] = Image{
-			Filename:  imgStrings[i],
-			GalleryID: galleryID,
+	for i := range images {
+		if images[i].PHash != "" {
+			continue
+		}
+		if err := is.hashImage(&images[i]); err != nil {
+			// Leave images that can't be read out, rather than
+			// failing the whole gallery
+			continue
+		}
+		if err := is.ImageDB.Update(&images[i]); err != nil {
+			return nil, err
 		}
 	}
-	return ret, nil
+	return SimilarGroups(images), nil
 }
 
-func (is *imageService) imagePath(galleryID uint) string {
-	return fmt.Sprintf("images/galleries/%v/", galleryID)
+// hashImage sets the perceptual hash of an existing image
+func (is *imageService) hashImage(i *Image) error {
+	rc, err := is.Original(i)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	src, err := imaging.Decode(rc, imaging.AutoOrientation(true))
+	if err != nil {
+		return ErrImageInvalid
+	}
+	i.PHash = perceptualHash(src)
+	return nil
 }
 
-func (is *imageService) mkImagePath(galleryID uint) (string, error) {
-	galleryPath := is.imagePath(galleryID)
-	err := os.MkdirAll(galleryPath, 0755)
+func (is *imageService) Republish(gallery *Gallery) error {
+	images, err := is.ImageDB.ByGalleryID(gallery.ID)
 	if err != nil {
-		return "", err
+		return err
 	}
-	return galleryPath, nil
+	for i := range images {
+		if err := is.publish(&images[i], gallery.MetadataPolicy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publish writes the publicly served copy of the image, with metadata
+// removed according to policy.
+func (is *imageService) publish(i *Image, policy string) error {
+	rc, err := is.Original(i)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	if _, err := is.store.Stat(i.OriginalKey()); err == storage.ErrNotFound {
+		err = is.store.Put(i.OriginalKey(), i.ContentType, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+	}
+	data, err = stripMetadata(data, i.ContentType, policy)
+	if err != nil {
+		return err
+	}
+	return is.store.Put(i.Key(), i.ContentType, bytes.NewReader(data))
+}
+
+// availableFilename returns filename if it is not used in the gallery
+// yet, or otherwise the first free name with a numeric suffix.
+func (is *imageService) availableFilename(galleryID uint, filename string) (string, error) {
+	ext := path.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	name := filename
+	for n := 1; ; n++ {
+		_, err := is.ImageDB.ByFilename(galleryID, name)
+		if err == ErrNotFound {
+			return name, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		name = fmt.Sprintf("%s-%d%s", base, n, ext)
+	}
+}
+
+// claimFilename saves image with save under the first free filename.
+// The unique index on the gallery and filename stops two uploads from
+// saving the same one, in which case the next free name is tried.
+// Images restored next to the same file get ErrImageDuplicate.
+func (is *imageService) claimFilename(image *Image, save func(*Image) error) error {
+	filename := image.Filename
+	for n := 1; ; n++ {
+		name, err := is.availableFilename(image.GalleryID, filename)
+		if err != nil {
+			return err
+		}
+		image.Filename = name
+		err = save(image)
+		if isUniqueViolation(err, imageSHA256Index) {
+			return ErrImageDuplicate
+		}
+		if !isUniqueViolation(err, imageFilenameIndex) || n == maxFilenameClaims {
+			return err
+		}
+	}
+}
+
+// isUniqueViolation reports whether err came from the unique index
+func isUniqueViolation(err error, index string) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505" && pqErr.Constraint == index
+}
+
+// nextPosition is the position that puts a new image after every
+// other image in the gallery.
+func (is *imageService) nextPosition(galleryID uint) (int, error) {
+	images, err := is.ImageDB.ByGalleryID(galleryID)
+	if err != nil || len(images) == 0 {
+		return 0, err
+	}
+	return images[len(images)-1].Position + 1, nil
+}
+
+// loadExif reads the original back out of the blob store and parses
+// its EXIF metadata. Missing or malformed metadata is not an error.
+func (is *imageService) loadExif(i *Image) error {
+	rc, err := is.Original(i)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	i.Exif, err = readExif(rc)
+	if err != nil {
+		i.Exif = ImageExif{}
+	}
+	return nil
+}
+
+// storeRenditions reads the original back out of the blob store and
+// writes the resized copies next to it. Files that don't fully decode
+// as an image are rejected with ErrImageInvalid.
+func (is *imageService) storeRenditions(i *Image) error {
+	i.HasRenditions = false
+	rc, err := is.Original(i)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	// Renditions are rotated upright using the EXIF orientation,
+	// since not every browser honors it
+	src, err := imaging.Decode(rc, imaging.AutoOrientation(true))
+	if err != nil {
+		return ErrImageInvalid
+	}
+	i.PHash = perceptualHash(src)
+	rs, err := makeRenditions(i, src)
+	if err != nil {
+		return err
+	}
+	for _, r := range rs {
+		err = is.store.Put(r.key, r.contentType, bytes.NewReader(r.data))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteFiles removes the original along with any renditions
+func (is *imageService) deleteFiles(i *Image) error {
+	for _, key := range i.renditionKeys() {
+		if err := is.store.Delete(key); err != nil {
+			return err
+		}
+	}
+	if err := is.store.Delete(i.OriginalKey()); err != nil {
+		return err
+	}
+	return is.store.Delete(i.Key())
+}
+
+// countingReader keeps track of how many bytes were read through it
+// and fails with ErrImageTooLarge once more than max bytes are read.
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	max int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	if cr.max > 0 && cr.n > cr.max {
+		return n, ErrImageTooLarge
+	}
+	return n, err
+}
+
+type imageValidator struct {
+	ImageDB
+}
+
+// Create an image in the database
+func (iv *imageValidator) Create(image *Image) error {
+	err := runImageValFuncs(image,
+		iv.galleryIDRequired,
+		iv.userIDRequired,
+		iv.filenameRequired,
+		canonicalExtension,
+		filenameSafe,
+		iv.normalizeText,
+		iv.textLength)
+	if err != nil {
+		return err
+	}
+	return iv.ImageDB.Create(image)
+}
+
+// Update an image in the database
+func (iv *imageValidator) Update(image *Image) error {
+	err := runImageValFuncs(image,
+		iv.galleryIDRequired,
+		iv.userIDRequired,
+		iv.filenameRequired,
+		filenameSafe,
+		iv.normalizeText,
+		iv.textLength)
+	if err != nil {
+		return err
+	}
+	return iv.ImageDB.Update(image)
+}
+
+// Delete an image in the database
+func (iv *imageValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return iv.ImageDB.Delete(id)
+}
+
+func (iv *imageValidator) DeleteByGalleryID(galleryID uint) error {
+	if galleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return iv.ImageDB.DeleteByGalleryID(galleryID)
+}
+
+func (iv *imageValidator) PurgeByGalleryID(galleryID uint) error {
+	if galleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return iv.ImageDB.PurgeByGalleryID(galleryID)
+}
+
+// Restore validates the filename, which may have changed while the
+// image was in the trash
+func (iv *imageValidator) Restore(image *Image) error {
+	if image.ID <= 0 {
+		return ErrIDInvalid
+	}
+	err := runImageValFuncs(image,
+		iv.galleryIDRequired,
+		iv.filenameRequired)
+	if err != nil {
+		return err
+	}
+	return iv.ImageDB.Restore(image)
+}
+
+func (iv *imageValidator) RestoreByGalleryID(galleryID uint, since time.Time) error {
+	if galleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return iv.ImageDB.RestoreByGalleryID(galleryID, since)
+}
+
+func (iv *imageValidator) Purge(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return iv.ImageDB.Purge(id)
+}
+
+// Reorder makes sure imageIDs lists every image in the gallery
+// exactly once before saving the new order
+func (iv *imageValidator) Reorder(galleryID uint, imageIDs []uint) error {
+	images, err := iv.ImageDB.ByGalleryID(galleryID)
+	if err != nil {
+		return err
+	}
+	if len(images) != len(imageIDs) {
+		return ErrImageOrderInvalid
+	}
+	seen := make(map[uint]bool, len(imageIDs))
+	for _, id := range imageIDs {
+		seen[id] = true
+	}
+	for _, image := range images {
+		if !seen[image.ID] {
+			return ErrImageOrderInvalid
+		}
+	}
+	return iv.ImageDB.Reorder(galleryID, imageIDs)
+}
+
+func (iv *imageValidator) galleryIDRequired(i *Image) error {
+	if i.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return nil
+}
+
+func (iv *imageValidator) userIDRequired(i *Image) error {
+	if i.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (iv *imageValidator) filenameRequired(i *Image) error {
+	if i.Filename == "" {
+		return ErrFilenameRequired
+	}
+	return nil
+}
+
+// normalizeText trims the title, alt text and caption, and collapses
+// the title and alt text onto a single line.
+func (iv *imageValidator) normalizeText(i *Image) error {
+	i.Title = strings.Join(strings.Fields(i.Title), " ")
+	i.AltText = strings.Join(strings.Fields(i.AltText), " ")
+	i.Caption = strings.TrimSpace(i.Caption)
+	return nil
+}
+
+func (iv *imageValidator) textLength(i *Image) error {
+	switch {
+	case utf8.RuneCountInString(i.Title) > maxImageTitleLength:
+		return ErrImageTitleTooLong
+	case utf8.RuneCountInString(i.AltText) > maxAltTextLength:
+		return ErrAltTextTooLong
+	case utf8.RuneCountInString(i.Caption) > maxCaptionLength:
+		return ErrCaptionTooLong
+	}
+	return nil
+}
+
+// filenameSafe normalizes the filename and makes sure it can't be
+// used to escape the gallery, ie no path separators, dot-segments,
+// hidden files or control characters.
+func filenameSafe(i *Image) error {
+	i.Filename = strings.TrimSpace(i.Filename)
+	name := i.Filename
+	if name == "" {
+		return ErrFilenameRequired
+	}
+	if len(name) > maxFilenameLength ||
+		strings.ContainsAny(name, `/\`) ||
+		strings.HasPrefix(name, ".") {
+		return ErrFilenameInvalid
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return ErrFilenameInvalid
+		}
+	}
+	return nil
+}
+
+// canonicalExtension replaces the extension of the filename with the
+// one for the sniffed content type, so an image is never served as
+// anything else. Filenames with an extension that isn't an image one,
+// eg .html, are rejected.
+func canonicalExtension(i *Image) error {
+	want, ok := imageExtensions[i.ContentType]
+	if !ok {
+		return ErrImageInvalid
+	}
+	ext := path.Ext(i.Filename)
+	if ext != "" && !imageUploadExtensions[strings.ToLower(ext)] {
+		return ErrImageInvalid
+	}
+	i.Filename = strings.TrimSuffix(i.Filename, ext) + want
+	return nil
+}
+
+var _ ImageDB = &imageGorm{}
+
+type imageGorm struct {
+	db *gorm.DB
+}
+
+func (ig *imageGorm) ByID(id uint) (*Image, error) {
+	var image Image
+	db := ig.db.Where("id = ?", id)
+	err := first(db, &image)
+	return &image, err
+}
+
+func (ig *imageGorm) ByGalleryID(galleryID uint) ([]Image, error) {
+	var images []Image
+	err := ig.db.Where("gallery_id = ?", galleryID).Order("position asc, id asc").Find(&images).Error
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) ByGalleryIDs(galleryIDs []uint) ([]Image, error) {
+	var images []Image
+	if len(galleryIDs) == 0 {
+		return images, nil
+	}
+	err := ig.db.Where("gallery_id in (?)", galleryIDs).Order("position asc, id asc").Find(&images).Error
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) ByFilename(galleryID uint, filename string) (*Image, error) {
+	var image Image
+	db := ig.db.Where("gallery_id = ?", galleryID).Where("filename = ?", filename)
+	err := first(db, &image)
+	return &image, err
+}
+
+func (ig *imageGorm) BySHA256(galleryID uint, hash string) (*Image, error) {
+	var image Image
+	db := ig.db.Where("gallery_id = ?", galleryID).Where("sha256 = ?", hash)
+	err := first(db, &image)
+	return &image, err
+}
+
+func (ig *imageGorm) Create(image *Image) error {
+	return ig.db.Create(image).Error
+}
+
+func (ig *imageGorm) Update(image *Image) error {
+	return ig.db.Save(image).Error
+}
+
+func (ig *imageGorm) Delete(id uint) error {
+	image := Image{Model: gorm.Model{ID: id}}
+	return ig.db.Delete(&image).Error
+}
+
+func (ig *imageGorm) DeleteByGalleryID(galleryID uint) error {
+	return ig.db.Where("gallery_id = ?", galleryID).Delete(&Image{}).Error
+}
+
+func (ig *imageGorm) PurgeByGalleryID(galleryID uint) error {
+	return ig.db.Unscoped().Where("gallery_id = ?", galleryID).Delete(&Image{}).Error
+}
+
+func (ig *imageGorm) DeletedByID(id uint) (*Image, error) {
+	var image Image
+	db := ig.db.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", id)
+	err := first(db, &image)
+	return &image, err
+}
+
+func (ig *imageGorm) DeletedByGalleryIDs(galleryIDs []uint) ([]Image, error) {
+	var images []Image
+	if len(galleryIDs) == 0 {
+		return images, nil
+	}
+	err := ig.db.Unscoped().
+		Where("gallery_id in (?) AND deleted_at IS NOT NULL", galleryIDs).
+		Order("deleted_at desc").
+		Find(&images).Error
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) DeletedBefore(t time.Time) ([]Image, error) {
+	var images []Image
+	err := ig.db.Unscoped().
+		Where("deleted_at IS NOT NULL AND deleted_at < ?", t).
+		Find(&images).Error
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) Restore(image *Image) error {
+	image.DeletedAt = nil
+	return ig.db.Unscoped().Save(image).Error
+}
+
+func (ig *imageGorm) RestoreByGalleryID(galleryID uint, since time.Time) error {
+	return ig.db.Unscoped().Model(&Image{}).
+		Where("gallery_id = ? AND deleted_at >= ?", galleryID, since).
+		UpdateColumn("deleted_at", gorm.Expr("NULL")).Error
+}
+
+func (ig *imageGorm) Purge(id uint) error {
+	image := Image{Model: gorm.Model{ID: id}}
+	return ig.db.Unscoped().Delete(&image).Error
+}
+
+func (ig *imageGorm) Reorder(galleryID uint, imageIDs []uint) error {
+	tx := ig.db.Begin()
+	for pos, id := range imageIDs {
+		err := tx.Model(&Image{}).
+			Where("id = ? AND gallery_id = ?", id, galleryID).
+			UpdateColumn("position", pos).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+type imageValFunc func(*Image) error
+
+func runImageValFuncs(image *Image, fns ...imageValFunc) error {
+	for _, fn := range fns {
+		if err := fn(image); err != nil {
+			return err
+		}
+	}
+	return nil
 }
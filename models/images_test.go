@@ -0,0 +1,291 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image/png"
+	"io"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/imattf/go-courses/gallery/storage"
+	"github.com/lib/pq"
+)
+
+func TestFilenameSafe(t *testing.T) {
+	cases := map[string]error{
+		"beach.jpg":        nil,
+		"  beach 2.jpg ":   nil,
+		"":                 ErrFilenameRequired,
+		".":                ErrFilenameInvalid,
+		"..":               ErrFilenameInvalid,
+		".htaccess":        ErrFilenameInvalid,
+		"../../etc/passwd": ErrFilenameInvalid,
+		"dir/beach.jpg":    ErrFilenameInvalid,
+		`dir\beach.jpg`:    ErrFilenameInvalid,
+		"beach\x00.jpg":    ErrFilenameInvalid,
+	}
+	for name, want := range cases {
+		img := Image{Filename: name}
+		if got := filenameSafe(&img); got != want {
+			t.Errorf("filenameSafe(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestPublicKeyGalleryID(t *testing.T) {
+	cases := map[string]uint{
+		"galleries/7/beach.jpg":            7,
+		"renditions/12/beach.jpg_320.webp": 12,
+		"originals/7/beach.jpg":            0,
+		"galleries/7/":                     0,
+		"galleries/0/beach.jpg":            0,
+		"galleries/-1/beach.jpg":           0,
+		"galleries/x/beach.jpg":            0,
+		"galleries/7":                      0,
+		"other/7/beach.jpg":                0,
+		"":                                 0,
+	}
+	for key, want := range cases {
+		got, ok := PublicKeyGalleryID(key)
+		if got != want || ok != (want != 0) {
+			t.Errorf("PublicKeyGalleryID(%q) = %v, %v, want %v", key, got, ok, want)
+		}
+	}
+}
+
+func TestCanonicalExtension(t *testing.T) {
+	cases := []struct {
+		filename, contentType string
+		want                  string
+		err                   error
+	}{
+		{"beach.jpg", "image/jpeg", "beach.jpg", nil},
+		{"beach.JPEG", "image/jpeg", "beach.jpg", nil},
+		{"beach.png", "image/jpeg", "beach.jpg", nil},
+		{"upload", "image/webp", "upload.webp", nil},
+		{"x.html", "image/jpeg", "", ErrImageInvalid},
+		{"x.svg", "image/png", "", ErrImageInvalid},
+		{"beach.jpg", "text/html; charset=utf-8", "", ErrImageInvalid},
+	}
+	for _, c := range cases {
+		img := Image{Filename: c.filename, ContentType: c.contentType}
+		err := canonicalExtension(&img)
+		if err != c.err || (err == nil && img.Filename != c.want) {
+			t.Errorf("canonicalExtension(%q, %q) = %q, %v, want %q, %v",
+				c.filename, c.contentType, img.Filename, err, c.want, c.err)
+		}
+	}
+}
+
+// imageMemory acts like another upload claims each filename just
+// before we save it, until claims run out
+type imageMemory struct {
+	ImageDB
+	names  map[string]bool
+	claims int
+}
+
+func (m *imageMemory) ByFilename(galleryID uint, filename string) (*Image, error) {
+	if m.names[filename] {
+		return &Image{Filename: filename}, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (m *imageMemory) Create(image *Image) error {
+	if m.claims > 0 {
+		m.claims--
+		m.names[image.Filename] = true
+		return &pq.Error{Code: "23505", Constraint: imageFilenameIndex}
+	}
+	m.names[image.Filename] = true
+	return nil
+}
+
+func TestClaimFilename(t *testing.T) {
+	m := &imageMemory{names: map[string]bool{"beach.jpg": true}, claims: 2}
+	is := &imageService{ImageDB: m}
+	image := Image{GalleryID: 1, Filename: "beach.jpg"}
+	if err := is.claimFilename(&image, m.Create); err != nil {
+		t.Fatal(err)
+	}
+	if image.Filename != "beach-3.jpg" {
+		t.Errorf("Expected beach-3.jpg. Recieved %s", image.Filename)
+	}
+
+	m.claims = maxFilenameClaims
+	if err := is.claimFilename(&image, m.Create); !isUniqueViolation(err, imageFilenameIndex) {
+		t.Errorf("Expected to give up with a unique violation. Recieved %v", err)
+	}
+
+	sameFile := func(*Image) error {
+		return &pq.Error{Code: "23505", Constraint: imageSHA256Index}
+	}
+	if err := is.claimFilename(&image, sameFile); err != ErrImageDuplicate {
+		t.Errorf("Expected ErrImageDuplicate. Recieved %v", err)
+	}
+}
+
+// pngHeader is the start of a PNG claiming to be w by h, with no
+// pixel data after it
+func pngHeader(w, h uint32) []byte {
+	ihdr := []byte("IHDR")
+	ihdr = binary.BigEndian.AppendUint32(ihdr, w)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, h)
+	ihdr = append(ihdr, 8, 2, 0, 0, 0) // 8 bit RGB
+	b := []byte("\x89PNG\r\n\x1a\n")
+	b = binary.BigEndian.AppendUint32(b, uint32(len(ihdr)-4))
+	b = append(b, ihdr...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestCreateTooManyPixels(t *testing.T) {
+	gallery := Gallery{UserID: 7}
+	gallery.ID = 1
+	is, records := testingImageService(t, gallery)
+
+	image := &Image{GalleryID: 1, UserID: 7, Filename: "bomb.png"}
+	err := is.Create(image, io.NopCloser(bytes.NewReader(pngHeader(100000, 100000))))
+	if err != ErrImageTooManyPixels {
+		t.Fatalf("Expected ErrImageTooManyPixels. Recieved %v", err)
+	}
+	if len(records.images) != 0 {
+		t.Errorf("Expected no image to be saved. Recieved %v", records.images)
+	}
+	if keys, _ := is.store.List(""); len(keys) != 0 {
+		t.Errorf("Expected nothing to be stored. Recieved %v", keys)
+	}
+
+	image = &Image{GalleryID: 1, UserID: 7, Filename: "small.png"}
+	err = is.Create(image, io.NopCloser(bytes.NewReader(pngFile(t, 64, 48, false))))
+	if err != nil {
+		t.Fatalf("Expected a small image to be created. Recieved %v", err)
+	}
+	if image.Width != 64 || image.Height != 48 {
+		t.Errorf("Expected a 64x48 image. Recieved %dx%d", image.Width, image.Height)
+	}
+}
+
+// imageRecords is an ImageDB that keeps images in memory, indexed by
+// ID - 1. Purged images are left as zero values.
+type imageRecords struct {
+	ImageDB
+	images []Image
+}
+
+func (ir *imageRecords) find(match func(*Image) bool) []Image {
+	var images []Image
+	for _, image := range ir.images {
+		if image.ID != 0 && match(&image) {
+			images = append(images, image)
+		}
+	}
+	return images
+}
+
+func (ir *imageRecords) first(match func(*Image) bool) (*Image, error) {
+	images := ir.find(match)
+	if len(images) == 0 {
+		return nil, ErrNotFound
+	}
+	return &images[0], nil
+}
+
+func (ir *imageRecords) ByID(id uint) (*Image, error) {
+	return ir.first(func(i *Image) bool { return i.ID == id && i.DeletedAt == nil })
+}
+
+func (ir *imageRecords) ByGalleryID(galleryID uint) ([]Image, error) {
+	images := ir.find(func(i *Image) bool { return i.GalleryID == galleryID && i.DeletedAt == nil })
+	sort.SliceStable(images, func(a, b int) bool { return images[a].Position < images[b].Position })
+	return images, nil
+}
+
+func (ir *imageRecords) ByFilename(galleryID uint, filename string) (*Image, error) {
+	return ir.first(func(i *Image) bool {
+		return i.GalleryID == galleryID && i.Filename == filename && i.DeletedAt == nil
+	})
+}
+
+func (ir *imageRecords) BySHA256(galleryID uint, hash string) (*Image, error) {
+	return ir.first(func(i *Image) bool {
+		return i.GalleryID == galleryID && i.SHA256 == hash && i.DeletedAt == nil
+	})
+}
+
+func (ir *imageRecords) DeletedByID(id uint) (*Image, error) {
+	return ir.first(func(i *Image) bool { return i.ID == id && i.DeletedAt != nil })
+}
+
+func (ir *imageRecords) DeletedByGalleryIDs(galleryIDs []uint) ([]Image, error) {
+	return ir.find(func(i *Image) bool {
+		for _, id := range galleryIDs {
+			if i.GalleryID == id && i.DeletedAt != nil {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+func (ir *imageRecords) Create(image *Image) error {
+	image.ID = uint(len(ir.images) + 1)
+	ir.images = append(ir.images, *image)
+	return nil
+}
+
+func (ir *imageRecords) Update(image *Image) error {
+	ir.images[image.ID-1] = *image
+	return nil
+}
+
+func (ir *imageRecords) Delete(id uint) error {
+	now := time.Now()
+	ir.images[id-1].DeletedAt = &now
+	return nil
+}
+
+func (ir *imageRecords) Restore(image *Image) error {
+	image.DeletedAt = nil
+	return ir.Update(image)
+}
+
+func (ir *imageRecords) Purge(id uint) error {
+	ir.images[id-1] = Image{}
+	return nil
+}
+
+func (ir *imageRecords) PurgeByGalleryID(galleryID uint) error {
+	for _, image := range ir.find(func(i *Image) bool { return i.GalleryID == galleryID }) {
+		ir.Purge(image.ID)
+	}
+	return nil
+}
+
+// pngFile encodes a w by h image as a PNG
+func pngFile(t *testing.T, w, h int, reversed bool) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, gradient(w, h, reversed)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testingImageService is an imageService with its records in memory
+// and its files in a temp directory
+func testingImageService(t *testing.T, galleries ...Gallery) (*imageService, *imageRecords) {
+	records := &imageRecords{}
+	gm := &galleryMemory{galleries: make(map[uint]*Gallery)}
+	for n := range galleries {
+		gm.galleries[galleries[n].ID] = &galleries[n]
+	}
+	is := &imageService{
+		ImageDB:   records,
+		galleryDB: gm,
+		store:     storage.NewDisk(t.TempDir()),
+	}
+	return is, records
+}
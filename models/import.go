@@ -0,0 +1,87 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+// importKey is where a stored file is kept while ImportStored creates
+// its image, since Create publishes to the key the file came from
+func importKey(key string) string {
+	return "imports/" + key
+}
+
+func (is *imageService) ImportStored() (int, error) {
+	keys, err := is.store.List("galleries/")
+	if err != nil {
+		return 0, err
+	}
+	galleries := make(map[uint]*Gallery)
+	var n int
+	for _, key := range keys {
+		galleryID, ok := PublicKeyGalleryID(key)
+		if !ok || strings.Count(key, "/") != 2 {
+			continue
+		}
+		filename := key[strings.LastIndex(key, "/")+1:]
+		_, err := is.ImageDB.ByFilename(galleryID, filename)
+		if err == nil {
+			continue
+		}
+		if err != ErrNotFound {
+			return n, err
+		}
+
+		gallery, ok := galleries[galleryID]
+		if !ok {
+			gallery, err = is.galleryDB.ByID(galleryID)
+			switch err {
+			case nil:
+			case ErrNotFound:
+				gallery = nil
+			default:
+				return n, err
+			}
+			galleries[galleryID] = gallery
+		}
+		// Files of deleted galleries are imported if the gallery is
+		// restored
+		if gallery == nil {
+			continue
+		}
+
+		err = is.importFile(gallery, key, filename)
+		if err != nil {
+			fmt.Printf("Failed to import %s: %v\n", key, err)
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
+
+// importFile creates the image for a file stored under key before
+// images were kept in the database. The file is left where it was if
+// that fails, eg because it isn't an image.
+func (is *imageService) importFile(gallery *Gallery, key, filename string) error {
+	err := is.moveFile(key, importKey(key))
+	if err != nil {
+		return err
+	}
+	rc, err := is.store.Get(importKey(key))
+	if err != nil {
+		is.moveFile(importKey(key), key)
+		return err
+	}
+	image := &Image{
+		GalleryID: gallery.ID,
+		UserID:    gallery.UserID,
+		Filename:  filename,
+	}
+	err = is.Create(image, rc)
+	if err != nil {
+		is.moveFile(importKey(key), key)
+		return err
+	}
+	return is.store.Delete(importKey(key))
+}
@@ -0,0 +1,50 @@
+package models
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestImportStored(t *testing.T) {
+	gallery := Gallery{UserID: 7}
+	gallery.ID = 1
+	is, records := testingImageService(t, gallery)
+	legacy := pngFile(t, 64, 48, false)
+	files := map[string][]byte{
+		"galleries/1/beach.png":  legacy,
+		"galleries/1/kept.png":   pngFile(t, 64, 48, true),
+		"galleries/1/notes.txt":  []byte("not an image"),
+		"galleries/2/trashy.png": pngFile(t, 32, 32, false),
+	}
+	for key, data := range files {
+		if err := is.store.Put(key, "", bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records.Create(&Image{GalleryID: 1, UserID: 7, Filename: "kept.png"})
+
+	n, err := is.ImportStored()
+	if err != nil || n != 1 {
+		t.Fatalf("Expected 1 image imported. Recieved %d, %v", n, err)
+	}
+	image, err := records.ByFilename(1, "beach.png")
+	if err != nil {
+		t.Fatalf("Expected an image for beach.png. Recieved %v", err)
+	}
+	if image.UserID != 7 || image.ContentType != "image/png" || image.Size != int64(len(legacy)) || image.Position != 1 {
+		t.Errorf("Expected the image to be filled in. Recieved %+v", image)
+	}
+	for _, key := range []string{"galleries/1/beach.png", "galleries/1/notes.txt", "galleries/2/trashy.png"} {
+		if _, err := is.store.Stat(key); err != nil {
+			t.Errorf("Expected %s to be left in place. Recieved %v", key, err)
+		}
+	}
+	if keys, _ := is.store.List("imports/"); len(keys) != 0 {
+		t.Errorf("Expected no files left over from the import. Recieved %v", keys)
+	}
+
+	n, err = is.ImportStored()
+	if err != nil || n != 0 {
+		t.Errorf("Expected nothing imported the second time. Recieved %d, %v", n, err)
+	}
+}
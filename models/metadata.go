@@ -0,0 +1,346 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Metadata policies for galleries. They control what is removed from
+// the copy of each image that is publicly served, the original is
+// always kept untouched for the owner.
+const (
+	// MetadataKeepAll serves images byte for byte as uploaded
+	MetadataKeepAll = "keep_all"
+
+	// MetadataStripLocation removes GPS coordinates and XMP data,
+	// which can also carry a location
+	MetadataStripLocation = "strip_location"
+
+	// MetadataStripAll removes all EXIF, XMP, IPTC and comment data,
+	// only keeping what is needed to display the image correctly
+	MetadataStripAll = "strip_all"
+)
+
+// MetadataPolicies lists every policy with a label for forms
+var MetadataPolicies = []struct {
+	Value string
+	Label string
+}{
+	{MetadataStripLocation, "Remove location data"},
+	{MetadataStripAll, "Remove all camera metadata"},
+	{MetadataKeepAll, "Keep all metadata"},
+}
+
+const (
+	tiffGPSInfo     = 0x8825
+	tiffOrientation = 0x0112
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	pngSig     = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// Redacted returns the metadata that may be shown to people other than
+// the owner of a gallery with the given policy.
+func (e ImageExif) Redacted(policy string) ImageExif {
+	switch policy {
+	case MetadataKeepAll:
+		return e
+	case MetadataStripAll:
+		return ImageExif{}
+	default:
+		e.Latitude = nil
+		e.Longitude = nil
+		return e
+	}
+}
+
+// stripMetadata returns a copy of data with metadata removed according
+// to policy. Only the container is rewritten, the image itself is never
+// re-encoded. GIFs have no camera metadata and are returned as is.
+func stripMetadata(data []byte, contentType, policy string) ([]byte, error) {
+	if policy == MetadataKeepAll {
+		return data, nil
+	}
+	switch contentType {
+	case "image/jpeg":
+		return stripJPEG(data, policy)
+	case "image/png":
+		return stripPNG(data, policy)
+	case "image/webp":
+		return stripWebP(data)
+	case "image/gif":
+		return data, nil
+	}
+	return nil, ErrImageInvalid
+}
+
+// stripJPEG walks the segments before the image data. With
+// MetadataStripLocation the GPS directory of the EXIF data is wiped
+// and XMP is dropped. With MetadataStripAll every metadata segment is
+// dropped, and a minimal EXIF segment holding only the orientation is
+// written so the image still displays the right way up.
+func stripJPEG(data []byte, policy string) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, ErrImageInvalid
+	}
+	var out bytes.Buffer
+	out.Write(data[:2])
+	orientation := 0
+	pos := 2
+	for {
+		// Skip any fill bytes before the marker
+		for pos < len(data) && data[pos] == 0xFF && pos+1 < len(data) && data[pos+1] == 0xFF {
+			pos++
+		}
+		if pos+4 > len(data) || data[pos] != 0xFF {
+			return nil, ErrImageInvalid
+		}
+		marker := data[pos+1]
+		if marker == 0xD9 || marker == 0xDA {
+			// End of image or start of scan, everything from here on
+			// is image data
+			if policy == MetadataStripAll && orientation > 1 {
+				writeOrientationSegment(&out, orientation)
+			}
+			out.Write(data[pos:])
+			return out.Bytes(), nil
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			// Markers without a length
+			out.Write(data[pos : pos+2])
+			pos += 2
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, ErrImageInvalid
+		}
+		seg := data[pos:end]
+		payload := seg[4:]
+
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(payload, exifHeader):
+			tiff := payload[len(exifHeader):]
+			if policy == MetadataStripAll {
+				orientation = tiffReadOrientation(tiff)
+				break
+			}
+			// EXIF we can't make sense of is dropped rather than
+			// risk leaving the location in
+			cleaned := append([]byte(nil), seg...)
+			if err := tiffWipeGPS(cleaned[4+len(exifHeader):]); err == nil {
+				out.Write(cleaned)
+			}
+		case marker == 0xE1:
+			// XMP, which can hold a location as well
+		case policy == MetadataStripAll && isJPEGMetadata(marker):
+		default:
+			out.Write(seg)
+		}
+		pos = end
+	}
+}
+
+// isJPEGMetadata reports whether a segment is metadata we can safely
+// drop. JFIF (APP0), ICC profiles (APP2) and Adobe color info (APP14)
+// are needed to display the image correctly and are kept.
+func isJPEGMetadata(marker byte) bool {
+	if marker == 0xFE {
+		return true // comment
+	}
+	if marker >= 0xE1 && marker <= 0xEF {
+		return marker != 0xE2 && marker != 0xEE
+	}
+	return false
+}
+
+// writeOrientationSegment writes an APP1 EXIF segment with a single
+// orientation tag.
+func writeOrientationSegment(out *bytes.Buffer, orientation int) {
+	tiff := []byte{
+		'M', 'M', 0x00, 0x2A, 0x00, 0x00, 0x00, 0x08, // header, IFD0 at 8
+		0x00, 0x01, // one entry
+		0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, // orientation, SHORT, count 1
+		0x00, byte(orientation), 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, // no next IFD
+	}
+	length := 2 + len(exifHeader) + len(tiff)
+	out.Write([]byte{0xFF, 0xE1, byte(length >> 8), byte(length)})
+	out.Write(exifHeader)
+	out.Write(tiff)
+}
+
+// tiffOrder returns the byte order of a TIFF block and the offset of
+// its first IFD.
+func tiffOrder(tiff []byte) (binary.ByteOrder, int, error) {
+	if len(tiff) < 8 {
+		return nil, 0, ErrImageInvalid
+	}
+	var bo binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return nil, 0, ErrImageInvalid
+	}
+	return bo, int(bo.Uint32(tiff[4:])), nil
+}
+
+// tiffEntries calls fn with the offset of every 12 byte entry in the
+// IFD at off.
+func tiffEntries(tiff []byte, bo binary.ByteOrder, off int, fn func(entry int)) error {
+	if off < 8 || off+2 > len(tiff) {
+		return ErrImageInvalid
+	}
+	n := int(bo.Uint16(tiff[off:]))
+	if off+2+n*12 > len(tiff) {
+		return ErrImageInvalid
+	}
+	for i := 0; i < n; i++ {
+		fn(off + 2 + i*12)
+	}
+	return nil
+}
+
+func tiffReadOrientation(tiff []byte) int {
+	bo, ifd0, err := tiffOrder(tiff)
+	if err != nil {
+		return 0
+	}
+	orientation := 0
+	tiffEntries(tiff, bo, ifd0, func(e int) {
+		if bo.Uint16(tiff[e:]) == tiffOrientation {
+			orientation = int(bo.Uint16(tiff[e+8:]))
+		}
+	})
+	return orientation
+}
+
+// tiffTypeSizes is the size in bytes of each TIFF field type
+var tiffTypeSizes = map[uint16]int{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+// tiffWipeGPS zeroes the GPS IFD, including any values it points to,
+// and removes the pointer to it from IFD0. tiff is modified in place.
+func tiffWipeGPS(tiff []byte) error {
+	bo, ifd0, err := tiffOrder(tiff)
+	if err != nil {
+		return err
+	}
+	gps := -1
+	err = tiffEntries(tiff, bo, ifd0, func(e int) {
+		if bo.Uint16(tiff[e:]) == tiffGPSInfo {
+			gps = int(bo.Uint32(tiff[e+8:]))
+			// Point the tag at nothing so readers skip it
+			bo.PutUint16(tiff[e:], 0)
+			bo.PutUint32(tiff[e+8:], 0)
+		}
+	})
+	if err != nil || gps < 0 {
+		return err
+	}
+	return tiffEntries(tiff, bo, gps, func(e int) {
+		size := tiffTypeSizes[bo.Uint16(tiff[e+2:])] * int(bo.Uint32(tiff[e+4:]))
+		if size > 4 {
+			off := int(bo.Uint32(tiff[e+8:]))
+			if off >= 0 && off+size <= len(tiff) {
+				zero(tiff[off : off+size])
+			}
+		}
+		zero(tiff[e : e+12])
+	})
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// stripPNG drops the eXIf chunk and XMP text. With MetadataStripAll
+// all text chunks and the modification time are dropped too.
+func stripPNG(data []byte, policy string) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSig) {
+		return nil, ErrImageInvalid
+	}
+	var out bytes.Buffer
+	out.Write(pngSig)
+	pos := len(pngSig)
+	for pos < len(data) {
+		if pos+12 > len(data) {
+			return nil, ErrImageInvalid
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, ErrImageInvalid
+		}
+		typ := string(data[pos+4 : pos+8])
+		body := data[pos+8 : pos+8+length]
+		drop := false
+		switch typ {
+		case "eXIf":
+			drop = true
+		case "iTXt":
+			drop = policy == MetadataStripAll || bytes.HasPrefix(body, []byte("XML:com.adobe.xmp\x00"))
+		case "tEXt", "zTXt", "tIME":
+			drop = policy == MetadataStripAll
+		}
+		if !drop {
+			out.Write(data[pos:end])
+		}
+		pos = end
+		if typ == "IEND" {
+			break
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// stripWebP drops the EXIF and XMP chunks, which is all the metadata
+// a WebP file can hold, and fixes up the VP8X flags and RIFF size.
+func stripWebP(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, ErrImageInvalid
+	}
+	var out bytes.Buffer
+	out.Write(data[:12])
+	vp8x := -1
+	pos := 12
+	for pos < len(data) {
+		if pos+8 > len(data) {
+			return nil, ErrImageInvalid
+		}
+		fourcc := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + size + size%2
+		if end > len(data) {
+			if pos+8+size > len(data) {
+				return nil, ErrImageInvalid
+			}
+			end = len(data)
+		}
+		switch fourcc {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			vp8x = out.Len()
+			out.Write(data[pos:end])
+		default:
+			out.Write(data[pos:end])
+		}
+		pos = end
+	}
+	b := out.Bytes()
+	if vp8x >= 0 && vp8x+8 < len(b) {
+		// Clear the EXIF (0x08) and XMP (0x04) flags
+		b[vp8x+8] &^= 0x08 | 0x04
+	}
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(b)-8))
+	return b, nil
+}
@@ -0,0 +1,92 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+// gpsJPEG returns a small JPEG with an EXIF segment holding a GPS
+// location of 10°N 20°E.
+func gpsJPEG(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	bo := binary.BigEndian
+	tiff := make([]byte, 8)
+	copy(tiff, "MM\x00\x2A")
+	bo.PutUint32(tiff[4:], 8)
+	entry := func(tag, typ uint16, count, value uint32) {
+		e := make([]byte, 12)
+		bo.PutUint16(e, tag)
+		bo.PutUint16(e[2:], typ)
+		bo.PutUint32(e[4:], count)
+		bo.PutUint32(e[8:], value)
+		tiff = append(tiff, e...)
+	}
+	rational := func(vals ...uint32) {
+		for _, v := range vals {
+			tiff = append(tiff, 0, 0, 0, 0, 0, 0, 0, 1)
+			bo.PutUint32(tiff[len(tiff)-8:], v)
+		}
+	}
+	// IFD0 at 8 with only the GPS pointer, the GPS IFD follows at 26
+	tiff = append(tiff, 0, 1)
+	entry(tiffGPSInfo, 4, 1, 26)
+	tiff = append(tiff, 0, 0, 0, 0)
+	// GPS IFD with four entries, the rationals start at 26+2+48+4
+	tiff = append(tiff, 0, 4)
+	entry(1, 2, 2, 'N'<<24)
+	entry(2, 5, 3, 80)
+	entry(3, 2, 2, 'E'<<24)
+	entry(4, 5, 3, 104)
+	tiff = append(tiff, 0, 0, 0, 0)
+	rational(10, 0, 0)
+	rational(20, 0, 0)
+
+	length := 2 + len(exifHeader) + len(tiff)
+	var out bytes.Buffer
+	out.Write(buf.Bytes()[:2])
+	out.Write([]byte{0xFF, 0xE1, byte(length >> 8), byte(length)})
+	out.Write(exifHeader)
+	out.Write(tiff)
+	out.Write(buf.Bytes()[2:])
+	return out.Bytes()
+}
+
+func TestStripMetadataJPEG(t *testing.T) {
+	data := gpsJPEG(t)
+	x, err := readExif(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !x.HasLocation() || *x.Latitude != 10 || *x.Longitude != 20 {
+		t.Fatalf("Expected location 10, 20. Recieved %q", x.Location())
+	}
+
+	for _, policy := range []string{MetadataStripLocation, MetadataStripAll} {
+		stripped, err := stripMetadata(data, "image/jpeg", policy)
+		if err != nil {
+			t.Fatalf("%s: %v", policy, err)
+		}
+		x, err := readExif(bytes.NewReader(stripped))
+		if err != nil {
+			t.Fatalf("%s: %v", policy, err)
+		}
+		if x.HasLocation() {
+			t.Errorf("%s: Expected no location. Recieved %q", policy, x.Location())
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(stripped)); err != nil {
+			t.Errorf("%s: Expected a valid JPEG. Recieved %v", policy, err)
+		}
+	}
+
+	kept, err := stripMetadata(data, "image/jpeg", MetadataKeepAll)
+	if err != nil || !bytes.Equal(kept, data) {
+		t.Errorf("Expected keep_all to return the image unchanged")
+	}
+}
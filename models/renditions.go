@@ -0,0 +1,159 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/url"
+	"strings"
+
+	// Register the decoders we accept uploads in
+	_ "image/gif"
+	_ "image/png"
+
+	"github.com/chai2010/webp"
+	"github.com/disintegration/imaging"
+	_ "golang.org/x/image/webp"
+)
+
+// RenditionWidths are the fixed widths, in pixels, that resized
+// copies of every image are generated at. Images are never upscaled,
+// so smaller originals only get the renditions narrower than them.
+var RenditionWidths = []int{320, 800, 1600}
+
+const (
+	renditionJPEG = "jpg"
+	renditionWebP = "webp"
+
+	renditionJPEGQuality = 85
+	renditionWebPQuality = 80
+)
+
+// widths returns the rendition widths that exist for this image.
+func (i *Image) widths() []int {
+	if !i.HasRenditions {
+		return nil
+	}
+	var ret []int
+	for _, w := range RenditionWidths {
+		if w < i.Width {
+			ret = append(ret, w)
+		}
+	}
+	return ret
+}
+
+// renditionKey is where the resized copy of the image at width w
+// is kept in the BlobStore.
+func (i *Image) renditionKey(w int, ext string) string {
+	return fmt.Sprintf("renditions/%v/%v_%d.%s", i.GalleryID, i.Filename, w, ext)
+}
+
+func (i *Image) renditionPath(w int, ext string) string {
+	temp := url.URL{
+		Path: "/images/" + i.renditionKey(w, ext),
+	}
+	return temp.String()
+}
+
+// ThumbPath is the URL of the smallest JPEG rendition, falling back
+// to the original when no renditions exist.
+func (i *Image) ThumbPath() string {
+	widths := i.widths()
+	if len(widths) == 0 {
+		return i.Path()
+	}
+	return i.renditionPath(widths[0], renditionJPEG)
+}
+
+// SrcSet is the value for an <img> srcset attribute listing the JPEG
+// renditions along with the original.
+func (i *Image) SrcSet() string {
+	return i.srcSet(renditionJPEG, true)
+}
+
+// WebPSrcSet is the value for a <source type="image/webp"> srcset
+// attribute. It is empty when no renditions exist.
+func (i *Image) WebPSrcSet() string {
+	return i.srcSet(renditionWebP, false)
+}
+
+func (i *Image) srcSet(ext string, withOriginal bool) string {
+	var parts []string
+	for _, w := range i.widths() {
+		parts = append(parts, fmt.Sprintf("%s %dw", i.renditionPath(w, ext), w))
+	}
+	if withOriginal && i.Width > 0 {
+		parts = append(parts, fmt.Sprintf("%s %dw", i.Path(), i.Width))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// rendition is a single resized and encoded copy of an image
+type rendition struct {
+	key         string
+	contentType string
+	data        []byte
+}
+
+// makeRenditions decodes src and returns every rendition for the image,
+// setting Width and Height on the image along the way.
+func makeRenditions(img *Image, src image.Image) ([]rendition, error) {
+	b := src.Bounds()
+	img.Width = b.Dx()
+	img.Height = b.Dy()
+	img.HasRenditions = true
+
+	var ret []rendition
+	for _, w := range img.widths() {
+		resized := imaging.Resize(src, w, 0, imaging.Lanczos)
+
+		var jpg bytes.Buffer
+		err := jpeg.Encode(&jpg, resized, &jpeg.Options{Quality: renditionJPEGQuality})
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, rendition{
+			key:         img.renditionKey(w, renditionJPEG),
+			contentType: "image/jpeg",
+			data:        jpg.Bytes(),
+		})
+
+		var wp bytes.Buffer
+		err = webp.Encode(&wp, resized, &webp.Options{Quality: renditionWebPQuality})
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, rendition{
+			key:         img.renditionKey(w, renditionWebP),
+			contentType: "image/webp",
+			data:        wp.Bytes(),
+		})
+	}
+	return ret, nil
+}
+
+// renditionKeys lists every key a rendition of the image could be
+// stored under, whether or not it was generated.
+func (i *Image) renditionKeys() []string {
+	var ret []string
+	for _, w := range RenditionWidths {
+		ret = append(ret, i.renditionKey(w, renditionJPEG), i.renditionKey(w, renditionWebP))
+	}
+	return ret
+}
+
+// checkPixels reads the dimensions from the header of the image in r
+// and rejects images with more than MaxImagePixels
+func checkPixels(r io.Reader) error {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return ErrImageInvalid
+	}
+	if int64(config.Width)*int64(config.Height) > MaxImagePixels {
+		return ErrImageTooManyPixels
+	}
+	return nil
+}
@@ -1,6 +1,9 @@
 package models
 
 import (
+	"time"
+
+	"github.com/imattf/go-courses/gallery/storage"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 )
@@ -25,23 +28,55 @@ func WithLogMode(mode bool) ServicesConfig {
 	}
 }
 
-func WithUser(pepper, hmacKey string) ServicesConfig {
+func WithUser(pepper, hmacKey, encryptionKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.User = NewUserService(s.db, pepper, hmacKey, encryptionKey)
+		return nil
+	}
+}
+
+func WithSession(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.Session = NewSessionService(s.db, hmacKey)
+		return nil
+	}
+}
+
+func WithWebAuthn(rpID string, origins []string, encryptionKey string) ServicesConfig {
 	return func(s *Services) error {
-		s.User = NewUserService(s.db, pepper, hmacKey)
+		ws, err := NewWebAuthnService(s.db, rpID, origins, encryptionKey)
+		if err != nil {
+			return err
+		}
+		s.WebAuthn = ws
 		return nil
 	}
 }
 
-func WithGallery() ServicesConfig {
+func WithGallery(pepper, hmacKey string) ServicesConfig {
 	return func(s *Services) error {
-		s.Gallery = NewGalleryService(s.db)
+		s.Gallery = NewGalleryService(s.db, pepper, hmacKey)
 		return nil
 	}
 }
 
-func WithImage() ServicesConfig {
+func WithImage(store storage.BlobStore) ServicesConfig {
 	return func(s *Services) error {
-		s.Image = NewImageService()
+		s.Image = NewImageService(s.db, store)
+		return nil
+	}
+}
+
+func WithShareLink(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.ShareLink = NewShareLinkService(s.db, hmacKey)
+		return nil
+	}
+}
+
+func WithGalleryMember(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.GalleryMember = NewGalleryMemberService(s.db, hmacKey)
 		return nil
 	}
 }
@@ -64,11 +99,15 @@ func NewServices(cfgs ...ServicesConfig) (*Services, error) {
 }
 
 type Services struct {
-	Gallery GalleryService
-	User    UserService
-	Image   ImageService
-	OAuth   OAuthService
-	db      *gorm.DB
+	Gallery       GalleryService
+	User          UserService
+	Session       SessionService
+	WebAuthn      WebAuthnService
+	Image         ImageService
+	ShareLink     ShareLinkService
+	GalleryMember GalleryMemberService
+	OAuth         OAuthService
+	db            *gorm.DB
 }
 
 // Closes the database connection
@@ -76,9 +115,32 @@ func (s *Services) Close() error {
 	return s.db.Close()
 }
 
+// EmptyTrash permanently removes the galleries and images deleted
+// more than retention ago, along with their files. Galleries take
+// their share links and members with them. It returns how many
+// galleries and images were purged.
+func (s *Services) EmptyTrash(retention time.Duration) (int, error) {
+	before := time.Now().Add(-retention)
+	galleries, err := s.Gallery.DeletedBefore(before)
+	if err != nil {
+		return 0, err
+	}
+	for i, gallery := range galleries {
+		if err := s.Image.PurgeGallery(gallery.ID); err != nil {
+			return i, err
+		}
+		// The gallery goes last so a failed purge is tried again
+		if err := s.Gallery.Purge(gallery.ID); err != nil {
+			return i, err
+		}
+	}
+	n, err := s.Image.PurgeDeleted(before)
+	return len(galleries) + n, err
+}
+
 // DestructiveReset drops all tables and rebuilds them
 func (s *Services) DestructiveReset() error {
-	err := s.db.DropTableIfExists(&User{}, &Gallery{}, OAuth{}, &pwReset{}).Error
+	err := s.db.DropTableIfExists(&User{}, &Session{}, &WebAuthnCredential{}, &Gallery{}, &Image{}, &ShareLink{}, &GalleryMember{}, OAuth{}, &pwReset{}, &emailVerification{}, &recoveryCode{}, &unlockAttempt{}, &webAuthnChallenge{}).Error
 	if err != nil {
 		return err
 	}
@@ -87,5 +149,52 @@ func (s *Services) DestructiveReset() error {
 
 // AutoMigrate will attempt to automatically migrate all tables
 func (s *Services) AutoMigrate() error {
-	return s.db.AutoMigrate(&User{}, &Gallery{}, OAuth{}, &pwReset{}).Error
+	// Users who signed up before email addresses were verified keep
+	// everything they could do, so they count as verified
+	backfillVerified := s.db.HasTable(&User{}) && !s.db.Dialect().HasColumn("users", "verified_at")
+	// Galleries could be seen by anyone before they had a visibility,
+	// so they stay public rather than breaking links that work today
+	backfillVisibility := s.db.HasTable(&Gallery{}) && !s.db.Dialect().HasColumn("galleries", "visibility")
+	err := s.db.AutoMigrate(&User{}, &Session{}, &WebAuthnCredential{}, &Gallery{}, &Image{}, &ShareLink{}, &GalleryMember{}, OAuth{}, &pwReset{}, &emailVerification{}, &recoveryCode{}, &unlockAttempt{}, &webAuthnChallenge{}).Error
+	if err != nil {
+		return err
+	}
+	// Stops two uploads from claiming the same filename, see
+	// claimFilename. Images in the trash keep theirs until restored.
+	err = s.db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS " + imageFilenameIndex + " ON images (gallery_id, filename) WHERE deleted_at IS NULL").Error
+	if err != nil {
+		return err
+	}
+	// Stops the same file being uploaded to a gallery twice at once.
+	// Images uploaded twice before that keep only the first hash, the
+	// copies are left as they were before hashes were added.
+	if !s.db.Dialect().HasIndex("images", imageSHA256Index) {
+		err = s.db.Exec(`UPDATE images SET sha256 = '' WHERE deleted_at IS NULL AND sha256 <> '' AND id NOT IN
+			(SELECT MIN(id) FROM images WHERE deleted_at IS NULL AND sha256 <> '' GROUP BY gallery_id, sha256)`).Error
+		if err != nil {
+			return err
+		}
+		err = s.db.Exec("CREATE UNIQUE INDEX " + imageSHA256Index + " ON images (gallery_id, sha256) WHERE deleted_at IS NULL AND sha256 <> ''").Error
+		if err != nil {
+			return err
+		}
+	}
+	if backfillVisibility {
+		err := s.db.Unscoped().Model(&Gallery{}).UpdateColumn("visibility", VisibilityPublic).Error
+		if err != nil {
+			return err
+		}
+	}
+	if backfillVerified {
+		err := s.db.Model(&User{}).UpdateColumn("verified_at", gorm.Expr("created_at")).Error
+		if err != nil {
+			return err
+		}
+	}
+	// Remember tokens were replaced by sessions, and the old not null
+	// column would stop new users from being created
+	if s.db.Dialect().HasColumn("users", "remember_hash") {
+		return s.db.Model(&User{}).DropColumn("remember_hash").Error
+	}
+	return nil
 }
@@ -0,0 +1,286 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/imattf/go-courses/gallery/hash"
+	"github.com/imattf/go-courses/gallery/rand"
+	"github.com/jinzhu/gorm"
+)
+
+// SessionDuration is how long a session lasts without being used
+const SessionDuration = 30 * 24 * time.Hour
+
+// sessionTouchInterval is how often LastSeenAt is updated while a
+// session is in use, rather than on every request
+const sessionTouchInterval = 5 * time.Minute
+
+// Session is a device the user signed in on. The device keeps Token
+// in a cookie, only its hash is stored.
+type Session struct {
+	gorm.Model
+	UserID     uint   `gorm:"not null;index"`
+	Token      string `gorm:"-"`
+	TokenHash  string `gorm:"not null;unique_index"`
+	UserAgent  string `gorm:"type:text"`
+	IP         string
+	LastSeenAt time.Time
+	ExpiresAt  time.Time `gorm:"not null;index"`
+}
+
+// Device describes the browser and operating system the session was
+// started from, eg "Firefox on Windows", going by its user agent.
+func (s *Session) Device() string {
+	ua := s.UserAgent
+	browser := "Unknown browser"
+	// Order matters, eg Edge and Chrome user agents also claim to be
+	// Safari
+	for _, b := range [][2]string{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+	} {
+		if strings.Contains(ua, b[0]) {
+			browser = b[1]
+			break
+		}
+	}
+	for _, os := range [][2]string{
+		{"iPhone", "iPhone"},
+		{"iPad", "iPad"},
+		{"Android", "Android"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(ua, os[0]) {
+			return browser + " on " + os[1]
+		}
+	}
+	return browser
+}
+
+// SessionDB is used for interacting with the sessions database.
+// Sessions that have expired are never returned.
+type SessionDB interface {
+	// ByToken looks up a session by the token the device sent
+	ByToken(token string) (*Session, error)
+
+	// ByUserID lists the user's sessions, most recently seen first
+	ByUserID(userID uint) ([]Session, error)
+
+	// Create starts a session for UserID, filling in Token
+	Create(session *Session) error
+	Update(session *Session) error
+	Delete(id uint) error
+
+	// DeleteByUserID ends every session of the user except exceptID,
+	// which may be 0 to end them all
+	DeleteByUserID(userID, exceptID uint) error
+}
+
+// SessionService keeps track of the devices users are signed in on
+type SessionService interface {
+	SessionDB
+
+	// Touch records that the session was just used, which extends it
+	// by SessionDuration. It only writes to the database every few
+	// minutes.
+	Touch(session *Session) error
+}
+
+func NewSessionService(db *gorm.DB, hmacKey string) SessionService {
+	return &sessionService{
+		SessionDB: &sessionValidator{
+			SessionDB: &sessionGorm{db},
+			hmac:      hash.NewHMAC(hmacKey),
+		},
+	}
+}
+
+// Compiler check to make sure sessionService implements SessionService
+var _ SessionService = &sessionService{}
+
+type sessionService struct {
+	SessionDB
+}
+
+func (ss *sessionService) Touch(session *Session) error {
+	now := time.Now()
+	if now.Sub(session.LastSeenAt) < sessionTouchInterval {
+		return nil
+	}
+	session.LastSeenAt = now
+	session.ExpiresAt = now.Add(SessionDuration)
+	return ss.SessionDB.Update(session)
+}
+
+type sessionValidator struct {
+	SessionDB
+	hmac hash.HMAC
+}
+
+// ByToken will hash the token and then call ByToken on the
+// subsequent SessionDB layer.
+func (sv *sessionValidator) ByToken(token string) (*Session, error) {
+	session := Session{Token: token}
+	if err := runSessionValFuncs(&session, sv.hmacToken); err != nil {
+		return nil, err
+	}
+	return sv.SessionDB.ByToken(session.TokenHash)
+}
+
+func (sv *sessionValidator) Create(session *Session) error {
+	err := runSessionValFuncs(session,
+		sv.userIDRequired,
+		sv.setTokenIfUnset,
+		sv.tokenMinBytes,
+		sv.hmacToken,
+		sv.tokenHashRequired,
+		sv.setExpiry)
+	if err != nil {
+		return err
+	}
+	return sv.SessionDB.Create(session)
+}
+
+func (sv *sessionValidator) Update(session *Session) error {
+	err := runSessionValFuncs(session,
+		sv.userIDRequired,
+		sv.tokenHashRequired)
+	if err != nil {
+		return err
+	}
+	return sv.SessionDB.Update(session)
+}
+
+func (sv *sessionValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return sv.SessionDB.Delete(id)
+}
+
+func (sv *sessionValidator) DeleteByUserID(userID, exceptID uint) error {
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+	return sv.SessionDB.DeleteByUserID(userID, exceptID)
+}
+
+func (sv *sessionValidator) userIDRequired(s *Session) error {
+	if s.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (sv *sessionValidator) setTokenIfUnset(s *Session) error {
+	if s.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	s.Token = token
+	return nil
+}
+
+func (sv *sessionValidator) tokenMinBytes(s *Session) error {
+	n, err := rand.NBytes(s.Token)
+	if err != nil {
+		return err
+	}
+	if n < rand.RememberTokenBytes {
+		return ErrRememberTooShort
+	}
+	return nil
+}
+
+func (sv *sessionValidator) hmacToken(s *Session) error {
+	if s.Token == "" {
+		return nil
+	}
+	s.TokenHash = sv.hmac.Hash(s.Token)
+	return nil
+}
+
+func (sv *sessionValidator) tokenHashRequired(s *Session) error {
+	if s.TokenHash == "" {
+		return ErrRememberRequired
+	}
+	return nil
+}
+
+func (sv *sessionValidator) setExpiry(s *Session) error {
+	s.LastSeenAt = time.Now()
+	s.ExpiresAt = s.LastSeenAt.Add(SessionDuration)
+	return nil
+}
+
+type sessionValFunc func(*Session) error
+
+func runSessionValFuncs(session *Session, fns ...sessionValFunc) error {
+	for _, fn := range fns {
+		if err := fn(session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ SessionDB = &sessionGorm{}
+
+type sessionGorm struct {
+	db *gorm.DB
+}
+
+// ByToken expects the token to already be hashed
+func (sg *sessionGorm) ByToken(tokenHash string) (*Session, error) {
+	var session Session
+	db := sg.db.Where("token_hash = ? AND expires_at > ?", tokenHash, time.Now())
+	err := first(db, &session)
+	return &session, err
+}
+
+func (sg *sessionGorm) ByUserID(userID uint) ([]Session, error) {
+	var sessions []Session
+	err := sg.db.Where("user_id = ? AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at desc").
+		Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (sg *sessionGorm) Create(session *Session) error {
+	// Tidy up the user's expired sessions while we are here
+	err := sg.db.Unscoped().
+		Where("user_id = ? AND expires_at <= ?", session.UserID, time.Now()).
+		Delete(&Session{}).Error
+	if err != nil {
+		return err
+	}
+	return sg.db.Create(session).Error
+}
+
+func (sg *sessionGorm) Update(session *Session) error {
+	return sg.db.Save(session).Error
+}
+
+// Sessions are removed for good, there is nothing to restore
+func (sg *sessionGorm) Delete(id uint) error {
+	session := Session{Model: gorm.Model{ID: id}}
+	return sg.db.Unscoped().Delete(&session).Error
+}
+
+func (sg *sessionGorm) DeleteByUserID(userID, exceptID uint) error {
+	return sg.db.Unscoped().
+		Where("user_id = ? AND id <> ?", userID, exceptID).
+		Delete(&Session{}).Error
+}
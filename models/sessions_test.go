@@ -0,0 +1,18 @@
+package models
+
+import "testing"
+
+func TestSessionDevice(t *testing.T) {
+	cases := map[string]string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.0.0":           "Edge on Windows",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1": "Safari on iPhone",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0":                                                                  "Firefox on Linux",
+		"curl/8.4.0": "Unknown browser",
+	}
+	for ua, want := range cases {
+		s := Session{UserAgent: ua}
+		if got := s.Device(); got != want {
+			t.Errorf("Expected %q. Recieved %q", want, got)
+		}
+	}
+}
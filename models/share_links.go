@@ -0,0 +1,338 @@
+package models
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/imattf/go-courses/gallery/hash"
+	"github.com/imattf/go-courses/gallery/rand"
+	"github.com/jinzhu/gorm"
+)
+
+// ShareLink lets anyone holding its token see a gallery, whatever the
+// gallery's visibility, until the link expires, runs out of views or
+// is revoked. Like pwReset, only the HMAC of the token is stored, so
+// the token itself can only be shown once, right after creating it.
+type ShareLink struct {
+	gorm.Model
+	GalleryID uint   `gorm:"not_null;index"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not_null;unique_index"`
+
+	// Label reminds the owner who the link was given to
+	Label string
+
+	// ExpiresAt is nil for links that never expire
+	ExpiresAt *time.Time
+
+	// MaxViews is 0 for links that can be viewed any number of times
+	MaxViews int `gorm:"not_null;default:0"`
+	Views    int `gorm:"not_null;default:0"`
+
+	RevokedAt *time.Time
+}
+
+// Active reports whether the link can still be opened at time now
+func (sl *ShareLink) Active(now time.Time) bool {
+	if sl.MaxViews > 0 && sl.Views >= sl.MaxViews {
+		return false
+	}
+	return sl.Valid(now)
+}
+
+// Valid reports whether the link has neither expired nor been revoked
+// at time now. Unlike Active it ignores the view limit, which counts
+// how often the gallery is opened and not the images loaded with it,
+// see ShareLinkService.VisitToken.
+func (sl *ShareLink) Valid(now time.Time) bool {
+	if sl.RevokedAt != nil {
+		return false
+	}
+	return sl.ExpiresAt == nil || now.Before(*sl.ExpiresAt)
+}
+
+// Path is the URL the link is opened at. It is only available right
+// after the link is created, when Token is still set.
+func (sl *ShareLink) Path() string {
+	if sl.Token == "" {
+		return ""
+	}
+	return "/s/" + sl.Token
+}
+
+// ShareLinkDB is used for interacting with the share links database.
+type ShareLinkDB interface {
+	ByID(id uint) (*ShareLink, error)
+	ByToken(token string) (*ShareLink, error)
+	// ActiveByGalleryID lists the links to a gallery that can still
+	// be used, newest first
+	ActiveByGalleryID(galleryID uint) ([]ShareLink, error)
+	Create(link *ShareLink) error
+	Update(link *ShareLink) error
+
+	// AddView counts a view of the link, returning
+	// ErrShareLinkInvalid if it has no views left.
+	AddView(link *ShareLink) error
+}
+
+// ShareLinkService manages the links galleries are shared with.
+type ShareLinkService interface {
+	ShareLinkDB
+
+	// Use looks up an active link by its token and counts the view.
+	// Unknown, expired, used up and revoked links all return
+	// ErrShareLinkInvalid.
+	Use(token string) (*ShareLink, error)
+
+	// Revoke stops the link from working
+	Revoke(link *ShareLink) error
+
+	// VisitToken returns a signed token that lets whoever opened the
+	// link load the gallery's images and image pages until expires,
+	// as part of the view Use counted.
+	VisitToken(link *ShareLink, expires time.Time) string
+
+	// ByVisitToken looks up the link a token from VisitToken was made
+	// for. Tokens that are expired or were tampered with, and links
+	// that expired or were revoked since, return ErrShareLinkInvalid.
+	ByVisitToken(token string) (*ShareLink, error)
+}
+
+func NewShareLinkService(db *gorm.DB, hmacKey string) ShareLinkService {
+	hmac := hash.NewHMAC(hmacKey)
+	return &shareLinkService{
+		ShareLinkDB: &shareLinkValidator{
+			ShareLinkDB: &shareLinkGorm{db},
+			hmac:        hmac,
+		},
+		hmac: hmac,
+	}
+}
+
+// Compiler check to make sure shareLinkService implements ShareLinkService
+var _ ShareLinkService = &shareLinkService{}
+
+type shareLinkService struct {
+	ShareLinkDB
+	hmac hash.HMAC
+}
+
+func (sls *shareLinkService) Use(token string) (*ShareLink, error) {
+	link, err := sls.ByToken(token)
+	if err == ErrNotFound {
+		return nil, ErrShareLinkInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !link.Active(time.Now()) {
+		return nil, ErrShareLinkInvalid
+	}
+	if err := sls.AddView(link); err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+func (sls *shareLinkService) Revoke(link *ShareLink) error {
+	now := time.Now()
+	link.RevokedAt = &now
+	return sls.Update(link)
+}
+
+// Visit tokens are "<link id>.<expires unix time>.<signature>"
+func (sls *shareLinkService) VisitToken(link *ShareLink, expires time.Time) string {
+	id := strconv.FormatUint(uint64(link.ID), 10)
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return id + "." + exp + "." + sls.visitSignature(link.ID, exp)
+}
+
+func (sls *shareLinkService) ByVisitToken(token string) (*ShareLink, error) {
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 {
+		return nil, ErrShareLinkInvalid
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrShareLinkInvalid
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() >= exp {
+		return nil, ErrShareLinkInvalid
+	}
+	want := sls.visitSignature(uint(id), parts[1])
+	if !hmac.Equal([]byte(parts[2]), []byte(want)) {
+		return nil, ErrShareLinkInvalid
+	}
+	link, err := sls.ByID(uint(id))
+	if err == ErrNotFound {
+		return nil, ErrShareLinkInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !link.Valid(time.Now()) {
+		return nil, ErrShareLinkInvalid
+	}
+	return link, nil
+}
+
+func (sls *shareLinkService) visitSignature(id uint, exp string) string {
+	return sls.hmac.Hash(fmt.Sprintf("share-visit:%d:%s", id, exp))
+}
+
+type shareLinkValidator struct {
+	ShareLinkDB
+	hmac hash.HMAC
+}
+
+func (slv *shareLinkValidator) ByToken(token string) (*ShareLink, error) {
+	link := ShareLink{Token: token}
+	err := runShareLinkValFuncs(&link, slv.hmacToken)
+	if err != nil {
+		return nil, err
+	}
+	if link.TokenHash == "" {
+		return nil, ErrNotFound
+	}
+	return slv.ShareLinkDB.ByToken(link.TokenHash)
+}
+
+func (slv *shareLinkValidator) Create(link *ShareLink) error {
+	err := runShareLinkValFuncs(link,
+		slv.galleryIDRequired,
+		slv.expiryInFuture,
+		slv.maxViewsValid,
+		slv.setTokenIfUnset,
+		slv.hmacToken)
+	if err != nil {
+		return err
+	}
+	return slv.ShareLinkDB.Create(link)
+}
+
+func (slv *shareLinkValidator) Update(link *ShareLink) error {
+	err := runShareLinkValFuncs(link,
+		slv.galleryIDRequired,
+		slv.maxViewsValid)
+	if err != nil {
+		return err
+	}
+	return slv.ShareLinkDB.Update(link)
+}
+
+func (slv *shareLinkValidator) galleryIDRequired(link *ShareLink) error {
+	if link.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+	return nil
+}
+
+func (slv *shareLinkValidator) expiryInFuture(link *ShareLink) error {
+	if link.ExpiresAt != nil && !link.ExpiresAt.After(time.Now()) {
+		return ErrShareLinkExpiryInvalid
+	}
+	return nil
+}
+
+func (slv *shareLinkValidator) maxViewsValid(link *ShareLink) error {
+	if link.MaxViews < 0 {
+		return ErrShareLinkMaxViewsInvalid
+	}
+	return nil
+}
+
+func (slv *shareLinkValidator) setTokenIfUnset(link *ShareLink) error {
+	if link.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	link.Token = token
+	return nil
+}
+
+func (slv *shareLinkValidator) hmacToken(link *ShareLink) error {
+	if link.Token == "" {
+		return nil
+	}
+	link.TokenHash = slv.hmac.Hash(link.Token)
+	return nil
+}
+
+var _ ShareLinkDB = &shareLinkGorm{}
+
+type shareLinkGorm struct {
+	db *gorm.DB
+}
+
+func (slg *shareLinkGorm) ByID(id uint) (*ShareLink, error) {
+	var link ShareLink
+	err := first(slg.db.Where("id = ?", id), &link)
+	return &link, err
+}
+
+func (slg *shareLinkGorm) ByToken(tokenHash string) (*ShareLink, error) {
+	var link ShareLink
+	err := first(slg.db.Where("token_hash = ?", tokenHash), &link)
+	if err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+func (slg *shareLinkGorm) ActiveByGalleryID(galleryID uint) ([]ShareLink, error) {
+	var links []ShareLink
+	err := slg.db.Where("gallery_id = ?", galleryID).
+		Where("revoked_at IS NULL").
+		Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		Where("max_views = 0 OR views < max_views").
+		Order("created_at desc").
+		Find(&links).Error
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (slg *shareLinkGorm) Create(link *ShareLink) error {
+	return slg.db.Create(link).Error
+}
+
+func (slg *shareLinkGorm) Update(link *ShareLink) error {
+	return slg.db.Save(link).Error
+}
+
+// AddView increments the count in the database rather than saving
+// link, so visitors opening the link at the same time can't go over
+// the limit.
+func (slg *shareLinkGorm) AddView(link *ShareLink) error {
+	db := slg.db.Model(&ShareLink{}).
+		Where("id = ?", link.ID).
+		Where("max_views = 0 OR views < max_views").
+		UpdateColumn("views", gorm.Expr("views + 1"))
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrShareLinkInvalid
+	}
+	link.Views++
+	return nil
+}
+
+type shareLinkValFunc func(*ShareLink) error
+
+func runShareLinkValFuncs(link *ShareLink, fns ...shareLinkValFunc) error {
+	for _, fn := range fns {
+		if err := fn(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
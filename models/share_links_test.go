@@ -0,0 +1,48 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/imattf/go-courses/gallery/hash"
+)
+
+type shareLinkMemory struct {
+	ShareLinkDB
+	link *ShareLink
+}
+
+func (m *shareLinkMemory) ByID(id uint) (*ShareLink, error) {
+	if id != m.link.ID {
+		return nil, ErrNotFound
+	}
+	return m.link, nil
+}
+
+func TestVisitToken(t *testing.T) {
+	link := &ShareLink{GalleryID: 3}
+	link.ID = 7
+	sls := &shareLinkService{ShareLinkDB: &shareLinkMemory{link: link}, hmac: hash.NewHMAC("test-key")}
+
+	token := sls.VisitToken(link, time.Now().Add(time.Hour))
+	if got, err := sls.ByVisitToken(token); err != nil || got.ID != link.ID {
+		t.Fatalf("Expected link %d. Recieved %v, %v", link.ID, got, err)
+	}
+
+	cases := map[string]string{
+		"expired":  sls.VisitToken(link, time.Now().Add(-time.Second)),
+		"tampered": "8" + token[1:],
+		"raw":      "not-a-visit-token",
+	}
+	for name, token := range cases {
+		if _, err := sls.ByVisitToken(token); err != ErrShareLinkInvalid {
+			t.Errorf("Expected ErrShareLinkInvalid for a %s token. Recieved %v", name, err)
+		}
+	}
+
+	now := time.Now()
+	link.RevokedAt = &now
+	if _, err := sls.ByVisitToken(token); err != ErrShareLinkInvalid {
+		t.Errorf("Expected ErrShareLinkInvalid once revoked. Recieved %v", err)
+	}
+}
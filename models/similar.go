@@ -0,0 +1,94 @@
+package models
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math/bits"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+)
+
+// SimilarDistance is how many of the 64 bits of two perceptual hashes
+// may differ for the images to count as similar. Shots from a burst
+// and lightly edited copies are usually well within it.
+const SimilarDistance = 10
+
+// perceptualHash returns the difference hash, or dHash, of src as 16
+// hex digits. The image is shrunk to 9x8 grey pixels and each bit
+// records whether a pixel is brighter than its right hand neighbour,
+// so the hash survives resizing, recompression and small edits.
+func perceptualHash(src image.Image) string {
+	small := imaging.Resize(src, 9, 8, imaging.Box)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := color.GrayModel.Convert(small.At(x, y)).(color.Gray)
+			right := color.GrayModel.Convert(small.At(x+1, y)).(color.Gray)
+			hash <<= 1
+			if left.Y > right.Y {
+				hash |= 1
+			}
+		}
+	}
+	return fmt.Sprintf("%016x", hash)
+}
+
+// hashDistance is the number of bits that differ between two hashes
+// returned by perceptualHash. ok is false if either is missing.
+func hashDistance(a, b string) (distance int, ok bool) {
+	x, err := strconv.ParseUint(a, 16, 64)
+	if err != nil {
+		return 0, false
+	}
+	y, err := strconv.ParseUint(b, 16, 64)
+	if err != nil {
+		return 0, false
+	}
+	return bits.OnesCount64(x ^ y), true
+}
+
+// SimilarGroups groups images that look alike, ie whose perceptual
+// hashes are within SimilarDistance of each other, directly or through
+// other images in the group. Only groups of two or more are returned,
+// with images in the order they were given.
+func SimilarGroups(images []Image) [][]Image {
+	// Union find over every pair, which is fine for gallery sized sets
+	parent := make([]int, len(images))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range images {
+		for j := i + 1; j < len(images); j++ {
+			d, ok := hashDistance(images[i].PHash, images[j].PHash)
+			if ok && d <= SimilarDistance {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+
+	byRoot := make(map[int][]Image)
+	var roots []int
+	for i := range images {
+		root := find(i)
+		if _, ok := byRoot[root]; !ok {
+			roots = append(roots, root)
+		}
+		byRoot[root] = append(byRoot[root], images[i])
+	}
+	var groups [][]Image
+	for _, root := range roots {
+		if len(byRoot[root]) > 1 {
+			groups = append(groups, byRoot[root])
+		}
+	}
+	return groups
+}
@@ -0,0 +1,71 @@
+package models
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// gradient is a test image getting brighter from left to right, or
+// darker when reversed
+func gradient(w, h int, reversed bool) image.Image {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		v := uint8(x * 255 / w)
+		if reversed {
+			v = 255 - v
+		}
+		for y := 0; y < h; y++ {
+			img.SetGray(x, y, color.Gray{Y: v})
+		}
+	}
+	return img
+}
+
+func TestPerceptualHash(t *testing.T) {
+	src := gradient(640, 480, false)
+	resized := imaging.Resize(src, 200, 0, imaging.Lanczos)
+	brighter := imaging.AdjustBrightness(src, 10)
+	other := gradient(640, 480, true)
+
+	h := perceptualHash(src)
+	if len(h) != 16 {
+		t.Fatalf("Expected 16 hex digits. Recieved %q", h)
+	}
+	for name, img := range map[string]image.Image{"resized": resized, "brighter": brighter} {
+		d, ok := hashDistance(h, perceptualHash(img))
+		if !ok || d > SimilarDistance {
+			t.Errorf("Expected %s copy to be similar. Recieved distance %d", name, d)
+		}
+	}
+	d, _ := hashDistance(h, perceptualHash(other))
+	if d <= SimilarDistance {
+		t.Errorf("Expected reversed gradient to differ. Recieved distance %d", d)
+	}
+	if _, ok := hashDistance(h, ""); ok {
+		t.Error("Expected images without a hash to never be similar")
+	}
+}
+
+func TestSimilarGroups(t *testing.T) {
+	images := []Image{
+		{Filename: "a.jpg", PHash: "ff00ff00ff00ff00"},
+		{Filename: "b.jpg", PHash: "00ff00ff00ff00ff"},
+		{Filename: "c.jpg", PHash: "ff00ff00ff00ff0f"},
+		{Filename: "d.jpg"},
+		{Filename: "e.jpg", PHash: "ff00ff00ff00f0ff"},
+	}
+	groups := SimilarGroups(images)
+	if len(groups) != 1 {
+		t.Fatalf("Expected 1 group. Recieved %d", len(groups))
+	}
+	var names []string
+	for _, img := range groups[0] {
+		names = append(names, img.Filename)
+	}
+	if len(names) != 3 || names[0] != "a.jpg" || names[1] != "c.jpg" || names[2] != "e.jpg" {
+		t.Errorf("Expected a.jpg, c.jpg and e.jpg. Recieved %v", names)
+	}
+}
@@ -0,0 +1,100 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/imattf/go-courses/gallery/storage"
+)
+
+// TrashRetention is how long deleted galleries and images are kept in
+// the trash, where they can still be restored, before they are purged
+const TrashRetention = 30 * 24 * time.Hour
+
+// trashKey is where the file of the image stored under key is moved
+// to while the image is in the trash. The image ID keeps images
+// deleted under the same filename apart. Files in the trash are never
+// served.
+func trashKey(i *Image, key string) string {
+	return fmt.Sprintf("%v%v/%v", galleryTrashPrefix(i.GalleryID), i.ID, key)
+}
+
+// galleryTrashPrefix is the prefix of every trashKey in the gallery
+func galleryTrashPrefix(galleryID uint) string {
+	return fmt.Sprintf("trash/%v/", galleryID)
+}
+
+// fileKeys lists every key a file of the image could be stored under
+func (i *Image) fileKeys() []string {
+	return append([]string{i.OriginalKey(), i.Key()}, i.renditionKeys()...)
+}
+
+func (is *imageService) Restore(i *Image) error {
+	from := i.fileKeys()
+	var err error
+	i.Position, err = is.nextPosition(i.GalleryID)
+	if err != nil {
+		return err
+	}
+	err = is.claimFilename(i, is.ImageDB.Restore)
+	if err != nil {
+		return err
+	}
+	// The keys line up with the old ones, only the filename in them
+	// changes if the image had to be renamed
+	for n, key := range i.fileKeys() {
+		if err := is.moveFile(trashKey(i, from[n]), key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (is *imageService) Purge(i *Image) error {
+	for _, key := range i.fileKeys() {
+		if err := is.store.Delete(trashKey(i, key)); err != nil {
+			return err
+		}
+	}
+	return is.ImageDB.Purge(i.ID)
+}
+
+func (is *imageService) RestoreGallery(galleryID uint, since time.Time) error {
+	return is.ImageDB.RestoreByGalleryID(galleryID, since)
+}
+
+func (is *imageService) PurgeDeleted(t time.Time) (int, error) {
+	images, err := is.ImageDB.DeletedBefore(t)
+	if err != nil {
+		return 0, err
+	}
+	for n := range images {
+		if err := is.Purge(&images[n]); err != nil {
+			return n, err
+		}
+	}
+	return len(images), nil
+}
+
+// moveFile moves the file stored under from to the key to. Files
+// that don't exist, eg renditions that were never generated, are
+// skipped.
+func (is *imageService) moveFile(from, to string) error {
+	info, err := is.store.Stat(from)
+	if err == storage.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	rc, err := is.store.Get(from)
+	if err != nil {
+		return err
+	}
+	err = is.store.Put(to, info.ContentType, rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	return is.store.Delete(from)
+}
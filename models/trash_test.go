@@ -0,0 +1,51 @@
+package models
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestRestoreSameFilename(t *testing.T) {
+	gallery := Gallery{UserID: 7}
+	gallery.ID = 1
+	is, records := testingImageService(t, gallery)
+
+	files := [][]byte{pngFile(t, 64, 48, false), pngFile(t, 64, 48, true)}
+	var images []*Image
+	for _, data := range files {
+		image := &Image{GalleryID: 1, UserID: 7, Filename: "beach.png"}
+		if err := is.Create(image, io.NopCloser(bytes.NewReader(data))); err != nil {
+			t.Fatal(err)
+		}
+		if err := is.Delete(image); err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, image)
+	}
+
+	for n, want := range []string{"beach.png", "beach-1.png"} {
+		image, err := records.DeletedByID(images[n].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := is.Restore(image); err != nil {
+			t.Fatal(err)
+		}
+		if image.Filename != want {
+			t.Errorf("Expected image %d to be restored as %s. Recieved %s", n, want, image.Filename)
+		}
+		rc, err := is.Original(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		if !bytes.Equal(data, files[n]) {
+			t.Errorf("Expected image %d to get its own file back", n)
+		}
+	}
+	if keys, _ := is.store.List("trash/"); len(keys) != 0 {
+		t.Errorf("Expected the trash to be empty. Recieved %v", keys)
+	}
+}
@@ -0,0 +1,308 @@
+package models
+
+import (
+	"crypto/hmac"
+	"encoding/base32"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/imattf/go-courses/gallery/hash"
+	"github.com/imattf/go-courses/gallery/rand"
+	"github.com/imattf/go-courses/gallery/totp"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// RecoveryCodeCount is how many recovery codes users get when
+	// they turn on two-factor authentication
+	RecoveryCodeCount = 10
+
+	// maxTOTPFailures wrong codes in a row lock the second sign in
+	// step for totpLockout, so codes can't be guessed
+	maxTOTPFailures = 5
+	totpLockout     = 15 * time.Minute
+)
+
+// TOTPEnabled reports whether the user signs in with a code from an
+// authenticator app as well as their password
+func (u *User) TOTPEnabled() bool {
+	return u.TOTPEnabledAt != nil
+}
+
+func (us *userService) EnrollTOTP(user *User) (string, error) {
+	if user.TOTPEnabled() {
+		return "", ErrTOTPEnabled
+	}
+	if user.TOTPSecretEncrypted != "" {
+		return us.TOTPSecret(user)
+	}
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return "", err
+	}
+	user.TOTPSecret = secret
+	if err := us.Update(user); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+func (us *userService) TOTPSecret(user *User) (string, error) {
+	if user.TOTPSecretEncrypted == "" {
+		return "", ErrTOTPNotEnrolled
+	}
+	return us.cipher.Decrypt(user.TOTPSecretEncrypted)
+}
+
+func (us *userService) EnableTOTP(user *User, code string) ([]string, error) {
+	if user.TOTPEnabled() {
+		return nil, ErrTOTPEnabled
+	}
+	secret, err := us.TOTPSecret(user)
+	if err != nil {
+		return nil, err
+	}
+	counter, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return nil, ErrTOTPCodeInvalid
+	}
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := us.recoveryCodeDB.Replace(user.ID, codes); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	user.TOTPEnabledAt = &now
+	user.TOTPCounter = counter
+	if err := us.Update(user); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (us *userService) VerifyTOTP(user *User, code string) error {
+	if !user.TOTPEnabled() {
+		return ErrTOTPNotEnrolled
+	}
+	now := time.Now()
+	if user.TOTPLockedUntil != nil && now.Before(*user.TOTPLockedUntil) {
+		return ErrTOTPLocked
+	}
+	secret, err := us.TOTPSecret(user)
+	if err != nil {
+		return err
+	}
+	counter, ok := totp.Validate(secret, code, now)
+	if ok && counter > user.TOTPCounter {
+		user.TOTPCounter = counter
+		return us.totpSucceeded(user)
+	}
+	if !ok {
+		err := us.recoveryCodeDB.Use(user.ID, code)
+		if err == nil {
+			return us.totpSucceeded(user)
+		}
+		if err != ErrNotFound {
+			return err
+		}
+	}
+
+	// Wrong codes and codes that were already used both count
+	user.TOTPFailures++
+	if user.TOTPFailures >= maxTOTPFailures {
+		until := now.Add(totpLockout)
+		user.TOTPLockedUntil = &until
+		user.TOTPFailures = 0
+	}
+	if err := us.Update(user); err != nil {
+		return err
+	}
+	return ErrTOTPCodeInvalid
+}
+
+func (us *userService) totpSucceeded(user *User) error {
+	user.TOTPFailures = 0
+	user.TOTPLockedUntil = nil
+	return us.Update(user)
+}
+
+func (us *userService) DisableTOTP(user *User, password string) error {
+	if _, err := us.Authenticate(user.Email, password); err != nil {
+		return err
+	}
+	user.TOTPSecretEncrypted = ""
+	user.TOTPEnabledAt = nil
+	user.TOTPCounter = 0
+	user.TOTPFailures = 0
+	user.TOTPLockedUntil = nil
+	if err := us.Update(user); err != nil {
+		return err
+	}
+	return us.recoveryCodeDB.DeleteByUserID(user.ID)
+}
+
+// Login tokens are "<user id>.<expires unix time>.<signature>". Like
+// unlock tokens the signature covers the password hash, so changing
+// the password invalidates them.
+func (us *userService) LoginToken(user *User, expires time.Time) string {
+	id := strconv.FormatUint(uint64(user.ID), 10)
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return id + "." + exp + "." + us.loginSignature(user, exp)
+}
+
+func (us *userService) ByLoginToken(token string) (*User, error) {
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 {
+		return nil, ErrTokenInvalid
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() >= exp {
+		return nil, ErrTokenInvalid
+	}
+	user, err := us.ByID(uint(id))
+	if err == ErrNotFound {
+		return nil, ErrTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	want := us.loginSignature(user, parts[1])
+	if !hmac.Equal([]byte(parts[2]), []byte(want)) {
+		return nil, ErrTokenInvalid
+	}
+	return user, nil
+}
+
+func (us *userService) loginSignature(user *User, exp string) string {
+	return us.hmac.Hash(fmt.Sprintf("login:%d:%s:%s", user.ID, exp, user.PasswordHash))
+}
+
+// newRecoveryCodes returns RecoveryCodeCount random codes formatted
+// like "abcde-fghij", which is easier to copy than one long string
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		b, err := rand.Bytes(7)
+		if err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:10]
+		codes[i] = s[:5] + "-" + s[5:]
+	}
+	return codes, nil
+}
+
+// recoveryCode is a single use code that signs a user in instead of
+// a code from their authenticator app, eg after losing their phone.
+// Only a hash of the code is stored.
+type recoveryCode struct {
+	gorm.Model
+	UserID   uint   `gorm:"not null;index"`
+	CodeHash string `gorm:"not null;unique_index"`
+}
+
+type recoveryCodeDB interface {
+	// Replace stores codes as the user's recovery codes, in place of
+	// any they had before
+	Replace(userID uint, codes []string) error
+
+	// Use deletes the user's recovery code matching code, returning
+	// ErrNotFound if none does
+	Use(userID uint, code string) error
+
+	DeleteByUserID(userID uint) error
+}
+
+func newRecoveryCodeValidator(db recoveryCodeDB, hmac hash.HMAC) *recoveryCodeValidator {
+	return &recoveryCodeValidator{
+		recoveryCodeDB: db,
+		hmac:           hmac,
+	}
+}
+
+// recoveryCodeValidator hashes the codes on their way to the
+// database, the layer below only ever sees hashes
+type recoveryCodeValidator struct {
+	recoveryCodeDB
+	hmac hash.HMAC
+}
+
+func (rcv *recoveryCodeValidator) Replace(userID uint, codes []string) error {
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = rcv.hashCode(code)
+	}
+	return rcv.recoveryCodeDB.Replace(userID, hashes)
+}
+
+func (rcv *recoveryCodeValidator) Use(userID uint, code string) error {
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+	return rcv.recoveryCodeDB.Use(userID, rcv.hashCode(code))
+}
+
+func (rcv *recoveryCodeValidator) DeleteByUserID(userID uint) error {
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+	return rcv.recoveryCodeDB.DeleteByUserID(userID)
+}
+
+// hashCode ignores case, spaces and dashes, which are easily mistyped
+func (rcv *recoveryCodeValidator) hashCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return rcv.hmac.Hash(code)
+}
+
+type recoveryCodeGorm struct {
+	db *gorm.DB
+}
+
+func (rcg *recoveryCodeGorm) Replace(userID uint, hashes []string) error {
+	tx := rcg.db.Begin()
+	err := tx.Unscoped().Where("user_id = ?", userID).Delete(&recoveryCode{}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, h := range hashes {
+		err := tx.Create(&recoveryCode{UserID: userID, CodeHash: h}).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+func (rcg *recoveryCodeGorm) Use(userID uint, codeHash string) error {
+	// Deleting and checking a row went means two requests can't both
+	// use the same code
+	db := rcg.db.Unscoped().
+		Where("user_id = ? AND code_hash = ?", userID, codeHash).
+		Delete(&recoveryCode{})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (rcg *recoveryCodeGorm) DeleteByUserID(userID uint) error {
+	return rcg.db.Unscoped().Where("user_id = ?", userID).Delete(&recoveryCode{}).Error
+}
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// unlockAttempt counts the passwords one client tried on a gallery,
+// so a client guessing the password only locks itself out. Client is
+// a hash of the client's IP address.
+type unlockAttempt struct {
+	GalleryID   uint   `gorm:"primary_key;auto_increment:false"`
+	Client      string `gorm:"primary_key"`
+	Failures    int    `gorm:"not null"`
+	LockedUntil *time.Time
+	UpdatedAt   time.Time
+}
+
+// Locked reports whether the client is locked out at time now
+func (ua *unlockAttempt) Locked(now time.Time) bool {
+	return ua.LockedUntil != nil && now.Before(*ua.LockedUntil)
+}
+
+type unlockAttemptDB interface {
+	// Count records an attempt by client on the gallery at time now
+	// and returns the attempts counted so far. The count starts over
+	// once the client made none for galleryLockout.
+	Count(galleryID uint, client string, now time.Time) (*unlockAttempt, error)
+
+	// Lock locks the client out until the time given, and starts the
+	// count over
+	Lock(attempt *unlockAttempt, until time.Time) error
+
+	// Delete forgets the client's attempts, eg once it entered the
+	// right password
+	Delete(galleryID uint, client string) error
+}
+
+type unlockAttemptGorm struct {
+	db *gorm.DB
+}
+
+// Compiler check to make sure unlockAttemptGorm implements unlockAttemptDB
+var _ unlockAttemptDB = &unlockAttemptGorm{}
+
+func (uag *unlockAttemptGorm) Count(galleryID uint, client string, now time.Time) (*unlockAttempt, error) {
+	// Counting in a single statement keeps attempts made at the same
+	// time from being counted once
+	var attempt unlockAttempt
+	err := uag.db.Raw(`INSERT INTO unlock_attempts (gallery_id, client, failures, updated_at)
+		VALUES (?, ?, 1, ?)
+		ON CONFLICT (gallery_id, client) DO UPDATE SET
+			failures = CASE WHEN unlock_attempts.updated_at < ? THEN 1 ELSE unlock_attempts.failures + 1 END,
+			updated_at = excluded.updated_at
+		RETURNING *`, galleryID, client, now, now.Add(-galleryLockout)).Scan(&attempt).Error
+	if err != nil {
+		return nil, err
+	}
+	return &attempt, nil
+}
+
+func (uag *unlockAttemptGorm) Lock(attempt *unlockAttempt, until time.Time) error {
+	attempt.Failures = 0
+	attempt.LockedUntil = &until
+	return uag.db.Model(&unlockAttempt{}).
+		Where("gallery_id = ? AND client = ?", attempt.GalleryID, attempt.Client).
+		UpdateColumns(map[string]interface{}{
+			"failures":     0,
+			"locked_until": until,
+		}).Error
+}
+
+func (uag *unlockAttemptGorm) Delete(galleryID uint, client string) error {
+	return uag.db.Where("gallery_id = ? AND client = ?", galleryID, client).Delete(&unlockAttempt{}).Error
+}
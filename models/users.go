@@ -5,8 +5,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/imattf/go-courses/gallery/encrypt"
 	"github.com/imattf/go-courses/gallery/hash"
-	"github.com/imattf/go-courses/gallery/rand"
 
 	"github.com/jinzhu/gorm"
 	"golang.org/x/crypto/bcrypt"
@@ -21,8 +21,32 @@ type User struct {
 	Email        string `gorm:"not null;unique_index"`
 	Password     string `gorm:"-"`
 	PasswordHash string `gorm:"not null"`
-	Remember     string `gorm:"-"`
-	RememberHash string `gorm:"not null;unique_index"`
+
+	// VerifiedAt is when the user proved they own Email, it is
+	// cleared again when Email changes
+	VerifiedAt *time.Time
+
+	// TOTPSecret is only set while enrolling in two-factor
+	// authentication, the database holds it encrypted in
+	// TOTPSecretEncrypted. See UserService.EnrollTOTP.
+	TOTPSecret          string `gorm:"-"`
+	TOTPSecretEncrypted string
+	TOTPEnabledAt       *time.Time
+
+	// TOTPCounter is the period of the last code used to sign in, so
+	// each code only works once
+	TOTPCounter int64
+
+	// TOTPFailures counts wrong codes in a row, after too many the
+	// second sign in step is locked until TOTPLockedUntil
+	TOTPFailures    int
+	TOTPLockedUntil *time.Time
+}
+
+// Verified reports whether the user proved they own their email
+// address
+func (u *User) Verified() bool {
+	return u.VerifiedAt != nil
 }
 
 // UserDB interface is used for interacting with the users database.
@@ -40,7 +64,6 @@ type UserDB interface {
 	// Methods for querying for single users
 	ByID(id uint) (*User, error)
 	ByEmail(id string) (*User, error)
-	ByRemember(token string) (*User, error)
 
 	// Methods for altering users
 	Create(user *User) error
@@ -63,17 +86,65 @@ type UserService interface {
 
 	// CompleteReset(...)(...)
 	CompleteReset(token, newPw string) (*User, error)
+
+	// InitiateVerification creates a token to email to the user, which
+	// proves they own their email address when CompleteVerification
+	// is called with it
+	InitiateVerification(user *User) (string, error)
+
+	// CompleteVerification marks the user the token was sent to as
+	// verified. Tokens stop working after EmailVerificationExpiry, or
+	// once the user changes their email address.
+	CompleteVerification(token string) (*User, error)
+
+	// EnrollTOTP starts setting up two-factor authentication by
+	// storing a new secret for the user, which is returned to be
+	// shown as a QR code. Signing in doesn't need a code until
+	// EnableTOTP is called with one generated from the secret. Until
+	// then the same secret is returned again, so reloading the page
+	// or opening it twice doesn't change the QR code being scanned.
+	EnrollTOTP(user *User) (string, error)
+
+	// TOTPSecret decrypts the secret stored by EnrollTOTP
+	TOTPSecret(user *User) (string, error)
+
+	// EnableTOTP turns on two-factor authentication once code shows
+	// the user's authenticator app has the secret. It returns their
+	// recovery codes, which are only ever shown this once.
+	EnableTOTP(user *User, code string) ([]string, error)
+
+	// VerifyTOTP checks a code from the user's authenticator app, or
+	// one of their recovery codes, when they sign in. Each code only
+	// works once. Too many wrong codes and the user is locked out for
+	// a while with ErrTOTPLocked.
+	VerifyTOTP(user *User, code string) error
+
+	// DisableTOTP turns two-factor authentication off and deletes the
+	// recovery codes, after checking the user's current password.
+	DisableTOTP(user *User, password string) error
+
+	// LoginToken returns a signed token for a user who entered their
+	// password, but still has to enter a two-factor code, that is
+	// valid until expires. ByLoginToken returns the user it is for,
+	// or ErrTokenInvalid.
+	LoginToken(user *User, expires time.Time) string
+	ByLoginToken(token string) (*User, error)
 	UserDB
 }
 
-func NewUserService(db *gorm.DB, pepper, hmacKey string) UserService {
+func NewUserService(db *gorm.DB, pepper, hmacKey, encryptionKey string) UserService {
 	ug := &userGorm{db}
 	hmac := hash.NewHMAC(hmacKey)
-	uv := newUserValidator(ug, hmac, pepper)
+	cipher := encrypt.NewCipher(encryptionKey)
+	uv := newUserValidator(ug, hmac, cipher, pepper)
 	return &userService{
-		UserDB:    uv,
-		pepper:    pepper,
-		pwResetDB: newPwResetValidator(&pwResetGorm{db}, hmac),
+		UserDB:         uv,
+		pepper:         pepper,
+		hmac:           hmac,
+		cipher:         cipher,
+		pwResetDB:      newPwResetValidator(&pwResetGorm{db}, hmac),
+		verificationDB: newEmailVerificationValidator(&emailVerificationGorm{db}, hmac),
+		recoveryCodeDB: newRecoveryCodeValidator(&recoveryCodeGorm{db}, hmac),
 	}
 }
 
@@ -82,8 +153,12 @@ var _ UserService = &userService{}
 
 type userService struct {
 	UserDB
-	pepper    string
-	pwResetDB pwResetDB
+	pepper         string
+	hmac           hash.HMAC
+	cipher         encrypt.Cipher
+	pwResetDB      pwResetDB
+	verificationDB emailVerificationDB
+	recoveryCodeDB recoveryCodeDB
 }
 
 // Authenticates a user login request
@@ -153,6 +228,50 @@ func (us *userService) CompleteReset(token, newPw string) (*User, error) {
 	return user, nil
 }
 
+func (us *userService) InitiateVerification(user *User) (string, error) {
+	if user.Verified() {
+		return "", ErrEmailVerified
+	}
+	ev := emailVerification{
+		UserID: user.ID,
+		Email:  user.Email,
+	}
+	if err := us.verificationDB.Create(&ev); err != nil {
+		return "", err
+	}
+	return ev.Token, nil
+}
+
+func (us *userService) CompleteVerification(token string) (*User, error) {
+	ev, err := us.verificationDB.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+	if time.Now().Sub(ev.CreatedAt) > EmailVerificationExpiry {
+		return nil, ErrTokenInvalid
+	}
+	user, err := us.ByID(ev.UserID)
+	if err != nil {
+		return nil, err
+	}
+	// The link was sent to an address the user no longer has
+	if user.Email != ev.Email {
+		return nil, ErrTokenInvalid
+	}
+	if !user.Verified() {
+		now := time.Now()
+		user.VerifiedAt = &now
+		if err := us.Update(user); err != nil {
+			return nil, err
+		}
+	}
+	us.verificationDB.DeleteByUserID(user.ID)
+	return user, nil
+}
+
 type userValFunc func(*User) error
 
 func runUserValFuncs(user *User, fns ...userValFunc) error {
@@ -167,10 +286,11 @@ func runUserValFuncs(user *User, fns ...userValFunc) error {
 // Compiler check to make sure userValidator implements UserDB
 var _ UserDB = &userValidator{}
 
-func newUserValidator(udb UserDB, hmac hash.HMAC, pepper string) *userValidator {
+func newUserValidator(udb UserDB, hmac hash.HMAC, cipher encrypt.Cipher, pepper string) *userValidator {
 	return &userValidator{
 		UserDB:     udb,
 		hmac:       hmac,
+		cipher:     cipher,
 		emailRegex: regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
 		pepper:     pepper,
 	}
@@ -179,6 +299,7 @@ func newUserValidator(udb UserDB, hmac hash.HMAC, pepper string) *userValidator
 type userValidator struct {
 	UserDB
 	hmac       hash.HMAC
+	cipher     encrypt.Cipher
 	emailRegex *regexp.Regexp
 	pepper     string
 }
@@ -195,18 +316,6 @@ func (uv *userValidator) ByEmail(email string) (*User, error) {
 	return uv.UserDB.ByEmail(user.Email)
 }
 
-// ByRemember will hash the remember token and then call
-// ByRemember on the subsequent UserDB layer.
-func (uv *userValidator) ByRemember(token string) (*User, error) {
-	user := User{
-		Remember: token,
-	}
-	if err := runUserValFuncs(&user, uv.hmacRemember); err != nil {
-		return nil, err
-	}
-	return uv.UserDB.ByRemember(user.RememberHash)
-}
-
 //Creates a user in the database and will backfill
 // related meta-data like ID, CreatedAt...
 func (uv *userValidator) Create(user *User) error {
@@ -215,10 +324,6 @@ func (uv *userValidator) Create(user *User) error {
 		uv.passwordMinLength,
 		uv.bcryptPassword,
 		uv.passwordHashRequired,
-		uv.setRememberIfUnset,
-		uv.rememberMinBytes,
-		uv.hmacRemember,
-		uv.rememberHashRequired,
 		uv.normalizeEmail,
 		uv.requireEmail,
 		uv.emailFormat,
@@ -229,19 +334,19 @@ func (uv *userValidator) Create(user *User) error {
 	return uv.UserDB.Create(user)
 }
 
-// Update will hash a remember token if it is provided.
+// Update will hash the password and encrypt the TOTP secret if
+// they are provided.
 func (uv *userValidator) Update(user *User) error {
 	err := runUserValFuncs(user,
 		uv.passwordMinLength,
 		uv.bcryptPassword,
 		uv.passwordHashRequired,
-		uv.rememberMinBytes,
-		uv.hmacRemember,
-		uv.rememberHashRequired,
+		uv.encryptTOTPSecret,
 		uv.normalizeEmail,
 		uv.requireEmail,
 		uv.emailFormat,
-		uv.emailIsAvail)
+		uv.emailIsAvail,
+		uv.unverifyChangedEmail)
 	if err != nil {
 		return err
 	}
@@ -275,45 +380,19 @@ func (uv *userValidator) bcryptPassword(user *User) error {
 	return nil
 }
 
-// uv method hmac
-func (uv *userValidator) hmacRemember(user *User) error {
-	if user.Remember == "" {
-		return nil
-	}
-	user.RememberHash = uv.hmac.Hash(user.Remember)
-	return nil
-}
-
-func (uv *userValidator) setRememberIfUnset(user *User) error {
-	if user.Remember != "" {
+// encryptTOTPSecret encrypts the TOTP secret into
+// TOTPSecretEncrypted if it is set, like bcryptPassword does for the
+// password, except the secret has to be readable again.
+func (uv *userValidator) encryptTOTPSecret(user *User) error {
+	if user.TOTPSecret == "" {
 		return nil
 	}
-	token, err := rand.RememberToken()
+	encrypted, err := uv.cipher.Encrypt(user.TOTPSecret)
 	if err != nil {
 		return err
 	}
-	user.Remember = token
-	return nil
-}
-
-func (uv *userValidator) rememberMinBytes(user *User) error {
-	if user.Remember == "" {
-		return nil
-	}
-	n, err := rand.NBytes(user.Remember)
-	if err != nil {
-		return err
-	}
-	if n < 32 {
-		return ErrRememberTooShort
-	}
-	return nil
-}
-
-func (uv *userValidator) rememberHashRequired(user *User) error {
-	if user.RememberHash == "" {
-		return ErrRememberRequired
-	}
+	user.TOTPSecretEncrypted = encrypted
+	user.TOTPSecret = ""
 	return nil
 }
 
@@ -367,6 +446,22 @@ func (uv *userValidator) emailIsAvail(user *User) error {
 	return nil
 }
 
+// unverifyChangedEmail clears VerifiedAt when the email address is
+// changed, the new one has to be verified again
+func (uv *userValidator) unverifyChangedEmail(user *User) error {
+	if user.VerifiedAt == nil {
+		return nil
+	}
+	existing, err := uv.UserDB.ByID(user.ID)
+	if err != nil {
+		return err
+	}
+	if existing.Email != user.Email {
+		user.VerifiedAt = nil
+	}
+	return nil
+}
+
 func (uv *userValidator) passwordMinLength(user *User) error {
 	if user.Password == "" {
 		return nil
@@ -428,21 +523,6 @@ func (ug *userGorm) ByEmail(email string) (*User, error) {
 	return &user, err
 }
 
-// ByRemember looks up a user with a given remember token and returns
-// that user. The method expects the remember token to already be hashed.
-// Errors are the same as ByEmail.
-func (ug *userGorm) ByRemember(rememberHash string) (*User, error) {
-	var user User
-	//maybe here
-	// db := ug.db.Where("remember_hash = ?", rememberHash)
-	// err := first(db, &user)
-	err := first(ug.db.Where("remember_hash = ?", rememberHash), &user)
-	if err != nil {
-		return nil, err
-	}
-	return &user, err
-}
-
 // // Lookup a users by Age Range in the database
 // func (ug *userGorm) InAgeRange(minAge, maxAge uint) ([]User, error) {
 // 	var users []User
@@ -2,11 +2,12 @@ package models
 
 import (
   "fmt"
+  "os"
   "testing"
   "time"
 )
 
-func testingUserService() (*UserService, error) {
+func testingUserService() (UserService, error) {
   const (
   	host   = "localhost"
   	port   = 5432
@@ -15,18 +16,24 @@ func testingUserService() (*UserService, error) {
   )
   psqlInfo := fmt.Sprintf("host=%s port=%d user=%s dbname=%s sslmode=disable",
     host, port, user, dbname)
-  us, err := NewUserService(psqlInfo)
+  services, err := NewServices(
+    WithGorm("postgres", psqlInfo),
+    // Toggle logging
+    WithLogMode(false),
+    WithUser("test-pepper", "test-hmac-key", "test-encryption-key"),
+  )
   if err != nil {
     return nil, err
   }
-  // Toggle logging
-  us.db.LogMode(false)
   //Clear user table between tests
-  us.DestructiveReset()
-  return us, nil
+  services.DestructiveReset()
+  return services.User, nil
 }
 
 func TestCreateUser(t *testing.T) {
+  if os.Getenv("GALLERY_TEST_DB") == "" {
+    t.Skip("Set GALLERY_TEST_DB=1 to run tests against the lenslocked_test database")
+  }
   us, err := testingUserService()
   if err != nil {
     t.Fatal(err)
@@ -0,0 +1,602 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/imattf/go-courses/gallery/encrypt"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// webAuthnDisplayName is the site name browsers show when asking
+	// to create or use a passkey
+	webAuthnDisplayName = "Gallery"
+
+	// webAuthnTimeout is how long users have to respond to the
+	// browser's passkey prompt
+	webAuthnTimeout = 5 * time.Minute
+
+	// maxPasskeyNameLength is the longest name a passkey can be given
+	maxPasskeyNameLength = 100
+
+	ceremonyRegistration = "registration"
+	ceremonyLogin        = "login"
+)
+
+// WebAuthnCredential is a passkey or security key the user registered
+// with their browser. Only the public key is stored, the private key
+// never leaves the authenticator.
+type WebAuthnCredential struct {
+	gorm.Model
+	UserID uint   `gorm:"not null;index"`
+	Name   string `gorm:"not null"`
+
+	// CredentialID is the ID the authenticator chose, base64 URL
+	// encoded
+	CredentialID    string `gorm:"not null;unique_index"`
+	PublicKey       []byte `gorm:"not null"`
+	AttestationType string
+	AAGUID          []byte
+
+	// Transports lists how the browser can reach the authenticator,
+	// eg "internal,hybrid"
+	Transports string
+
+	// SignCount goes up every time an authenticator that keeps a
+	// counter is used. One going backwards was probably cloned.
+	SignCount uint32
+
+	// BackupEligible is set for passkeys that can sync between
+	// devices, BackupState once they have
+	BackupEligible bool
+	BackupState    bool
+	LastUsedAt     *time.Time
+}
+
+// webAuthnCredential is c the way the webauthn package expects it
+func (c *WebAuthnCredential) webAuthnCredential() webauthn.Credential {
+	id, _ := base64.RawURLEncoding.DecodeString(c.CredentialID)
+	var transports []protocol.AuthenticatorTransport
+	for _, t := range strings.Split(c.Transports, ",") {
+		if t != "" {
+			transports = append(transports, protocol.AuthenticatorTransport(t))
+		}
+	}
+	return webauthn.Credential{
+		ID:              id,
+		PublicKey:       c.PublicKey,
+		AttestationType: c.AttestationType,
+		Transport:       transports,
+		Flags: webauthn.CredentialFlags{
+			BackupEligible: c.BackupEligible,
+			BackupState:    c.BackupState,
+		},
+		Authenticator: webauthn.Authenticator{
+			AAGUID:    c.AAGUID,
+			SignCount: c.SignCount,
+		},
+	}
+}
+
+// webAuthnUser adapts a user and their credentials to the
+// webauthn.User interface
+type webAuthnUser struct {
+	*User
+	credentials []WebAuthnCredential
+}
+
+// WebAuthnID is the user handle authenticators store along with
+// passkeys, which is how a passkey login finds the user without an
+// email address. It is the user's ID, which doesn't change and
+// reveals nothing about them.
+func (u *webAuthnUser) WebAuthnID() []byte {
+	return webAuthnUserHandle(u.ID)
+}
+
+func (u *webAuthnUser) WebAuthnName() string {
+	return u.Email
+}
+
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	if u.Name != "" {
+		return u.Name
+	}
+	return u.Email
+}
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	creds := make([]webauthn.Credential, len(u.credentials))
+	for i := range u.credentials {
+		creds[i] = u.credentials[i].webAuthnCredential()
+	}
+	return creds
+}
+
+func webAuthnUserHandle(userID uint) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(userID))
+	return b
+}
+
+// webAuthnState is what has to be remembered between starting a
+// ceremony and the browser's response. It is handed to the caller
+// encrypted, so it can be kept on the client without being changed.
+type webAuthnState struct {
+	Ceremony string               `json:"ceremony"`
+	Session  webauthn.SessionData `json:"session"`
+}
+
+// webAuthnChallenge is a ceremony that was started and not finished
+// yet. The state handed out for it only works while its challenge is
+// stored, so each state can be used once.
+type webAuthnChallenge struct {
+	Challenge string    `gorm:"primary_key"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+type webAuthnChallengeDB interface {
+	// Create stores a challenge until it expires
+	Create(challenge *webAuthnChallenge) error
+
+	// Use deletes the challenge, returning ErrNotFound if it was
+	// already used or has expired
+	Use(challenge string) error
+}
+
+// passkeyError is returned when the browser's response to a passkey
+// ceremony doesn't check out. Users see ErrPasskeyInvalid, the logs
+// get the reason.
+type passkeyError struct {
+	err error
+}
+
+func (e passkeyError) Error() string {
+	msg := "models: passkey verification failed: " + e.err.Error()
+	if pErr, ok := e.err.(*protocol.Error); ok && pErr.DevInfo != "" {
+		msg += " (" + pErr.DevInfo + ")"
+	}
+	return msg
+}
+
+func (e passkeyError) Public() string {
+	return ErrPasskeyInvalid.Public()
+}
+
+// WebAuthnCredentialDB is used for interacting with the stored
+// passkeys
+type WebAuthnCredentialDB interface {
+	// ByUserID lists the user's passkeys, oldest first
+	ByUserID(userID uint) ([]WebAuthnCredential, error)
+
+	Create(cred *WebAuthnCredential) error
+	Update(cred *WebAuthnCredential) error
+	Delete(id uint) error
+}
+
+// WebAuthnService signs users in with passkeys, either instead of a
+// password or as a second factor after it.
+//
+// Both ceremonies happen in two steps. Begin returns the options to
+// pass to the browser's navigator.credentials API, and a state string
+// the caller must keep, eg in a cookie, until the browser responds.
+// Finish checks the browser's JSON response against that state.
+type WebAuthnService interface {
+	WebAuthnCredentialDB
+
+	BeginRegistration(user *User) (*protocol.CredentialCreation, string, error)
+
+	// FinishRegistration stores the new passkey under name
+	FinishRegistration(user *User, state, name string, response io.Reader) (*WebAuthnCredential, error)
+
+	// BeginLogin starts signing user in with one of their passkeys,
+	// which is the second factor after their password. With a nil
+	// user it starts a passwordless login with any passkey, which
+	// must verify the user, eg with a fingerprint or PIN, to count
+	// for both factors.
+	BeginLogin(user *User) (*protocol.CredentialAssertion, string, error)
+
+	// FinishLogin returns the user the passkey belongs to, which for
+	// a second factor is always user
+	FinishLogin(user *User, state string, response io.Reader) (*User, error)
+}
+
+// NewWebAuthnService creates a WebAuthnService for the site at rpID,
+// the domain passkeys are tied to, served from origins such as
+// "https://example.com".
+func NewWebAuthnService(db *gorm.DB, rpID string, origins []string, encryptionKey string) (WebAuthnService, error) {
+	ws, err := newWebAuthnService(&webAuthnCredentialGorm{db}, &userGorm{db}, &webAuthnChallengeGorm{db}, rpID, origins, encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return ws, nil
+}
+
+func newWebAuthnService(wdb WebAuthnCredentialDB, udb UserDB, cdb webAuthnChallengeDB, rpID string, origins []string, encryptionKey string) (*webAuthnService, error) {
+	wa, err := webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: webAuthnDisplayName,
+		RPOrigins:     origins,
+		Timeouts: webauthn.TimeoutsConfig{
+			Login: webauthn.TimeoutConfig{
+				Enforce:    true,
+				Timeout:    webAuthnTimeout,
+				TimeoutUVD: webAuthnTimeout,
+			},
+			Registration: webauthn.TimeoutConfig{
+				Enforce:    true,
+				Timeout:    webAuthnTimeout,
+				TimeoutUVD: webAuthnTimeout,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &webAuthnService{
+		WebAuthnCredentialDB: &webAuthnCredentialValidator{wdb},
+		userDB:               udb,
+		challengeDB:          cdb,
+		webauthn:             wa,
+		cipher:               encrypt.NewCipher(encryptionKey),
+	}, nil
+}
+
+// Compiler check to make sure webAuthnService implements WebAuthnService
+var _ WebAuthnService = &webAuthnService{}
+
+type webAuthnService struct {
+	WebAuthnCredentialDB
+	userDB      UserDB
+	challengeDB webAuthnChallengeDB
+	webauthn    *webauthn.WebAuthn
+	cipher      encrypt.Cipher
+}
+
+func (ws *webAuthnService) BeginRegistration(user *User) (*protocol.CredentialCreation, string, error) {
+	wu, err := ws.webAuthnUser(user)
+	if err != nil {
+		return nil, "", err
+	}
+	creation, session, err := ws.webauthn.BeginRegistration(wu,
+		// Passkeys that live on the authenticator can sign in without
+		// an email address
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+		// Stop the same authenticator being registered twice
+		webauthn.WithExclusions(webauthn.Credentials(wu.WebAuthnCredentials()).CredentialDescriptors()),
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	state, err := ws.encodeState(ceremonyRegistration, session)
+	if err != nil {
+		return nil, "", err
+	}
+	return creation, state, nil
+}
+
+func (ws *webAuthnService) FinishRegistration(user *User, state, name string, response io.Reader) (*WebAuthnCredential, error) {
+	session, err := ws.decodeState(ceremonyRegistration, state)
+	if err != nil {
+		return nil, err
+	}
+	wu, err := ws.webAuthnUser(user)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBody(response)
+	if err != nil {
+		return nil, passkeyError{err}
+	}
+	cred, err := ws.webauthn.CreateCredential(wu, *session, parsed)
+	if err != nil {
+		return nil, passkeyError{err}
+	}
+	transports := make([]string, len(cred.Transport))
+	for i, t := range cred.Transport {
+		transports[i] = string(t)
+	}
+	wc := WebAuthnCredential{
+		UserID:          user.ID,
+		Name:            name,
+		CredentialID:    base64.RawURLEncoding.EncodeToString(cred.ID),
+		PublicKey:       cred.PublicKey,
+		AttestationType: cred.AttestationType,
+		AAGUID:          cred.Authenticator.AAGUID,
+		Transports:      strings.Join(transports, ","),
+		SignCount:       cred.Authenticator.SignCount,
+		BackupEligible:  cred.Flags.BackupEligible,
+		BackupState:     cred.Flags.BackupState,
+	}
+	if err := ws.Create(&wc); err != nil {
+		return nil, err
+	}
+	return &wc, nil
+}
+
+func (ws *webAuthnService) BeginLogin(user *User) (*protocol.CredentialAssertion, string, error) {
+	var assertion *protocol.CredentialAssertion
+	var session *webauthn.SessionData
+	if user == nil {
+		var err error
+		assertion, session, err = ws.webauthn.BeginDiscoverableLogin(
+			webauthn.WithUserVerification(protocol.VerificationRequired))
+		if err != nil {
+			return nil, "", err
+		}
+	} else {
+		wu, err := ws.webAuthnUser(user)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(wu.credentials) == 0 {
+			return nil, "", ErrNotFound
+		}
+		assertion, session, err = ws.webauthn.BeginLogin(wu,
+			webauthn.WithUserVerification(protocol.VerificationDiscouraged))
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	state, err := ws.encodeState(ceremonyLogin, session)
+	if err != nil {
+		return nil, "", err
+	}
+	return assertion, state, nil
+}
+
+func (ws *webAuthnService) FinishLogin(user *User, state string, response io.Reader) (*User, error) {
+	session, err := ws.decodeState(ceremonyLogin, state)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(response)
+	if err != nil {
+		return nil, passkeyError{err}
+	}
+
+	var wu *webAuthnUser
+	var cred *webauthn.Credential
+	if user == nil {
+		var found webauthn.User
+		found, cred, err = ws.webauthn.ValidatePasskeyLogin(ws.discoverUser, *session, parsed)
+		if err == nil {
+			wu = found.(*webAuthnUser)
+		}
+	} else {
+		wu, err = ws.webAuthnUser(user)
+		if err != nil {
+			return nil, err
+		}
+		cred, err = ws.webauthn.ValidateLogin(wu, *session, parsed)
+	}
+	if err != nil {
+		return nil, passkeyError{err}
+	}
+	if cred.Authenticator.CloneWarning {
+		return nil, passkeyError{protocol.ErrBadRequest.WithDetails("Signature counter went backwards, the authenticator may be cloned")}
+	}
+
+	credentialID := base64.RawURLEncoding.EncodeToString(cred.ID)
+	for i := range wu.credentials {
+		wc := &wu.credentials[i]
+		if wc.CredentialID != credentialID {
+			continue
+		}
+		now := time.Now()
+		wc.SignCount = cred.Authenticator.SignCount
+		wc.BackupState = cred.Flags.BackupState
+		wc.LastUsedAt = &now
+		if err := ws.Update(wc); err != nil {
+			return nil, err
+		}
+	}
+	return wu.User, nil
+}
+
+// discoverUser finds the owner of a passkey from the user handle the
+// authenticator returned
+func (ws *webAuthnService) discoverUser(rawID, userHandle []byte) (webauthn.User, error) {
+	if len(userHandle) != 8 {
+		return nil, ErrNotFound
+	}
+	user, err := ws.userDB.ByID(uint(binary.BigEndian.Uint64(userHandle)))
+	if err != nil {
+		return nil, err
+	}
+	return ws.webAuthnUser(user)
+}
+
+func (ws *webAuthnService) webAuthnUser(user *User) (*webAuthnUser, error) {
+	creds, err := ws.ByUserID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &webAuthnUser{User: user, credentials: creds}, nil
+}
+
+func (ws *webAuthnService) encodeState(ceremony string, session *webauthn.SessionData) (string, error) {
+	expires := session.Expires
+	if expires.IsZero() {
+		expires = time.Now().Add(webAuthnTimeout)
+	}
+	err := ws.challengeDB.Create(&webAuthnChallenge{Challenge: session.Challenge, ExpiresAt: expires})
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(webAuthnState{Ceremony: ceremony, Session: *session})
+	if err != nil {
+		return "", err
+	}
+	return ws.cipher.Encrypt(string(b))
+}
+
+// decodeState returns the session of a state from encodeState, as
+// long as it was for the same kind of ceremony. The state is used up,
+// whether or not the ceremony then succeeds.
+func (ws *webAuthnService) decodeState(ceremony, state string) (*webauthn.SessionData, error) {
+	plain, err := ws.cipher.Decrypt(state)
+	if err != nil {
+		return nil, ErrPasskeyInvalid
+	}
+	var s webAuthnState
+	if err := json.Unmarshal([]byte(plain), &s); err != nil || s.Ceremony != ceremony {
+		return nil, ErrPasskeyInvalid
+	}
+	switch err := ws.challengeDB.Use(s.Session.Challenge); err {
+	case nil:
+	case ErrNotFound:
+		return nil, ErrPasskeyInvalid
+	default:
+		return nil, err
+	}
+	return &s.Session, nil
+}
+
+type webAuthnCredentialValidator struct {
+	WebAuthnCredentialDB
+}
+
+func (wv *webAuthnCredentialValidator) ByUserID(userID uint) ([]WebAuthnCredential, error) {
+	if userID <= 0 {
+		return nil, ErrUserIDRequired
+	}
+	return wv.WebAuthnCredentialDB.ByUserID(userID)
+}
+
+func (wv *webAuthnCredentialValidator) Create(cred *WebAuthnCredential) error {
+	err := runWebAuthnCredentialValFuncs(cred,
+		wv.userIDRequired,
+		wv.credentialIDRequired,
+		wv.defaultName,
+		wv.nameMaxLength)
+	if err != nil {
+		return err
+	}
+	return wv.WebAuthnCredentialDB.Create(cred)
+}
+
+func (wv *webAuthnCredentialValidator) Update(cred *WebAuthnCredential) error {
+	err := runWebAuthnCredentialValFuncs(cred,
+		wv.userIDRequired,
+		wv.credentialIDRequired,
+		wv.defaultName,
+		wv.nameMaxLength)
+	if err != nil {
+		return err
+	}
+	return wv.WebAuthnCredentialDB.Update(cred)
+}
+
+func (wv *webAuthnCredentialValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return wv.WebAuthnCredentialDB.Delete(id)
+}
+
+func (wv *webAuthnCredentialValidator) userIDRequired(c *WebAuthnCredential) error {
+	if c.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (wv *webAuthnCredentialValidator) credentialIDRequired(c *WebAuthnCredential) error {
+	if c.CredentialID == "" || len(c.PublicKey) == 0 {
+		return ErrPasskeyInvalid
+	}
+	return nil
+}
+
+func (wv *webAuthnCredentialValidator) defaultName(c *WebAuthnCredential) error {
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Name == "" {
+		c.Name = "Passkey"
+	}
+	return nil
+}
+
+func (wv *webAuthnCredentialValidator) nameMaxLength(c *WebAuthnCredential) error {
+	if len([]rune(c.Name)) > maxPasskeyNameLength {
+		return ErrPasskeyNameTooLong
+	}
+	return nil
+}
+
+type webAuthnCredentialValFunc func(*WebAuthnCredential) error
+
+func runWebAuthnCredentialValFuncs(cred *WebAuthnCredential, fns ...webAuthnCredentialValFunc) error {
+	for _, fn := range fns {
+		if err := fn(cred); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ WebAuthnCredentialDB = &webAuthnCredentialGorm{}
+
+type webAuthnCredentialGorm struct {
+	db *gorm.DB
+}
+
+func (wg *webAuthnCredentialGorm) ByUserID(userID uint) ([]WebAuthnCredential, error) {
+	var creds []WebAuthnCredential
+	err := wg.db.Where("user_id = ?", userID).Order("created_at").Find(&creds).Error
+	if err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+func (wg *webAuthnCredentialGorm) Create(cred *WebAuthnCredential) error {
+	return wg.db.Create(cred).Error
+}
+
+func (wg *webAuthnCredentialGorm) Update(cred *WebAuthnCredential) error {
+	return wg.db.Save(cred).Error
+}
+
+// Passkeys are removed for good, so the same authenticator can be
+// registered again
+func (wg *webAuthnCredentialGorm) Delete(id uint) error {
+	cred := WebAuthnCredential{Model: gorm.Model{ID: id}}
+	return wg.db.Unscoped().Delete(&cred).Error
+}
+
+var _ webAuthnChallengeDB = &webAuthnChallengeGorm{}
+
+type webAuthnChallengeGorm struct {
+	db *gorm.DB
+}
+
+// Create also clears out the challenges of ceremonies that were
+// never finished
+func (cg *webAuthnChallengeGorm) Create(challenge *webAuthnChallenge) error {
+	err := cg.db.Where("expires_at < ?", time.Now()).Delete(&webAuthnChallenge{}).Error
+	if err != nil {
+		return err
+	}
+	return cg.db.Create(challenge).Error
+}
+
+func (cg *webAuthnChallengeGorm) Use(challenge string) error {
+	// Like recovery codes, deleting and checking a row went means two
+	// requests can't both use the same state
+	db := cg.db.Where("challenge = ? AND expires_at > ?", challenge, time.Now()).
+		Delete(&webAuthnChallenge{})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
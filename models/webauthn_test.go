@@ -0,0 +1,296 @@
+package models
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+const (
+	testRPID   = "localhost"
+	testOrigin = "http://localhost:3000"
+
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+)
+
+// softAuthenticator stands in for a security key or a phone, so the
+// ceremonies can be tested without a browser
+type softAuthenticator struct {
+	key   *ecdsa.PrivateKey
+	id    []byte
+	count uint32
+
+	// userHandle is stored when registering, like a passkey
+	userHandle []byte
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &softAuthenticator{key: key, id: id}
+}
+
+func (a *softAuthenticator) authData(flags byte, attested bool) []byte {
+	rpHash := sha256.Sum256([]byte(testRPID))
+	b := append(rpHash[:], flags)
+	b = binary.BigEndian.AppendUint32(b, a.count)
+	if attested {
+		b = append(b, make([]byte, 16)...) // AAGUID
+		b = binary.BigEndian.AppendUint16(b, uint16(len(a.id)))
+		b = append(b, a.id...)
+		coseKey, _ := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+			PublicKeyData: webauthncose.PublicKeyData{
+				KeyType:   int64(webauthncose.EllipticKey),
+				Algorithm: int64(webauthncose.AlgES256),
+			},
+			Curve:  int64(webauthncose.P256),
+			XCoord: a.key.X.FillBytes(make([]byte, 32)),
+			YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+		})
+		b = append(b, coseKey...)
+	}
+	return b
+}
+
+func clientData(typ string, challenge []byte) []byte {
+	b, _ := json.Marshal(map[string]string{
+		"type":      typ,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    testOrigin,
+	})
+	return b
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// create answers navigator.credentials.create with "none" attestation
+func (a *softAuthenticator) create(t *testing.T, creation *protocol.CredentialCreation) []byte {
+	a.userHandle = creation.Response.User.ID.(protocol.URLEncodedBase64)
+	attObj, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authData(flagUserPresent|flagUserVerified|flagAttested, true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(map[string]interface{}{
+		"id":    b64(a.id),
+		"rawId": b64(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64(clientData("webauthn.create", creation.Response.Challenge)),
+			"attestationObject": b64(attObj),
+		},
+	})
+	return b
+}
+
+// get answers navigator.credentials.get, counting the signature
+func (a *softAuthenticator) get(t *testing.T, assertion *protocol.CredentialAssertion, flags byte) []byte {
+	a.count++
+	authData := a.authData(flags, false)
+	cd := clientData("webauthn.get", assertion.Response.Challenge)
+	cdHash := sha256.Sum256(cd)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), cdHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(map[string]interface{}{
+		"id":    b64(a.id),
+		"rawId": b64(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64(cd),
+			"authenticatorData": b64(authData),
+			"signature":         b64(sig),
+			"userHandle":        b64(a.userHandle),
+		},
+	})
+	return b
+}
+
+type webAuthnCredentialMemory struct {
+	creds []WebAuthnCredential
+}
+
+func (m *webAuthnCredentialMemory) ByUserID(userID uint) ([]WebAuthnCredential, error) {
+	var creds []WebAuthnCredential
+	for _, c := range m.creds {
+		if c.UserID == userID {
+			creds = append(creds, c)
+		}
+	}
+	return creds, nil
+}
+
+func (m *webAuthnCredentialMemory) Create(cred *WebAuthnCredential) error {
+	cred.ID = uint(len(m.creds) + 1)
+	m.creds = append(m.creds, *cred)
+	return nil
+}
+
+func (m *webAuthnCredentialMemory) Update(cred *WebAuthnCredential) error {
+	m.creds[cred.ID-1] = *cred
+	return nil
+}
+
+func (m *webAuthnCredentialMemory) Delete(id uint) error {
+	return nil
+}
+
+type userMemory struct {
+	UserDB
+	user *User
+}
+
+func (m *userMemory) ByID(id uint) (*User, error) {
+	if id != m.user.ID {
+		return nil, ErrNotFound
+	}
+	return m.user, nil
+}
+
+func (m *userMemory) Update(user *User) error {
+	m.user = user
+	return nil
+}
+
+// webAuthnChallengeMemory keeps the challenges of started ceremonies
+type webAuthnChallengeMemory map[string]bool
+
+func (m webAuthnChallengeMemory) Create(challenge *webAuthnChallenge) error {
+	m[challenge.Challenge] = true
+	return nil
+}
+
+func (m webAuthnChallengeMemory) Use(challenge string) error {
+	if !m[challenge] {
+		return ErrNotFound
+	}
+	delete(m, challenge)
+	return nil
+}
+
+func testWebAuthnService(t *testing.T, user *User) (*webAuthnService, *webAuthnCredentialMemory) {
+	creds := &webAuthnCredentialMemory{}
+	ws, err := newWebAuthnService(creds, &userMemory{user: user}, webAuthnChallengeMemory{}, testRPID, []string{testOrigin}, "test-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ws, creds
+}
+
+func TestWebAuthnCeremonies(t *testing.T) {
+	user := &User{Email: "jon@example.com"}
+	user.ID = 42
+	ws, creds := testWebAuthnService(t, user)
+	a := newSoftAuthenticator(t)
+
+	creation, state, err := ws.BeginRegistration(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cred, err := ws.FinishRegistration(user, state, " ", bytes.NewReader(a.create(t, creation)))
+	if err != nil {
+		t.Fatalf("Expected registration to succeed. Recieved %v", err)
+	}
+	if cred.Name != "Passkey" || cred.CredentialID != b64(a.id) || len(creds.creds) != 1 {
+		t.Errorf("Expected a stored passkey named Passkey. Recieved %+v", cred)
+	}
+
+	// Passwordless login finds the user from the passkey
+	assertion, state, err := ws.BeginLogin(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := ws.FinishLogin(nil, state, bytes.NewReader(a.get(t, assertion, flagUserPresent|flagUserVerified)))
+	if err != nil {
+		t.Fatalf("Expected passkey login to succeed. Recieved %v", err)
+	}
+	if found.ID != user.ID {
+		t.Errorf("Expected user %d. Recieved %d", user.ID, found.ID)
+	}
+	if c := creds.creds[0]; c.SignCount != 1 || c.LastUsedAt == nil {
+		t.Errorf("Expected sign count 1 and a last used time. Recieved %d, %v", c.SignCount, c.LastUsedAt)
+	}
+
+	// As a second factor the user doesn't have to be verified again
+	assertion, state, err = ws.BeginLogin(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ws.FinishLogin(user, state, bytes.NewReader(a.get(t, assertion, flagUserPresent)))
+	if err != nil {
+		t.Fatalf("Expected second factor to succeed. Recieved %v", err)
+	}
+
+	// Each state only works once
+	if _, err := ws.FinishLogin(user, state, bytes.NewReader(a.get(t, assertion, flagUserPresent))); err != ErrPasskeyInvalid {
+		t.Errorf("Expected a used state to be rejected. Recieved %v", err)
+	}
+
+	// A registration state can't be used to log in
+	_, state, _ = ws.BeginRegistration(user)
+	if _, err := ws.FinishLogin(nil, state, bytes.NewReader(a.get(t, assertion, flagUserPresent|flagUserVerified))); err != ErrPasskeyInvalid {
+		t.Errorf("Expected ErrPasskeyInvalid. Recieved %v", err)
+	}
+}
+
+func TestWebAuthnLoginRejected(t *testing.T) {
+	user := &User{Email: "jon@example.com"}
+	user.ID = 42
+	ws, _ := testWebAuthnService(t, user)
+	a := newSoftAuthenticator(t)
+	creation, state, _ := ws.BeginRegistration(user)
+	if _, err := ws.FinishRegistration(user, state, "Key", bytes.NewReader(a.create(t, creation))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Passwordless login must verify the user
+	assertion, state, _ := ws.BeginLogin(nil)
+	_, err := ws.FinishLogin(nil, state, bytes.NewReader(a.get(t, assertion, flagUserPresent)))
+	if _, ok := err.(passkeyError); !ok {
+		t.Errorf("Expected a passkeyError without user verification. Recieved %v", err)
+	}
+
+	// A signature counter going backwards means a cloned key
+	assertion, state, _ = ws.BeginLogin(user)
+	if _, err := ws.FinishLogin(user, state, bytes.NewReader(a.get(t, assertion, flagUserPresent))); err != nil {
+		t.Fatal(err)
+	}
+	a.count = 0
+	assertion, state, _ = ws.BeginLogin(user)
+	_, err = ws.FinishLogin(user, state, bytes.NewReader(a.get(t, assertion, flagUserPresent)))
+	if _, ok := err.(passkeyError); !ok {
+		t.Errorf("Expected a passkeyError for a cloned key. Recieved %v", err)
+	}
+
+	// Someone else's key doesn't work as a second factor
+	other := newSoftAuthenticator(t)
+	other.userHandle = a.userHandle
+	assertion, state, _ = ws.BeginLogin(user)
+	_, err = ws.FinishLogin(user, state, bytes.NewReader(other.get(t, assertion, flagUserPresent)))
+	if _, ok := err.(passkeyError); !ok {
+		t.Errorf("Expected a passkeyError for an unknown key. Recieved %v", err)
+	}
+}
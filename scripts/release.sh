@@ -42,6 +42,18 @@ ssh root@143.110.237.111 "export GOPATH=/root/go; \
   /usr/local/go/bin/go get github.com/dropbox/dropbox-sdk-go-unofficial/v6/dropbox"
 ssh root@143.110.237.111 "export GOPATH=/root/go; \
   /usr/local/go/bin/go get github.com/dropbox/dropbox-sdk-go-unofficial/v6/dropbox/files"
+ssh root@143.110.237.111 "export GOPATH=/root/go; \
+  /usr/local/go/bin/go get github.com/disintegration/imaging"
+ssh root@143.110.237.111 "export GOPATH=/root/go; \
+  /usr/local/go/bin/go get github.com/chai2010/webp"
+ssh root@143.110.237.111 "export GOPATH=/root/go; \
+  /usr/local/go/bin/go get golang.org/x/image/webp"
+ssh root@143.110.237.111 "export GOPATH=/root/go; \
+  /usr/local/go/bin/go get github.com/rwcarlsen/goexif/exif"
+ssh root@143.110.237.111 "export GOPATH=/root/go; \
+  /usr/local/go/bin/go get github.com/skip2/go-qrcode"
+ssh root@143.110.237.111 "export GOPATH=/root/go; \
+  /usr/local/go/bin/go get github.com/go-webauthn/webauthn/webauthn"
 
 echo "  Building the code on remote server..."
 ssh root@143.110.237.111 'export GOPATH=/root/go; \
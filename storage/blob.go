@@ -0,0 +1,119 @@
+// Package storage provides the blob stores that image files
+// are written to and served from.
+package storage
+
+import (
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ErrNotFound is returned when no blob exists for a key
+	ErrNotFound storageError = "storage: blob not found"
+
+	// ErrKeyInvalid is returned when a key is empty or tries
+	// to escape the store with dot-segments
+	ErrKeyInvalid storageError = "storage: invalid key"
+)
+
+type storageError string
+
+func (e storageError) Error() string {
+	return string(e)
+}
+
+// BlobInfo describes a single stored blob.
+type BlobInfo struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// BlobStore is implemented by every storage backend. Keys are
+// slash separated paths such as "galleries/1/beach.jpg".
+type BlobStore interface {
+	// Put writes the contents of r under key, replacing any
+	// existing blob.
+	Put(key, contentType string, r io.Reader) error
+
+	// Get opens the blob stored under key. The caller must close
+	// the returned reader. ErrNotFound is returned if there is no
+	// such blob.
+	Get(key string) (io.ReadCloser, error)
+
+	// Delete removes the blob stored under key. Deleting a blob
+	// that does not exist is not an error.
+	Delete(key string) error
+
+	// List returns the keys of every blob starting with prefix.
+	List(prefix string) ([]string, error)
+
+	// Stat returns information about the blob stored under key.
+	Stat(key string) (*BlobInfo, error)
+}
+
+// cleanKey normalizes a key and rejects anything that would
+// resolve outside of the store.
+func cleanKey(key string) (string, error) {
+	key = strings.TrimPrefix(key, "/")
+	if key == "" {
+		return "", ErrKeyInvalid
+	}
+	for _, seg := range strings.Split(key, "/") {
+		if seg == "." || seg == ".." {
+			return "", ErrKeyInvalid
+		}
+	}
+	return path.Clean(key), nil
+}
+
+// ServeBlob writes the blob stored under key to w. It doesn't check
+// who is asking, callers have to.
+func ServeBlob(w http.ResponseWriter, r *http.Request, bs BlobStore, key string) {
+	info, err := bs.Stat(key)
+	if err != nil {
+		if err == ErrNotFound || err == ErrKeyInvalid {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	rc, err := bs.Get(key)
+	if err != nil {
+		if err == ErrNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+
+	// Blobs are served with the type they were stored with and never
+	// sniffed, so a file can't pass as HTML on our origin
+	contentType := info.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// Local files can seek, which gets us range requests for free
+	if rs, ok := rc.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, path.Base(key), info.ModTime, rs)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	if !info.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.Copy(w, rc)
+}
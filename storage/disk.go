@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// diskTempPrefix names the temp files blobs are written to
+	diskTempPrefix = ".upload-"
+
+	// diskTypePrefix names the file next to each blob that holds its
+	// content type, so it is served with the type it was stored with
+	diskTypePrefix = ".type-"
+)
+
+// diskFallbackTypes are the only types guessed from the extension of
+// blobs stored before content types were kept. Anything else is
+// served as a download rather than trusting the key.
+var diskFallbackTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// NewDisk creates a BlobStore that keeps blobs as files
+// below the root directory.
+func NewDisk(root string) *Disk {
+	return &Disk{root: root}
+}
+
+// Compiler check to make sure Disk implements BlobStore
+var _ BlobStore = &Disk{}
+
+// Disk is a BlobStore backed by the local filesystem.
+type Disk struct {
+	root string
+}
+
+func (d *Disk) Put(key, contentType string, r io.Reader) error {
+	p, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	if err := d.writeFile(d.typePath(p), strings.NewReader(contentType)); err != nil {
+		return err
+	}
+	return d.writeFile(p, r)
+}
+
+// writeFile writes to a temp file first so readers never see a
+// partial file
+func (d *Disk) writeFile(p string, r io.Reader) error {
+	tmp, err := os.CreateTemp(filepath.Dir(p), diskTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (d *Disk) Get(key string) (io.ReadCloser, error) {
+	p, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (d *Disk) Delete(key string) error {
+	p, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(d.typePath(p))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (d *Disk) List(prefix string) ([]string, error) {
+	// Only walk the directory the prefix lives in
+	dir := d.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		p, err := d.path(prefix[:i])
+		if err != nil {
+			return nil, err
+		}
+		dir = p
+	}
+
+	var keys []string
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() || diskReserved(fi.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(d.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (d *Disk) Stat(key string) (*BlobInfo, error) {
+	p, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, ErrNotFound
+	}
+	key, _ = cleanKey(key)
+	contentType, err := d.contentType(p, key)
+	if err != nil {
+		return nil, err
+	}
+	return &BlobInfo{
+		Key:         key,
+		Size:        fi.Size(),
+		ContentType: contentType,
+		ModTime:     fi.ModTime(),
+	}, nil
+}
+
+func (d *Disk) contentType(p, key string) (string, error) {
+	b, err := os.ReadFile(d.typePath(p))
+	if err == nil {
+		return string(b), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	contentType := mime.TypeByExtension(strings.ToLower(path.Ext(key)))
+	if !diskFallbackTypes[contentType] {
+		contentType = "application/octet-stream"
+	}
+	return contentType, nil
+}
+
+func (d *Disk) path(key string) (string, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	if diskReserved(path.Base(key)) {
+		return "", ErrKeyInvalid
+	}
+	return filepath.Join(d.root, filepath.FromSlash(key)), nil
+}
+
+func (d *Disk) typePath(p string) string {
+	return filepath.Join(filepath.Dir(p), diskTypePrefix+filepath.Base(p))
+}
+
+// diskReserved reports whether name is one of the files Disk keeps
+// next to the blobs, rather than a blob
+func diskReserved(name string) bool {
+	return strings.HasPrefix(name, diskTempPrefix) || strings.HasPrefix(name, diskTypePrefix)
+}
@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Algorithm   = "AWS4-HMAC-SHA256"
+	s3DateFormat  = "20060102T150405Z"
+	s3ShortFormat = "20060102"
+	s3EmptyHash   = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// NewS3 creates a BlobStore that talks to an S3 compatible object
+// store such as AWS S3 or MinIO. Requests use path-style URLs, so
+// the endpoint is the bare service URL, eg http://localhost:9000.
+func NewS3(endpoint, region, bucket, accessKey, secretKey string) (*S3, error) {
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("storage: invalid S3 endpoint %q", endpoint)
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3{
+		endpoint:  u,
+		region:    region,
+		bucket:    bucket,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+		now:       time.Now,
+	}, nil
+}
+
+// Compiler check to make sure S3 implements BlobStore
+var _ BlobStore = &S3{}
+
+// S3 is a BlobStore backed by an S3 compatible object store.
+type S3 struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+	now       func() time.Time
+}
+
+func (s *S3) Put(key, contentType string, r io.Reader) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+
+	// S3 needs the content length and payload hash up front, so we
+	// spool the body to a temp file rather than holding it in memory.
+	tmp, err := os.CreateTemp("", "s3-put-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	req, err := s.newRequest(http.MethodPut, key, nil, tmp)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = n
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := s.do(req, hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) Get(key string) (io.ReadCloser, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := s.newRequest(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, s3EmptyHash)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3) Delete(key string) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+	req, err := s.newRequest(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, s3EmptyHash)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) List(prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", prefix)
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		req, err := s.newRequest(http.MethodGet, "", q, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.do(req, s3EmptyHash)
+		if err != nil {
+			return nil, err
+		}
+		var res s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range res.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+func (s *S3) Stat(key string) (*BlobInfo, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := s.newRequest(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, s3EmptyHash)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	info := BlobInfo{
+		Key:         key,
+		ContentType: resp.Header.Get("Content-Type"),
+	}
+	info.Size, _ = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &info, nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// newRequest builds a path-style request for the bucket, or for an
+// object in the bucket when key is not empty.
+func (s *S3) newRequest(method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	p := "/" + s3Escape(s.bucket, false)
+	if key != "" {
+		p += "/" + s3Escape(key, true)
+	}
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = ""
+	raw := u.String() + p
+	if len(query) > 0 {
+		raw += "?" + s3Query(query)
+	}
+	return http.NewRequest(method, raw, body)
+}
+
+// do signs and sends req, turning non 2xx responses into errors.
+func (s *S3) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	s.sign(req, payloadHash)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("storage: S3 %s %s returned %s: %s",
+			req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req.
+func (s *S3) sign(req *http.Request, payloadHash string) {
+	now := s.now().UTC()
+	amzDate := now.Format(s3DateFormat)
+	shortDate := now.Format(s3ShortFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.URL.Host
+	canonicalHeaders := "host:" + host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3Query(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := shortDate + "/" + s.region + "/s3/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := s3Algorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+
+	key := s3HMAC([]byte("AWS4"+s.secretKey), shortDate)
+	key = s3HMAC(key, s.region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.accessKey, scope, signedHeaders, signature))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Query encodes query values sorted by key, as SigV4 requires.
+func s3Query(v url.Values) string {
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string(nil), v[k]...)
+		sort.Strings(vals)
+		for _, val := range vals {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(val, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything but the RFC 3986 unreserved
+// characters, optionally leaving slashes alone.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is a tiny in-memory stand-in for MinIO that understands
+// just enough of the S3 API for the S3 BlobStore.
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+	types   map[string]string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), s3Algorithm+" Credential=key/") {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+	prefix := "/" + f.bucket
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		var res s3ListResult
+		var keys []string
+		for k := range f.objects {
+			if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			res.Contents = append(res.Contents, struct {
+				Key string `xml:"Key"`
+			}{k})
+		}
+		xml.NewEncoder(w).Encode(res)
+	case r.Method == http.MethodPut:
+		b, _ := io.ReadAll(r.Body)
+		sum := sha256.Sum256(b)
+		if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+			http.Error(w, "XAmzContentSHA256Mismatch", http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = b
+		f.types[key] = r.Header.Get("Content-Type")
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		b, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", f.types[key])
+		w.Write(b)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func testBlobStore(t *testing.T, bs BlobStore) {
+	if err := bs.Put("galleries/1/a b.jpg", "image/jpeg", strings.NewReader("jpeg data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.Put("galleries/2/c.png", "image/png", strings.NewReader("png")); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := bs.Get("galleries/1/a b.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(b) != "jpeg data" {
+		t.Errorf("Expected %q. Recieved %q", "jpeg data", b)
+	}
+
+	info, err := bs.Stat("galleries/1/a b.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 9 || info.ContentType != "image/jpeg" {
+		t.Errorf("Unexpected blob info %+v", info)
+	}
+
+	keys, err := bs.List("galleries/1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "galleries/1/a b.jpg" {
+		t.Errorf("Expected only galleries/1/a b.jpg. Recieved %v", keys)
+	}
+
+	if err := bs.Delete("galleries/1/a b.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.Get("galleries/1/a b.jpg"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound. Recieved %v", err)
+	}
+	if err := bs.Delete("galleries/1/a b.jpg"); err != nil {
+		t.Errorf("Expected deleting a missing blob to succeed. Recieved %v", err)
+	}
+	if err := bs.Put("../escape.jpg", "", strings.NewReader("x")); err != ErrKeyInvalid {
+		t.Errorf("Expected ErrKeyInvalid. Recieved %v", err)
+	}
+}
+
+func TestDisk(t *testing.T) {
+	dir, err := os.MkdirTemp("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testBlobStore(t, NewDisk(dir))
+}
+
+func TestS3(t *testing.T) {
+	srv := httptest.NewServer(&fakeS3{
+		bucket:  "photos",
+		objects: make(map[string][]byte),
+		types:   make(map[string]string),
+	})
+	defer srv.Close()
+	s3, err := NewS3(srv.URL, "", "photos", "key", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, s3)
+}
+
+func TestDiskContentType(t *testing.T) {
+	dir, err := os.MkdirTemp("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := NewDisk(dir)
+
+	// The stored type wins over the extension of the key
+	if err := d.Put("galleries/1/x.html", "image/jpeg", strings.NewReader("jpeg")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := d.Stat("galleries/1/x.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ContentType != "image/jpeg" {
+		t.Errorf("Expected image/jpeg. Recieved %q", info.ContentType)
+	}
+
+	// Blobs stored without a type are only guessed as images
+	os.WriteFile(dir+"/galleries/1/old.html", []byte("<html>"), 0644)
+	if info, _ := d.Stat("galleries/1/old.html"); info.ContentType != "application/octet-stream" {
+		t.Errorf("Expected application/octet-stream. Recieved %q", info.ContentType)
+	}
+	if _, err := d.Stat("galleries/1/" + diskTypePrefix + "x.html"); err != ErrKeyInvalid {
+		t.Errorf("Expected ErrKeyInvalid. Recieved %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	ServeBlob(rec, httptest.NewRequest(http.MethodGet, "/x.html", nil), d, "galleries/1/x.html")
+	if ct := rec.Header().Get("Content-Type"); ct != "image/jpeg" {
+		t.Errorf("Expected image/jpeg. Recieved %q", ct)
+	}
+	if rec.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("Expected nosniff. Recieved %q", rec.Header().Get("X-Content-Type-Options"))
+	}
+}
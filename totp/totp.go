@@ -0,0 +1,124 @@
+// Package totp implements the time-based one-time passwords of
+// RFC 6238, as used by authenticator apps for two-factor
+// authentication. Codes are 6 digits, change every 30 seconds and
+// use HMAC-SHA1, which is what every authenticator app supports.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Period is how long each code is valid for
+	Period = 30 * time.Second
+
+	// Digits is the length of a code
+	Digits = 6
+
+	// Skew is how many periods either side of the current one are
+	// accepted, to allow for clocks being a little off
+	Skew = 1
+
+	secretBytes = 20
+)
+
+// ErrSecretInvalid is returned for secrets that aren't base32
+const ErrSecretInvalid totpError = "totp: secret is not valid base32"
+
+type totpError string
+
+func (e totpError) Error() string {
+	return string(e)
+}
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret returns a random secret, base32 encoded the way
+// authenticator apps expect it.
+func NewSecret() (string, error) {
+	b := make([]byte, secretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// Counter is the number of periods between the Unix epoch and t
+func Counter(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code returns the code for the secret at the given counter
+func Code(secret string, counter int64) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, see RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", Digits, n%1000000), nil
+}
+
+// Validate checks code against the codes for the periods around t.
+// It returns the counter the code matched, so callers can refuse a
+// code that was already used, and whether it matched at all.
+func Validate(secret, code string, t time.Time) (int64, bool) {
+	code = strings.Join(strings.Fields(code), "")
+	if len(code) != Digits {
+		return 0, false
+	}
+	now := Counter(t)
+	for c := now - Skew; c <= now+Skew; c++ {
+		want, err := Code(secret, c)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// URL is the otpauth:// URL authenticator apps read from a QR code
+// to add an account. issuer names the site and account the user.
+func URL(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(Digits))
+	v.Set("period", fmt.Sprint(int(Period/time.Second)))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: v.Encode(),
+	}
+	return u.String()
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Join(strings.Fields(secret), ""))
+	key, err := encoding.DecodeString(strings.TrimRight(secret, "="))
+	if err != nil || len(key) == 0 {
+		return nil, ErrSecretInvalid
+	}
+	return key, nil
+}
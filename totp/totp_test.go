@@ -0,0 +1,59 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCode(t *testing.T) {
+	// The SHA1 test vectors from RFC 6238 appendix B, which are 8
+	// digits long, so only their last 6 digits are compared
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	vectors := map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	}
+	for unix, want := range vectors {
+		got, err := Code(secret, Counter(time.Unix(unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want[2:] {
+			t.Errorf("Expected %s at %d. Recieved %s", want[2:], unix, got)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	code, err := Code(secret, Counter(now.Add(-Period)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter, ok := Validate(secret, code[:3]+" "+code[3:], now)
+	if !ok || counter != Counter(now)-1 {
+		t.Errorf("Expected the previous code to be accepted. Recieved %d, %v", counter, ok)
+	}
+	if _, ok := Validate(secret, code, now.Add(2*Period)); ok {
+		t.Error("Expected an old code to be refused")
+	}
+	if _, ok := Validate("not base32!", code, now); ok {
+		t.Error("Expected an invalid secret to be refused")
+	}
+}
+
+func TestURL(t *testing.T) {
+	u := URL("Gallery", "jon@example.com", "JBSWY3DPEHPK3PXP")
+	if !strings.HasPrefix(u, "otpauth://totp/Gallery:jon@example.com?") || !strings.Contains(u, "secret=JBSWY3DPEHPK3PXP") {
+		t.Errorf("Expected an otpauth URL. Recieved %s", u)
+	}
+}
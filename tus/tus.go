@@ -0,0 +1,364 @@
+// Package tus keeps the partial files of resumable uploads made with
+// the tus 1.0 protocol, https://tus.io/protocols/resumable-upload,
+// until they are complete. Uploads are kept on local disk as a data
+// file holding the bytes received so far next to a JSON info file.
+package tus
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imattf/go-courses/gallery/rand"
+)
+
+const (
+	// Version is the protocol version we speak, sent as Tus-Resumable
+	Version = "1.0.0"
+
+	// Extensions are the protocol extensions we support, sent as
+	// Tus-Extension
+	Extensions = "creation,termination,expiration"
+
+	// ContentType is the content type PATCH requests must have
+	ContentType = "application/offset+octet-stream"
+)
+
+const (
+	// ErrNotFound is returned for unknown and expired uploads
+	ErrNotFound tusError = "tus: upload not found"
+
+	// ErrOffsetMismatch is returned when a chunk doesn't start where
+	// the upload left off
+	ErrOffsetMismatch tusError = "tus: upload offset does not match"
+
+	// ErrSizeInvalid is returned for upload lengths that are zero,
+	// negative or over the maximum size
+	ErrSizeInvalid tusError = "tus: upload length is not valid"
+
+	// ErrTooLarge is returned when more data is sent than the upload
+	// length that was declared
+	ErrTooLarge tusError = "tus: upload is larger than its declared length"
+
+	// ErrMetadataInvalid is returned for malformed Upload-Metadata
+	ErrMetadataInvalid tusError = "tus: upload metadata is not valid"
+
+	// ErrLocked is returned when a chunk is sent for an upload that
+	// is already receiving one
+	ErrLocked tusError = "tus: upload is already in progress"
+)
+
+type tusError string
+
+func (e tusError) Error() string {
+	return string(e)
+}
+
+// Upload is a file being uploaded, along with who is uploading it
+type Upload struct {
+	ID        string            `json:"id"`
+	Size      int64             `json:"size"`
+	Metadata  map[string]string `json:"metadata"`
+	GalleryID uint              `json:"gallery_id"`
+	UserID    uint              `json:"user_id"`
+	ExpiresAt time.Time         `json:"expires_at"`
+
+	// Offset is how many bytes were received so far. It is read from
+	// the data file rather than stored.
+	Offset int64 `json:"-"`
+}
+
+// Complete reports whether every byte of the upload was received
+func (u *Upload) Complete() bool {
+	return u.Offset == u.Size
+}
+
+type Config func(*Store)
+
+// WithMaxSize sets the largest upload that can be created
+func WithMaxSize(n int64) Config {
+	return func(s *Store) {
+		s.maxSize = n
+	}
+}
+
+// WithTTL sets how long an upload may take before it expires
+func WithTTL(d time.Duration) Config {
+	return func(s *Store) {
+		s.ttl = d
+	}
+}
+
+// NewStore creates a Store keeping uploads in dir, which is created
+// if needed, with our defaults of 20MB uploads that expire after a
+// day.
+func NewStore(dir string, cfgs ...Config) (*Store, error) {
+	s := Store{
+		dir:     dir,
+		maxSize: 20 << 20,
+		ttl:     24 * time.Hour,
+		writing: make(map[string]bool),
+	}
+	for _, cfg := range cfgs {
+		cfg(&s)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Store keeps uploads in progress
+type Store struct {
+	dir     string
+	maxSize int64
+	ttl     time.Duration
+
+	// writing holds the IDs of uploads currently receiving a chunk
+	mu      sync.Mutex
+	writing map[string]bool
+}
+
+// MaxSize is the largest upload that can be created, sent as Tus-Max-Size
+func (s *Store) MaxSize() int64 {
+	return s.maxSize
+}
+
+// Create starts a new upload, setting its ID and ExpiresAt. Size,
+// GalleryID and UserID must be set.
+func (s *Store) Create(u *Upload) error {
+	if u.Size <= 0 || u.Size > s.maxSize {
+		return ErrSizeInvalid
+	}
+	b, err := rand.Bytes(16)
+	if err != nil {
+		return err
+	}
+	u.ID = hex.EncodeToString(b)
+	u.ExpiresAt = time.Now().Add(s.ttl).UTC()
+	u.Offset = 0
+
+	f, err := os.OpenFile(s.dataPath(u.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	info, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.infoPath(u.ID), info, 0600); err != nil {
+		os.Remove(s.dataPath(u.ID))
+		return err
+	}
+	return nil
+}
+
+// Get looks up an upload that hasn't expired
+func (s *Store) Get(id string) (*Upload, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+	data, err := os.ReadFile(s.infoPath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var u Upload
+	if err := json.Unmarshal(data, &u); err != nil {
+		return nil, err
+	}
+	if time.Now().After(u.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+	fi, err := os.Stat(s.dataPath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	u.Offset = fi.Size()
+	return &u, nil
+}
+
+// Write appends the chunk read from r to the upload, which must have
+// received exactly offset bytes so far. Whatever is read before r
+// fails is kept, so the client can resume from the returned upload's
+// Offset after a dropped connection.
+func (s *Store) Write(id string, offset int64, r io.Reader) (*Upload, error) {
+	if !s.lock(id) {
+		return nil, ErrLocked
+	}
+	defer s.unlock(id)
+
+	u, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if offset != u.Offset {
+		return u, ErrOffsetMismatch
+	}
+	f, err := os.OpenFile(s.dataPath(id), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	remaining := u.Size - u.Offset
+	n, err := io.Copy(f, io.LimitReader(r, remaining+1))
+	if n > remaining {
+		// Drop the extra bytes so the upload can still be completed
+		f.Truncate(u.Size)
+		u.Offset = u.Size
+		return u, ErrTooLarge
+	}
+	u.Offset += n
+	return u, err
+}
+
+// Finish passes the data of a complete upload to fn and then removes
+// the upload, whether or not fn succeeded. Uploads are only ever
+// finished once, later calls return ErrNotFound.
+func (s *Store) Finish(id string, fn func(u *Upload, data io.Reader) error) error {
+	if !s.lock(id) {
+		return ErrLocked
+	}
+	defer s.unlock(id)
+
+	u, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	if !u.Complete() {
+		return ErrOffsetMismatch
+	}
+	f, err := os.Open(s.dataPath(id))
+	if err != nil {
+		return err
+	}
+	defer s.remove(id)
+	defer f.Close()
+	return fn(u, f)
+}
+
+// Remove deletes an upload and its data
+func (s *Store) Remove(id string) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+	if !s.lock(id) {
+		return ErrLocked
+	}
+	defer s.unlock(id)
+	return s.remove(id)
+}
+
+// remove deletes the files of an upload, which the caller has locked
+func (s *Store) remove(id string) error {
+	err := os.Remove(s.dataPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(s.infoPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Sweep removes expired uploads, returning how many were removed
+func (s *Store) Sweep() (int, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.info"))
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, p := range paths {
+		id := strings.TrimSuffix(filepath.Base(p), ".info")
+		if !validID(id) {
+			continue
+		}
+		if _, err := s.Get(id); err != ErrNotFound {
+			continue
+		}
+		if s.lock(id) {
+			if err := s.remove(id); err == nil {
+				removed++
+			}
+			s.unlock(id)
+		}
+	}
+	return removed, nil
+}
+
+func (s *Store) lock(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writing[id] {
+		return false
+	}
+	s.writing[id] = true
+	return true
+}
+
+func (s *Store) unlock(id string) {
+	s.mu.Lock()
+	delete(s.writing, id)
+	s.mu.Unlock()
+}
+
+func (s *Store) dataPath(id string) string {
+	return filepath.Join(s.dir, id+".bin")
+}
+
+func (s *Store) infoPath(id string) string {
+	return filepath.Join(s.dir, id+".info")
+}
+
+// validID reports whether id looks like an ID made by Create, which
+// also keeps IDs taken from URLs from pointing outside the store.
+func validID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// ParseMetadata decodes an Upload-Metadata header, a comma separated
+// list of keys each followed by a space and a base64 encoded value.
+// Values may be left out, which sets them to an empty string.
+func ParseMetadata(header string) (map[string]string, error) {
+	md := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return md, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		if len(parts) == 0 || len(parts) > 2 {
+			return nil, ErrMetadataInvalid
+		}
+		var value []byte
+		if len(parts) == 2 {
+			var err error
+			value, err = base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, ErrMetadataInvalid
+			}
+		}
+		if _, ok := md[parts[0]]; ok {
+			return nil, ErrMetadataInvalid
+		}
+		md[parts[0]] = string(value)
+	}
+	return md, nil
+}
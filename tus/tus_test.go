@@ -0,0 +1,110 @@
+package tus
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParseMetadata(t *testing.T) {
+	md, err := ParseMetadata("filename d2VkZGluZy5qcGc=,is_confidential, filetype aW1hZ2UvanBlZw==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md["filename"] != "wedding.jpg" || md["filetype"] != "image/jpeg" {
+		t.Errorf("Expected filename and filetype to be decoded. Recieved %v", md)
+	}
+	if v, ok := md["is_confidential"]; !ok || v != "" {
+		t.Errorf("Expected is_confidential to be empty. Recieved %q", v)
+	}
+
+	invalid := []string{"filename not-base64!", "a YQ==,a YQ==", "a b c"}
+	for _, h := range invalid {
+		if _, err := ParseMetadata(h); err != ErrMetadataInvalid {
+			t.Errorf("Expected ErrMetadataInvalid for %q. Recieved %v", h, err)
+		}
+	}
+}
+
+// failingReader returns its data and then fails, like a request body
+// when the client's connection drops
+type failingReader struct {
+	r io.Reader
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestStoreResume(t *testing.T) {
+	s, err := NewStore(t.TempDir(), WithMaxSize(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Create(&Upload{Size: 11}); err != ErrSizeInvalid {
+		t.Errorf("Expected ErrSizeInvalid. Recieved %v", err)
+	}
+
+	u := Upload{Size: 10, GalleryID: 1, UserID: 2}
+	if err := s.Create(&u); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Write(u.ID, 0, &failingReader{strings.NewReader("hello")})
+	if err == nil {
+		t.Error("Expected the dropped connection to be reported")
+	}
+	if got.Offset != 5 {
+		t.Errorf("Expected offset 5. Recieved %d", got.Offset)
+	}
+	if _, err := s.Write(u.ID, 0, strings.NewReader("hello")); err != ErrOffsetMismatch {
+		t.Errorf("Expected ErrOffsetMismatch. Recieved %v", err)
+	}
+	got, err = s.Write(u.ID, 5, strings.NewReader("world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Complete() {
+		t.Errorf("Expected upload to be complete. Recieved offset %d", got.Offset)
+	}
+
+	var data []byte
+	err = s.Finish(u.ID, func(u *Upload, r io.Reader) error {
+		data, err = io.ReadAll(r)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "helloworld" {
+		t.Errorf("Expected helloworld. Recieved %q", data)
+	}
+	if _, err := s.Get(u.ID); err != ErrNotFound {
+		t.Errorf("Expected finished upload to be removed. Recieved %v", err)
+	}
+	if _, err := s.Get("../../etc/passwd"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound. Recieved %v", err)
+	}
+}
+
+func TestStoreTooLarge(t *testing.T) {
+	s, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := Upload{Size: 3}
+	if err := s.Create(&u); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Write(u.ID, 0, strings.NewReader("abcdef"))
+	if err != ErrTooLarge {
+		t.Errorf("Expected ErrTooLarge. Recieved %v", err)
+	}
+	if got.Offset != 3 {
+		t.Errorf("Expected the extra bytes to be dropped. Recieved offset %d", got.Offset)
+	}
+}
@@ -0,0 +1,242 @@
+// Package unzip reads the files out of ZIP archives uploaded by users,
+// such as the bulk uploads posted to ImageArchive, without trusting
+// the entry names or the sizes the archive claims.
+package unzip
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	// ErrInvalid is returned for files that aren't ZIP archives
+	ErrInvalid unzipError = "unzip: file is not a valid zip archive"
+
+	// ErrTooManyEntries is returned for archives with more than
+	// MaxEntries files
+	ErrTooManyEntries unzipError = "unzip: archive contains too many files"
+
+	// ErrTooLarge is returned for archives whose files add up to more
+	// than MaxTotalSize once decompressed
+	ErrTooLarge unzipError = "unzip: archive is too large once extracted"
+
+	// ErrEntryTooLarge is returned for a single file over MaxEntrySize
+	ErrEntryTooLarge unzipError = "unzip: file is too large"
+
+	// ErrUnsafeName is returned for entries whose name is absolute or
+	// climbs out of the archive, eg ../../etc/passwd
+	ErrUnsafeName unzipError = "unzip: file name is not allowed"
+
+	// ErrUnsupported is returned for symlinks and encrypted entries
+	ErrUnsupported unzipError = "unzip: file type is not supported"
+)
+
+type unzipError string
+
+func (e unzipError) Error() string {
+	return string(e)
+}
+
+// Public lets unzip errors be shown to users, see views.PublicError
+func (e unzipError) Public() string {
+	s := strings.Replace(string(e), "unzip: ", "", 1)
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// Result is the outcome of extracting a single entry
+type Result struct {
+	// Name is the entry's path within the archive
+	Name     string
+	Filename string
+	Err      error
+}
+
+// HandlerFunc is called with the contents of every entry that passed
+// the checks, with res.Filename set to the base name of the entry.
+// The handler may change res.Filename to whatever name the file was
+// stored under.
+type HandlerFunc func(res *Result, body io.Reader) error
+
+type Config func(*Extractor)
+
+// WithMaxEntries sets how many files an archive may contain,
+// directories not included
+func WithMaxEntries(n int) Config {
+	return func(e *Extractor) {
+		e.maxEntries = n
+	}
+}
+
+// WithMaxEntrySize sets the largest single file that will be read
+func WithMaxEntrySize(n int64) Config {
+	return func(e *Extractor) {
+		e.maxEntrySize = n
+	}
+}
+
+// WithMaxTotalSize sets how much may be read from one archive in total
+func WithMaxTotalSize(n int64) Config {
+	return func(e *Extractor) {
+		e.maxTotalSize = n
+	}
+}
+
+// New creates an Extractor, applying the configs over our defaults of
+// 1000 files of up to 20MB each and 2GB in total.
+func New(cfgs ...Config) *Extractor {
+	e := Extractor{
+		maxEntries:   1000,
+		maxEntrySize: 20 << 20,
+		maxTotalSize: 2 << 30,
+	}
+	for _, cfg := range cfgs {
+		cfg(&e)
+	}
+	return &e
+}
+
+// Extractor reads archives within its limits
+type Extractor struct {
+	maxEntries   int
+	maxEntrySize int64
+	maxTotalSize int64
+}
+
+// ExtractAll passes every file in the archive to fn, in archive
+// order, and returns one Result per file. Directories and the clutter
+// added by operating systems, such as __MACOSX/ and .DS_Store, are
+// skipped without a Result. An error is only returned when the
+// archive as a whole is rejected, in which case fn is never called.
+func (e *Extractor) ExtractAll(r io.ReaderAt, size int64, fn HandlerFunc) ([]Result, error) {
+	zr, err := zip.NewReader(r, size)
+	// Insecure names are reported per entry by SafeName, rather than
+	// rejecting the whole archive
+	if err != nil && !errors.Is(err, zip.ErrInsecurePath) {
+		return nil, ErrInvalid
+	}
+	var files []*zip.File
+	var total uint64
+	for _, f := range zr.File {
+		if skip(f) {
+			continue
+		}
+		files = append(files, f)
+		total += f.UncompressedSize64
+	}
+	if len(files) > e.maxEntries {
+		return nil, ErrTooManyEntries
+	}
+	// The sizes in the archive are checked up front so obviously
+	// oversized archives are rejected before anything is stored, and
+	// again while reading since they can't be trusted.
+	if total > uint64(e.maxTotalSize) {
+		return nil, ErrTooLarge
+	}
+
+	remaining := e.maxTotalSize
+	results := make([]Result, 0, len(files))
+	for _, f := range files {
+		res := Result{Name: f.Name}
+		if remaining < 0 {
+			res.Err = ErrTooLarge
+		} else {
+			res.Err = e.extract(f, &res, &remaining, fn)
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+func (e *Extractor) extract(f *zip.File, res *Result, remaining *int64, fn HandlerFunc) error {
+	name, err := SafeName(f.Name)
+	if err != nil {
+		return err
+	}
+	res.Filename = path.Base(name)
+	if f.Mode()&os.ModeSymlink != 0 || f.Flags&0x1 != 0 {
+		return ErrUnsupported
+	}
+	if f.UncompressedSize64 > uint64(e.maxEntrySize) {
+		return ErrEntryTooLarge
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return ErrInvalid
+	}
+	defer rc.Close()
+
+	limit := e.maxEntrySize
+	if *remaining < limit {
+		limit = *remaining
+	}
+	body := &limitedReader{r: rc, n: limit, err: ErrEntryTooLarge}
+	if limit < e.maxEntrySize {
+		body.err = ErrTooLarge
+	}
+	err = fn(res, body)
+	*remaining -= limit - body.n
+	if errors.Is(err, zip.ErrChecksum) || errors.Is(err, zip.ErrFormat) {
+		return ErrInvalid
+	}
+	return err
+}
+
+// SafeName cleans an entry name, returning ErrUnsafeName for absolute
+// names and names that would end up outside the directory the archive
+// was extracted to.
+func SafeName(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, ":") {
+		return "", ErrUnsafeName
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", ErrUnsafeName
+		}
+	}
+	cleaned := path.Clean(name)
+	if cleaned == "." {
+		return "", ErrUnsafeName
+	}
+	return cleaned, nil
+}
+
+// skip reports whether an entry is a directory or operating system
+// clutter rather than a file the user meant to upload
+func skip(f *zip.File) bool {
+	if f.FileInfo().IsDir() || strings.HasSuffix(f.Name, "/") {
+		return true
+	}
+	name := strings.ReplaceAll(f.Name, "\\", "/")
+	if strings.HasPrefix(name, "__MACOSX/") {
+		return true
+	}
+	base := path.Base(name)
+	return strings.HasPrefix(base, ".") || base == "Thumbs.db"
+}
+
+// limitedReader returns err once more than n bytes are read
+type limitedReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, l.err
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, l.err
+	}
+	return n, err
+}
@@ -0,0 +1,111 @@
+package unzip
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func makeZip(t *testing.T, files map[string]string) *bytes.Reader {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, body := range files {
+		fw, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(fw, body)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestSafeName(t *testing.T) {
+	unsafe := []string{"../evil.jpg", "a/../../evil.jpg", "/etc/passwd",
+		"..\\evil.jpg", "C:\\evil.jpg", ""}
+	for _, name := range unsafe {
+		if _, err := SafeName(name); err != ErrUnsafeName {
+			t.Errorf("Expected %q to be unsafe. Recieved %v", name, err)
+		}
+	}
+	got, err := SafeName("wedding/./ceremony/a.jpg")
+	if err != nil || got != "wedding/ceremony/a.jpg" {
+		t.Errorf("Expected wedding/ceremony/a.jpg. Recieved %q, %v", got, err)
+	}
+}
+
+func TestExtractAll(t *testing.T) {
+	zr := makeZip(t, map[string]string{
+		"photos/a.jpg":          "small",
+		"photos/big.jpg":        strings.Repeat("x", 100),
+		"../../evil.jpg":        "evil",
+		"__MACOSX/photos/._a":   "junk",
+		"photos/.DS_Store":      "junk",
+		"photos/empty-dir/":     "",
+		"photos/nested/b.jpg":   "small",
+		"photos/nested/.hidden": "junk",
+	})
+	e := New(WithMaxEntrySize(10))
+	var handled []string
+	results, err := e.ExtractAll(zr, zr.Size(), func(res *Result, body io.Reader) error {
+		_, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		handled = append(handled, res.Filename)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("Expected 4 results. Recieved %d: %v", len(results), results)
+	}
+	errs := make(map[string]error)
+	for _, res := range results {
+		errs[res.Name] = res.Err
+	}
+	if errs["photos/a.jpg"] != nil || errs["photos/nested/b.jpg"] != nil {
+		t.Errorf("Expected small files to be extracted. Recieved %v", errs)
+	}
+	if errs["photos/big.jpg"] != ErrEntryTooLarge {
+		t.Errorf("Expected ErrEntryTooLarge. Recieved %v", errs["photos/big.jpg"])
+	}
+	if errs["../../evil.jpg"] != ErrUnsafeName {
+		t.Errorf("Expected ErrUnsafeName. Recieved %v", errs["../../evil.jpg"])
+	}
+	if len(handled) != 2 {
+		t.Errorf("Expected 2 files to be handled. Recieved %v", handled)
+	}
+}
+
+func TestExtractAllLimits(t *testing.T) {
+	zr := makeZip(t, map[string]string{"a.jpg": "12345", "b.jpg": "12345", "c.jpg": "12345"})
+	called := false
+	fn := func(res *Result, body io.Reader) error {
+		called = true
+		return nil
+	}
+
+	_, err := New(WithMaxEntries(2)).ExtractAll(zr, zr.Size(), fn)
+	if err != ErrTooManyEntries {
+		t.Errorf("Expected ErrTooManyEntries. Recieved %v", err)
+	}
+	_, err = New(WithMaxTotalSize(10)).ExtractAll(zr, zr.Size(), fn)
+	if err != ErrTooLarge {
+		t.Errorf("Expected ErrTooLarge. Recieved %v", err)
+	}
+	if called {
+		t.Error("Handler should not be called for rejected archives")
+	}
+
+	notZip := strings.NewReader("not a zip")
+	_, err = New().ExtractAll(notZip, notZip.Size(), fn)
+	if err != ErrInvalid {
+		t.Errorf("Expected ErrInvalid. Recieved %v", err)
+	}
+}